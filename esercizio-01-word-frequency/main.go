@@ -2,12 +2,29 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"container/heap"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
 )
 
 type WordCount struct {
@@ -16,88 +33,943 @@ type WordCount struct {
 }
 
 func main() {
-	counts := make(map[string]int)
 	top := flag.Int("top", 0, "numero di parole da mostrare (0 = tutte)")
 	ignoreCase := flag.Bool("ignore-case", true, "ignora maiuscole/minuscole")
+	normalize := flag.Bool("normalize", false, "normalizza in NFC, così forme composte e decomposte (\"café\") contano insieme")
+	foldAccents := flag.Bool("fold-accents", false, "rimuove gli accenti (\"café\" -> \"cafe\")")
+	stripPunct := flag.Bool("strip-punct", false, "scarta i token composti solo da punteggiatura/simboli")
+	replaceFile := flag.String("replace", "", "file di sostituzioni from=to, una per riga")
+	groupByLetter := flag.Bool("group-by-letter", false, "raggruppa le parole per lettera iniziale")
+	outFile := flag.String("o", "", "scrive anche la lista di parole su questo file")
+	appendMode := flag.Bool("append", false, "con -o: unisce con il contenuto del file senza duplicare le parole")
+	excludeNumbers := flag.Bool("exclude-numbers", false, "scarta i token composti solo da cifre (\"2024\")")
+	excludeMixed := flag.Bool("exclude-mixed", false, "con -exclude-numbers: scarta anche i token misti lettere/cifre (\"mp3\")")
+	sample := flag.Float64("sample", 1, "frazione di righe da analizzare, 0 < P <= 1 (conteggi approssimati se < 1)")
+	seed := flag.Int64("seed", 0, "seed del campionamento, per run riproducibili (0 = casuale)")
+	workers := flag.Int("workers", 1, "file analizzati in parallelo")
+	tfidfMode := flag.Bool("tfidf", false, "tratta ogni file come un documento e mostra i termini con TF-IDF più alto per documento")
+	stopwords := flag.String("stopwords", "", "parole da non contare: en, it oppure un file con una parola per riga")
+	format := flag.String("format", "text", "formato di output: text, json o csv")
+	minCount := flag.Int("min-count", 2, "mostra solo le parole con almeno N occorrenze")
+	ngram := flag.Int("ngram", 1, "conta sequenze di N parole consecutive invece delle singole parole")
+	gzipInput := flag.Bool("gzip", false, "decomprime tutti gli input gzip, stdin compreso (i file .gz lo sono sempre)")
+	reverse := flag.Bool("reverse", false, "ordina per frequenza crescente: con -top N mostra le N parole più rare tra quelle con almeno -min-count occorrenze")
+	percent := flag.Bool("percent", false, "mostra la percentuale di ogni parola sul totale")
+	minLen := flag.Int("min-len", 0, "scarta le parole più corte di N caratteri (0 = nessun limite)")
+	maxLen := flag.Int("max-len", 0, "scarta le parole più lunghe di N caratteri (0 = nessun limite)")
+	cjk := flag.String("cjk", "", "segmenta il testo CJK: chars (un ideogramma per token) o bigrams (coppie sovrapposte)")
 	flag.Parse()
 	files := flag.Args()
 
+	switch *format {
+	case "text", "json", "csv":
+	default:
+		fmt.Fprintf(os.Stderr, "formato sconosciuto %q (valori ammessi: text, json, csv)\n", *format)
+		os.Exit(1)
+	}
+	if *sample <= 0 || *sample > 1 {
+		fmt.Fprintln(os.Stderr, "-sample deve essere compreso tra 0 (escluso) e 1")
+		os.Exit(1)
+	}
+	var keep lineSampler
+	if *sample < 1 {
+		s := *seed
+		if s == 0 {
+			s = rand.Int63()
+		}
+		keep = newLineSampler(*sample, s)
+	}
+
+	var replacements map[string]string
+	if *replaceFile != "" {
+		var err error
+		replacements, err = loadReplacements(*replaceFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "errore lettura sostituzioni:", err)
+			os.Exit(1)
+		}
+	}
+	pipeline := buildPipeline(*ignoreCase, *normalize, *foldAccents, *stripPunct, replacements)
+	if *ngram < 1 {
+		fmt.Fprintln(os.Stderr, "-ngram deve essere almeno 1")
+		os.Exit(1)
+	}
+	opts := countOptions{pipeline: pipeline, keep: keep, ngram: *ngram, gzip: *gzipInput}
+	if *excludeNumbers {
+		opts.filter = numberFilter(*excludeMixed)
+	}
+	opts.filter = combineFilters(opts.filter, lengthFilter(*minLen, *maxLen))
+	if *stopwords != "" {
+		stop, err := loadStopwords(*stopwords, pipeline)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "errore lettura stopword:", err)
+			os.Exit(1)
+		}
+		opts.filter = combineFilters(opts.filter, stopwordFilter(stop))
+	}
+	segment, err := parseSegmenter(*cjk)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	opts.segment = segment
+
+	if *tfidfMode {
+		names, docs := countDocuments(files, opts)
+		k := *top
+		if k <= 0 {
+			k = 10
+		}
+		printTFIDF(os.Stdout, names, tfidf(docs), k)
+		return
+	}
+
 	// Leggi da file se forniti, altrimenti da stdin.
+	var counter *WordCounter
 	if len(files) > 0 {
-		for _, filename := range files {
-			f, err := os.Open(filename)
-			if err != nil {
-				fmt.Fprintln(os.Stderr, "errore apertura file:", err)
-				continue
-			}
-			if err := countLines(f, counts, *ignoreCase); err != nil {
-				fmt.Fprintln(os.Stderr, "errore lettura file:", err)
-			}
-			f.Close()
+		n := *workers
+		if opts.keep != nil {
+			// il sampler non è condiviso tra goroutine e l'ordine delle righe
+			// deve essere fisso perché -seed sia riproducibile
+			n = 1
 		}
+		counter = countFiles(files, n, opts)
 	} else {
-		if err := countLines(os.Stdin, counts, *ignoreCase); err != nil {
-			fmt.Fprintln(os.Stderr, "errore lettura stdin:", err)
-		}
+		counter = NewWordCounter(opts)
+		feedStdin(counter, opts.gzip)
 	}
 
-	// Converti la mappa in slice per poter ordinare per frequenza.
-	items := make([]WordCount, 0, len(counts))
-	for w, c := range counts {
-		items = append(items, WordCount{Word: w, Count: c})
+	// Calcola statistiche globali.
+	totalWords := counter.Total()
+	uniqueWords := counter.Unique()
+	var shown []WordCount
+	if *reverse {
+		shown = counter.RarestAtLeast(*top, *minCount)
+	} else {
+		shown = counter.TopAtLeast(*top, *minCount)
 	}
-	sort.Slice(items, func(i, j int) bool {
-		if items[i].Count != items[j].Count {
-			return items[i].Count > items[j].Count
+	if *outFile != "" {
+		if err := writeWordFile(*outFile, shown, *appendMode); err != nil {
+			fmt.Fprintln(os.Stderr, "errore scrittura output:", err)
 		}
-		return items[i].Word < items[j].Word
-	})
-	// Calcola statistiche globali.
-	totalWords := 0
-	for _, item := range items {
-		totalWords += item.Count
 	}
 
-	uniqueWords := len(counts)
+	switch *format {
+	case "json":
+		if err := writeJSONReport(os.Stdout, totalWords, uniqueWords, *sample, shown); err != nil {
+			fmt.Fprintln(os.Stderr, "errore scrittura output:", err)
+		}
+		return
+	case "csv":
+		// una riga di commento romperebbe i parser CSV: l'avviso va su stderr
+		if keep != nil {
+			fmt.Fprintf(os.Stderr, "campionamento: %g delle righe, i conteggi sono approssimati\n", *sample)
+		}
+		if err := writeCSVReport(os.Stdout, shown); err != nil {
+			fmt.Fprintln(os.Stderr, "errore scrittura output:", err)
+		}
+		return
+	}
+
 	fmt.Printf("Parole totali: %d\n", totalWords)
-	fmt.Printf("Parole uniche: %d\n\n", uniqueWords)
+	fmt.Printf("Parole uniche: %d\n", uniqueWords)
+	if keep != nil {
+		fmt.Printf("Campionamento: %g delle righe, i conteggi sono approssimati\n", *sample)
+	}
+	fmt.Println()
 
-	if *top > 0 {
+	switch {
+	case *top > 0 && *reverse:
+		fmt.Printf("Top %d parole meno frequenti:\n", *top)
+	case *top > 0:
 		fmt.Printf("Top %d parole più frequenti:\n", *top)
-	} else {
+	case *reverse:
+		fmt.Println("Tutte le parole (ordinate per frequenza crescente):")
+	default:
 		fmt.Println("Tutte le parole (ordinate per frequenza):")
 	}
 
-	// Limita la stampa se è stato richiesto un top N.
-	limit := len(items)
-	if *top > 0 && *top < limit {
-		limit = *top
+	if *groupByLetter {
+		printGroups(os.Stdout, groupByInitial(shown))
+		return
+	}
+
+	// la percentuale è sul totale delle parole contate, non solo su quelle
+	// mostrate, così resta confrontabile tra run con -top diversi
+	percentOf := 0
+	if *percent {
+		percentOf = totalWords
+	}
+	printRanked(os.Stdout, shown, percentOf)
+}
+
+// jsonReport è il formato di -format=json. Sample è la frazione di righe
+// analizzate: sotto 1 i conteggi sono approssimati.
+type jsonReport struct {
+	Total  int        `json:"total"`
+	Unique int        `json:"unique"`
+	Sample float64    `json:"sample"`
+	Words  []jsonWord `json:"words"`
+}
+
+type jsonWord struct {
+	Word  string `json:"word"`
+	Count int    `json:"count"`
+}
+
+func writeJSONReport(w io.Writer, total, unique int, sample float64, items []WordCount) error {
+	report := jsonReport{Total: total, Unique: unique, Sample: sample, Words: make([]jsonWord, len(items))}
+	for i, item := range items {
+		report.Words[i] = jsonWord{Word: item.Word, Count: item.Count}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(report)
+}
+
+// writeCSVReport scrive un'intestazione word,count e una riga per parola.
+func writeCSVReport(w io.Writer, items []WordCount) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"word", "count"})
+	for _, item := range items {
+		cw.Write([]string{item.Word, strconv.Itoa(item.Count)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// openInput apre filename e, se ha suffisso .gz o forceGzip è true, lo
+// decomprime al volo.
+func openInput(filename string, forceGzip bool) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	if !forceGzip && !strings.HasSuffix(filename, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("decompressione %s: %w", filename, err)
+	}
+	return gzipFile{Reader: zr, file: f}, nil
+}
+
+// gzipFile chiude sia il decompressore sia il file sottostante.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// feedStdin conta stdin, decomprimendolo se gz è true; gli errori vanno su stderr.
+func feedStdin(counter *WordCounter, gz bool) {
+	var r io.Reader = os.Stdin
+	if gz {
+		zr, err := gzip.NewReader(os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "errore decompressione stdin:", err)
+			return
+		}
+		defer zr.Close()
+		r = zr
+	}
+	if err := counter.Feed(r); err != nil {
+		fmt.Fprintln(os.Stderr, "errore lettura stdin:", err)
+	}
+}
+
+// countDocuments conta ogni file in una mappa separata; senza file stdin è
+// l'unico documento. I file che non si riescono ad aprire vengono saltati.
+func countDocuments(files []string, opts countOptions) ([]string, []map[string]int) {
+	if len(files) == 0 {
+		counter := NewWordCounter(opts)
+		feedStdin(counter, opts.gzip)
+		return []string{"stdin"}, []map[string]int{counter.counts}
+	}
+
+	var names []string
+	var docs []map[string]int
+	for _, filename := range files {
+		f, err := openInput(filename, opts.gzip)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "errore apertura file:", err)
+			continue
+		}
+		counter := NewWordCounter(opts)
+		if err := counter.Feed(f); err != nil {
+			fmt.Fprintln(os.Stderr, "errore lettura file:", err)
+		}
+		f.Close()
+		names = append(names, filename)
+		docs = append(docs, counter.counts)
+	}
+	return names, docs
+}
+
+type termScore struct {
+	Word  string
+	Score float64
+}
+
+// tfidf calcola per ogni documento tf(t) = occorrenze/parole del documento e
+// idf(t) = ln(N/df), con df il numero di documenti che contengono t. Un
+// termine presente in tutti i documenti ha quindi punteggio 0. I risultati
+// sono ordinati per punteggio decrescente, poi alfabeticamente.
+func tfidf(docs []map[string]int) [][]termScore {
+	df := make(map[string]int)
+	for _, doc := range docs {
+		for w := range doc {
+			df[w]++
+		}
+	}
+	n := float64(len(docs))
+
+	scores := make([][]termScore, len(docs))
+	for i, doc := range docs {
+		total := 0
+		for _, c := range doc {
+			total += c
+		}
+		terms := make([]termScore, 0, len(doc))
+		for w, c := range doc {
+			tf := float64(c) / float64(total)
+			terms = append(terms, termScore{Word: w, Score: tf * math.Log(n/float64(df[w]))})
+		}
+		sort.Slice(terms, func(a, b int) bool {
+			if terms[a].Score != terms[b].Score {
+				return terms[a].Score > terms[b].Score
+			}
+			return terms[a].Word < terms[b].Word
+		})
+		scores[i] = terms
 	}
+	return scores
+}
 
-	for i := 0; i < limit; i++ {
-		if items[i].Count <= 1 {
+func printTFIDF(w io.Writer, names []string, scores [][]termScore, k int) {
+	for i, name := range names {
+		fmt.Fprintf(w, "Documento: %s\n", name)
+		for j, t := range scores[i] {
+			if j == k {
+				break
+			}
+			fmt.Fprintf(w, "%d. %q - %.4f\n", j+1, t.Word, t.Score)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// printRanked stampa la classifica; se total > 0 aggiunge a ogni riga la
+// quota di total che la parola rappresenta.
+func printRanked(w io.Writer, items []WordCount, total int) {
+	for i, item := range items {
+		if total > 0 {
+			pct := 100 * float64(item.Count) / float64(total)
+			fmt.Fprintf(w, "%d. %q - %d occorrenze (%.2f%%)\n", i+1, item.Word, item.Count, pct)
 			continue
 		}
-		fmt.Printf("%d. %q - %d occorrenze\n", i+1, items[i].Word, items[i].Count)
+		fmt.Fprintf(w, "%d. %q - %d occorrenze\n", i+1, item.Word, item.Count)
+	}
+}
+
+// countFiles conta le parole di tutti i file con al massimo workers file letti
+// in parallelo. Ogni worker riempie un suo counter e i counter vengono uniti
+// alla fine: la somma non dipende da come i file sono distribuiti.
+func countFiles(files []string, workers int, opts countOptions) *WordCounter {
+	countFile := func(filename string, counter *WordCounter) {
+		f, err := openInput(filename, opts.gzip)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "errore apertura file:", err)
+			return
+		}
+		defer f.Close()
+		if err := counter.Feed(f); err != nil {
+			fmt.Fprintln(os.Stderr, "errore lettura file:", err)
+		}
 	}
 
+	if workers <= 1 || len(files) == 1 {
+		counter := NewWordCounter(opts)
+		for _, filename := range files {
+			countFile(filename, counter)
+		}
+		return counter
+	}
+
+	jobs := make(chan string)
+	partials := make(chan *WordCounter, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter := NewWordCounter(opts)
+			for filename := range jobs {
+				countFile(filename, counter)
+			}
+			partials <- counter
+		}()
+	}
+	for _, filename := range files {
+		jobs <- filename
+	}
+	close(jobs)
+	wg.Wait()
+	close(partials)
+
+	merged := NewWordCounter(opts)
+	for partial := range partials {
+		merged.Merge(partial)
+	}
+	return merged
 }
 
-func countLines(f *os.File, counts map[string]int, ignoreCase bool) error {
+// wordOrder dice se a va stampata prima di b; deve essere un ordine totale.
+type wordOrder func(a, b WordCount) bool
+
+// wordBefore è l'ordine di stampa: frequenza decrescente, poi alfabetico.
+func wordBefore(a, b WordCount) bool {
+	if a.Count != b.Count {
+		return a.Count > b.Count
+	}
+	return a.Word < b.Word
+}
+
+// rareBefore è l'ordine di -reverse: frequenza crescente, poi alfabetico come
+// in wordBefore.
+func rareBefore(a, b WordCount) bool {
+	if a.Count != b.Count {
+		return a.Count < b.Count
+	}
+	return a.Word < b.Word
+}
+
+// wordHeap è un min-heap rispetto a before: in cima c'è la parola che
+// uscirebbe per prima dalla top K.
+type wordHeap struct {
+	items  []WordCount
+	before wordOrder
+}
+
+func (h *wordHeap) Len() int           { return len(h.items) }
+func (h *wordHeap) Less(i, j int) bool { return h.before(h.items[j], h.items[i]) }
+func (h *wordHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *wordHeap) Push(x any)         { h.items = append(h.items, x.(WordCount)) }
+func (h *wordHeap) Pop() any {
+	x := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return x
+}
+
+// topWords ritorna le prime k parole secondo before, tutte se k <= 0. Con k
+// piccolo usa un heap di dimensione k invece di ordinare tutto; il risultato
+// è identico perché before è un ordine totale. Le parole con meno di minCount
+// occorrenze vengono scartate prima di prendere le prime k.
+func topWords(counts map[string]int, k, minCount int, before wordOrder) []WordCount {
+	if k <= 0 || k >= len(counts) {
+		items := make([]WordCount, 0, len(counts))
+		for w, c := range counts {
+			if c >= minCount {
+				items = append(items, WordCount{Word: w, Count: c})
+			}
+		}
+		sort.Slice(items, func(i, j int) bool { return before(items[i], items[j]) })
+		return items
+	}
+
+	h := &wordHeap{items: make([]WordCount, 0, k+1), before: before}
+	for w, c := range counts {
+		if c < minCount {
+			continue
+		}
+		item := WordCount{Word: w, Count: c}
+		if h.Len() < k {
+			heap.Push(h, item)
+		} else if before(item, h.items[0]) {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+	}
+	items := make([]WordCount, h.Len())
+	for i := len(items) - 1; i >= 0; i-- {
+		items[i] = heap.Pop(h).(WordCount)
+	}
+	return items
+}
+
+var wordLineRe = regexp.MustCompile(`^\d+\. ("(?:[^"\\]|\\.)*") - (\d+) occorrenze$`)
+
+// readWordFile legge un file scritto da writeWordFile. Un file mancante è vuoto.
+func readWordFile(path string) ([]WordCount, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []WordCount
 	scanner := bufio.NewScanner(f)
 	for scanner.Scan() {
-		line := scanner.Text()
-		if ignoreCase {
-			line = strings.ToLower(line)
+		m := wordLineRe.FindStringSubmatch(scanner.Text())
+		if m == nil {
+			continue
 		}
-		// Spezza la riga in parole ignorando punteggiatura e spazi.
-		words := strings.FieldsFunc(line, func(r rune) bool {
-			return !unicode.IsLetter(r) && !unicode.IsNumber(r)
-		})
-		for _, w := range words {
-			if w != "" {
-				counts[w]++
+		word, err := strconv.Unquote(m[1])
+		if err != nil {
+			continue
+		}
+		count, _ := strconv.Atoi(m[2])
+		items = append(items, WordCount{Word: word, Count: count})
+	}
+	return items, scanner.Err()
+}
+
+// mergeWordCounts mantiene l'ordine di existing aggiornando i conteggi con
+// quelli di latest, poi aggiunge in coda le parole nuove di latest.
+func mergeWordCounts(existing, latest []WordCount) []WordCount {
+	latestCount := make(map[string]int, len(latest))
+	for _, item := range latest {
+		latestCount[item.Word] = item.Count
+	}
+	merged := make([]WordCount, 0, len(existing)+len(latest))
+	seen := make(map[string]bool, len(existing))
+	for _, item := range existing {
+		if seen[item.Word] {
+			continue
+		}
+		seen[item.Word] = true
+		if c, ok := latestCount[item.Word]; ok {
+			item.Count = c
+		}
+		merged = append(merged, item)
+	}
+	for _, item := range latest {
+		if !seen[item.Word] {
+			seen[item.Word] = true
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// writeWordFile scrive items su path nel formato della lista a video.
+// Con appendMode il contenuto esistente viene unito senza duplicati.
+// Il file è riscritto in modo atomico (temp + rename).
+func writeWordFile(path string, items []WordCount, appendMode bool) error {
+	if appendMode {
+		existing, err := readWordFile(path)
+		if err != nil {
+			return err
+		}
+		items = mergeWordCounts(existing, items)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriter(tmp)
+	for i, item := range items {
+		fmt.Fprintf(w, "%d. %q - %d occorrenze\n", i+1, item.Word, item.Count)
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+type letterGroup struct {
+	Letter string
+	Words  []WordCount
+}
+
+// groupByInitial raggruppa items (già ordinati per frequenza) per lettera
+// iniziale maiuscola, mantenendo l'ordine interno. Le parole che non iniziano
+// con una lettera finiscono nel gruppo "#", stampato per ultimo.
+func groupByInitial(items []WordCount) []letterGroup {
+	byLetter := make(map[string][]WordCount)
+	for _, item := range items {
+		key := "#"
+		if r, _ := utf8.DecodeRuneInString(item.Word); unicode.IsLetter(r) {
+			key = string(unicode.ToUpper(r))
+		}
+		byLetter[key] = append(byLetter[key], item)
+	}
+
+	groups := make([]letterGroup, 0, len(byLetter))
+	for letter, words := range byLetter {
+		groups = append(groups, letterGroup{Letter: letter, Words: words})
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if (groups[i].Letter == "#") != (groups[j].Letter == "#") {
+			return groups[j].Letter == "#"
+		}
+		return groups[i].Letter < groups[j].Letter
+	})
+	return groups
+}
+
+func printGroups(w io.Writer, groups []letterGroup) {
+	for _, g := range groups {
+		fmt.Fprintf(w, "\n%s\n", g.Letter)
+		for _, item := range g.Words {
+			fmt.Fprintf(w, "  %q - %d occorrenze\n", item.Word, item.Count)
+		}
+	}
+}
+
+// normalizer è uno stadio della pipeline di normalizzazione applicata a ogni
+// token. Ritornare "" scarta il token e interrompe la pipeline.
+type normalizer func(string) string
+
+// buildPipeline compone gli stadi nell'ordine fisso: lowercase, NFC,
+// accent-fold, strip-punct, sostituzioni. Per aggiungere uno stadio basta
+// appenderlo qui.
+func buildPipeline(lowercase, normalize, foldAccents, stripPunct bool, replacements map[string]string) []normalizer {
+	var pipeline []normalizer
+	if lowercase {
+		pipeline = append(pipeline, strings.ToLower)
+	}
+	// NFC dopo il lowercase, così il token che arriva agli stadi successivi è
+	// sempre composto: "CAFÉ" e "café" decomposto diventano lo stesso "café".
+	if normalize {
+		pipeline = append(pipeline, norm.NFC.String)
+	}
+	if foldAccents {
+		pipeline = append(pipeline, foldAccentsStage)
+	}
+	if stripPunct {
+		pipeline = append(pipeline, stripPunctStage)
+	}
+	if len(replacements) > 0 {
+		pipeline = append(pipeline, replaceStage(replacements))
+	}
+	return pipeline
+}
+
+func applyPipeline(pipeline []normalizer, token string) string {
+	for _, stage := range pipeline {
+		token = stage(token)
+		if token == "" {
+			return ""
+		}
+	}
+	return token
+}
+
+// foldAccentsStage decompone in NFD, rimuove i segni combinanti e ricompone.
+func foldAccentsStage(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	out, _, err := transform.String(t, s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+func stripPunctStage(s string) string {
+	for _, r := range s {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			return s
+		}
+	}
+	return ""
+}
+
+// replaceStage sostituisce i token che corrispondono esattamente a una chiave.
+// Le chiavi sono confrontate dopo gli stadi precedenti (es. già in minuscolo).
+func replaceStage(replacements map[string]string) normalizer {
+	return func(s string) string {
+		if to, ok := replacements[s]; ok {
+			return to
+		}
+		return s
+	}
+}
+
+func loadReplacements(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	replacements := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		from, to, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: atteso from=to", path, lineNum)
+		}
+		replacements[strings.TrimSpace(from)] = strings.TrimSpace(to)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return replacements, nil
+}
+
+// wordFilter decide se una parola, già separata dalla punteggiatura, va contata.
+type wordFilter func(string) bool
+
+// numberFilter scarta le parole fatte solo di cifre; con dropMixed anche
+// quelle che mescolano lettere e cifre.
+func numberFilter(dropMixed bool) wordFilter {
+	return func(w string) bool {
+		hasDigit, hasLetter := false, false
+		for _, r := range w {
+			if unicode.IsNumber(r) {
+				hasDigit = true
+			} else {
+				hasLetter = true
+			}
+		}
+		if !hasDigit {
+			return true
+		}
+		return hasLetter && !dropMixed
+	}
+}
+
+// lengthFilter tiene le parole lunghe da minLen a maxLen rune; un limite
+// <= 0 non viene applicato.
+func lengthFilter(minLen, maxLen int) wordFilter {
+	if minLen <= 0 && maxLen <= 0 {
+		return nil
+	}
+	return func(w string) bool {
+		n := utf8.RuneCountInString(w)
+		return (minLen <= 0 || n >= minLen) && (maxLen <= 0 || n <= maxLen)
+	}
+}
+
+// combineFilters tiene una parola solo se passa tutti i filtri non nil;
+// ritorna nil se non ce n'è nessuno.
+func combineFilters(filters ...wordFilter) wordFilter {
+	var active []wordFilter
+	for _, f := range filters {
+		if f != nil {
+			active = append(active, f)
+		}
+	}
+	switch len(active) {
+	case 0:
+		return nil
+	case 1:
+		return active[0]
+	}
+	return func(w string) bool {
+		for _, f := range active {
+			if !f(w) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// builtinStopwords sono le liste selezionabili con -stopwords=en e -stopwords=it.
+var builtinStopwords = map[string]string{
+	"en": `a about after all also an and any are as at be been but by can could do
+		for from had has have he her his how i if in into is it its just me more my
+		no not of on one or our out she so some than that the their them then there
+		these they this to up was we were what when which who will with would you your`,
+	"it": `a ad al alla alle agli ai anche che chi ci come con da dal dalla dei del
+		della delle di e ed gli ha hanno ho i il in io la le lei lo loro lui ma mi
+		ne negli nei nel nella non o per più quando quella quello questa questo se
+		si sono su sul sulla tra tu un una uno è`,
+}
+
+// loadStopwords carica le stopword da una lista predefinita ("en", "it") o
+// da un file con una parola per riga. Ogni stopword passa dalla stessa
+// pipeline dei token, così con -ignore-case "The" nel file scarta anche "the".
+func loadStopwords(spec string, pipeline []normalizer) (map[string]struct{}, error) {
+	var words []string
+	if list, ok := builtinStopwords[spec]; ok {
+		words = strings.Fields(list)
+	} else {
+		f, err := os.Open(spec)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			words = append(words, strings.TrimSpace(scanner.Text()))
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	stop := make(map[string]struct{}, len(words))
+	for _, w := range words {
+		if w = applyPipeline(pipeline, w); w != "" {
+			stop[w] = struct{}{}
+		}
+	}
+	return stop, nil
+}
+
+// stopwordFilter scarta le parole in stop; con una lista vuota ritorna nil,
+// che per WordCounter vuol dire nessun filtro.
+func stopwordFilter(stop map[string]struct{}) wordFilter {
+	if len(stop) == 0 {
+		return nil
+	}
+	return func(w string) bool {
+		_, found := stop[w]
+		return !found
+	}
+}
+
+// lineSampler decide per ogni riga se analizzarla.
+type lineSampler func() bool
+
+// newLineSampler tiene ogni riga con probabilità p; a parità di seed e di
+// input sceglie sempre le stesse righe.
+func newLineSampler(p float64, seed int64) lineSampler {
+	rng := rand.New(rand.NewSource(seed))
+	return func() bool { return rng.Float64() < p }
+}
+
+// countOptions raccoglie le impostazioni di conteggio di WordCounter.
+// Lo zero value conta ogni parola così com'è.
+type countOptions struct {
+	pipeline []normalizer
+	// filter, se non è nil, tiene solo le parole per cui ritorna true, così
+	// i totali riflettono il filtro.
+	filter wordFilter
+	// keep, se non è nil, salta senza tokenizzarle le righe per cui ritorna false.
+	keep lineSampler
+	// segment, se non è nil, spezza ulteriormente ogni parola (vedi -cjk).
+	segment segmenter
+	// ngram > 1 conta le sequenze di ngram parole consecutive della stessa
+	// riga, unite da uno spazio, invece delle singole parole.
+	ngram int
+	// gzip decomprime tutti gli input, stdin compreso; i file con suffisso
+	// .gz vengono decompressi comunque. Feed non lo usa: riceve già il testo.
+	gzip bool
+}
+
+// WordCounter accumula i conteggi delle parole. Feed tokenizza il testo
+// secondo le opzioni del counter, Add conta una parola già tokenizzata.
+// Non è sicuro per l'uso concorrente: per contare in parallelo si usa un
+// counter per goroutine e li si unisce con Merge.
+type WordCounter struct {
+	opts   countOptions
+	counts map[string]int
+}
+
+func NewWordCounter(opts countOptions) *WordCounter {
+	return &WordCounter{opts: opts, counts: make(map[string]int)}
+}
+
+// Add conta una occorrenza di word così com'è, senza pipeline né filtri.
+func (c *WordCounter) Add(word string) {
+	c.counts[word]++
+}
+
+// Merge somma a c i conteggi di other.
+func (c *WordCounter) Merge(other *WordCounter) {
+	for w, n := range other.counts {
+		c.counts[w] += n
+	}
+}
+
+// Total ritorna il numero di occorrenze contate.
+func (c *WordCounter) Total() int {
+	total := 0
+	for _, n := range c.counts {
+		total += n
+	}
+	return total
+}
+
+// Unique ritorna il numero di parole distinte.
+func (c *WordCounter) Unique() int {
+	return len(c.counts)
+}
+
+// TopN ritorna le n parole più frequenti in ordine di stampa, tutte se n <= 0.
+func (c *WordCounter) TopN(n int) []WordCount {
+	return topWords(c.counts, n, 0, wordBefore)
+}
+
+// TopAtLeast è TopN limitato alle parole con almeno minCount occorrenze:
+// la soglia si applica prima del taglio, quindi ritorna n parole se ce ne
+// sono abbastanza sopra soglia.
+func (c *WordCounter) TopAtLeast(n, minCount int) []WordCount {
+	return topWords(c.counts, n, minCount, wordBefore)
+}
+
+// RarestAtLeast ritorna le n parole meno frequenti tra quelle con almeno
+// minCount occorrenze, in ordine di frequenza crescente. Con minCount 2 le
+// parole che compaiono una volta sola restano escluse: per vederle serve
+// minCount 1.
+func (c *WordCounter) RarestAtLeast(n, minCount int) []WordCount {
+	return topWords(c.counts, n, minCount, rareBefore)
+}
+
+// Feed conta le parole lette da r.
+func (c *WordCounter) Feed(r io.Reader) error {
+	opts := c.opts
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if opts.keep != nil && !opts.keep() {
+			continue
+		}
+		var line []string
+		// La pipeline lavora sui token separati da spazi, così le sostituzioni
+		// possono vedere forme come "u.s.a." prima dello split sulla punteggiatura.
+		for _, raw := range strings.Fields(scanner.Text()) {
+			token := applyPipeline(opts.pipeline, raw)
+			if token == "" {
+				continue
+			}
+			// Spezza il token in parole ignorando punteggiatura.
+			words := strings.FieldsFunc(token, func(r rune) bool {
+				return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+			})
+			if opts.segment != nil {
+				words = segmentAll(opts.segment, words)
 			}
+			for _, w := range words {
+				if w != "" && (opts.filter == nil || opts.filter(w)) {
+					line = append(line, w)
+				}
+			}
+		}
+		// Gli n-grammi si formano dopo il filtro e non attraversano le righe;
+		// una riga con meno di ngram parole non contribuisce.
+		if opts.ngram <= 1 {
+			for _, w := range line {
+				c.Add(w)
+			}
+			continue
+		}
+		for i := 0; i+opts.ngram <= len(line); i++ {
+			c.Add(strings.Join(line[i:i+opts.ngram], " "))
 		}
 	}
 	if err := scanner.Err(); err != nil {
@@ -105,3 +977,75 @@ func countLines(f *os.File, counts map[string]int, ignoreCase bool) error {
 	}
 	return nil
 }
+
+// segmenter spezza una parola in token. Serve per le scritture senza spazi
+// tra le parole, dove strings.Fields lascerebbe un'intera frase in un token.
+type segmenter func(word string) []string
+
+// parseSegmenter ritorna il segmenter per il valore di -cjk; "" vuol dire
+// nessuna segmentazione.
+func parseSegmenter(mode string) (segmenter, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "chars":
+		return func(w string) []string { return splitHan(w, 1) }, nil
+	case "bigrams":
+		return func(w string) []string { return splitHan(w, 2) }, nil
+	}
+	return nil, fmt.Errorf("modalità -cjk sconosciuta %q (valori ammessi: chars, bigrams)", mode)
+}
+
+func segmentAll(seg segmenter, words []string) []string {
+	out := make([]string, 0, len(words))
+	for _, w := range words {
+		out = append(out, seg(w)...)
+	}
+	return out
+}
+
+// splitHan separa le sequenze di ideogrammi Han dal resto della parola, che
+// resta intero: "我爱Go语言" -> "我", "爱", "Go", "语", "言" con n=1. Con n=2
+// ogni sequenza Han diventa l'elenco dei bigrammi sovrapposti ("我爱", "语言");
+// un ideogramma isolato resta un token singolo.
+func splitHan(word string, n int) []string {
+	var out []string
+	var han []rune
+	flushHan := func() {
+		if n == 1 || len(han) == 1 {
+			for _, r := range han {
+				out = append(out, string(r))
+			}
+		} else {
+			for i := 0; i+n <= len(han); i++ {
+				out = append(out, string(han[i:i+n]))
+			}
+		}
+		han = han[:0]
+	}
+
+	other := -1 // inizio della sequenza non Han corrente
+	for i, r := range word {
+		if unicode.Is(unicode.Han, r) {
+			if other >= 0 {
+				out = append(out, word[other:i])
+				other = -1
+			}
+			han = append(han, r)
+			continue
+		}
+		if len(han) > 0 {
+			flushHan()
+		}
+		if other < 0 {
+			other = i
+		}
+	}
+	if len(han) > 0 {
+		flushHan()
+	}
+	if other >= 0 {
+		out = append(out, word[other:])
+	}
+	return out
+}
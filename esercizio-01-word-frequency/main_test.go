@@ -0,0 +1,489 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPipelineStages(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage normalizer
+		in    string
+		want  string
+	}{
+		{"lowercase", strings.ToLower, "GoLang", "golang"},
+		{"fold accents", foldAccentsStage, "perché", "perche"},
+		{"fold accents decomposed", foldAccentsStage, "café", "cafe"},
+		{"strip punct only", stripPunctStage, "--", ""},
+		{"strip punct keeps words", stripPunctStage, "ciao!", "ciao!"},
+		{"replace", replaceStage(map[string]string{"u.s.a.": "usa"}), "u.s.a.", "usa"},
+		{"replace miss", replaceStage(map[string]string{"u.s.a.": "usa"}), "usa.", "usa."},
+	}
+	for _, tt := range tests {
+		if got := tt.stage(tt.in); got != tt.want {
+			t.Errorf("%s: %q -> %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCombinedPipeline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replace.txt")
+	if err := os.WriteFile(path, []byte("# commento\nu.s.a. = usa\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	replacements, err := loadReplacements(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pipeline := buildPipeline(true, false, true, true, replacements)
+	input := "U.S.A. e usa, Café cafe -- CAFÉ\n"
+	counter := NewWordCounter(countOptions{pipeline: pipeline})
+	if err := counter.Feed(strings.NewReader(input)); err != nil {
+		t.Fatal(err)
+	}
+	counts := counter.counts
+
+	want := map[string]int{"usa": 2, "e": 1, "cafe": 3}
+	if !reflect.DeepEqual(counts, want) {
+		t.Fatalf("counts = %v, want %v", counts, want)
+	}
+}
+
+func TestGroupByInitial(t *testing.T) {
+	items := []WordCount{
+		{"casa", 5}, {"albero", 4}, {"2024", 3}, {"cane", 3}, {"ape", 2}, {"èra", 2},
+	}
+	var buf bytes.Buffer
+	printGroups(&buf, groupByInitial(items))
+
+	want := `
+A
+  "albero" - 4 occorrenze
+  "ape" - 2 occorrenze
+
+C
+  "casa" - 5 occorrenze
+  "cane" - 3 occorrenze
+
+È
+  "èra" - 2 occorrenze
+
+#
+  "2024" - 3 occorrenze
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestWriteWordFileAppendDeduplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.txt")
+
+	first := []WordCount{{"ciao", 3}, {"mondo", 2}}
+	if err := writeWordFile(path, first, true); err != nil {
+		t.Fatal(err)
+	}
+	second := []WordCount{{"mondo", 5}, {"\"go\"", 2}}
+	if err := writeWordFile(path, second, true); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readWordFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []WordCount{{"ciao", 3}, {"mondo", 5}, {"\"go\"", 2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("file contents = %v, want %v", got, want)
+	}
+	if tmps, _ := filepath.Glob(path + ".*.tmp"); len(tmps) != 0 {
+		t.Fatalf("temp files left behind: %v", tmps)
+	}
+}
+
+func TestWordCounterFeedExcludeNumbers(t *testing.T) {
+	input := "Nel 2024 ho ascoltato 12 mp3 e 3,5 ore di f1\n"
+	pipeline := buildPipeline(true, false, false, false, nil)
+
+	tests := []struct {
+		dropMixed bool
+		want      map[string]int
+	}{
+		{false, map[string]int{"nel": 1, "ho": 1, "ascoltato": 1, "mp3": 1, "e": 1, "ore": 1, "di": 1, "f1": 1}},
+		{true, map[string]int{"nel": 1, "ho": 1, "ascoltato": 1, "e": 1, "ore": 1, "di": 1}},
+	}
+	for _, tt := range tests {
+		counter := NewWordCounter(countOptions{pipeline: pipeline, filter: numberFilter(tt.dropMixed)})
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("dropMixed=%v: counts = %v, want %v", tt.dropMixed, counts, tt.want)
+		}
+	}
+}
+
+func TestWordCounterFeedSampling(t *testing.T) {
+	var input strings.Builder
+	for i := 0; i < 1000; i++ {
+		input.WriteString("alfa beta\n")
+	}
+	run := func(keep lineSampler) map[string]int {
+		counter := NewWordCounter(countOptions{keep: keep})
+		if err := counter.Feed(strings.NewReader(input.String())); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		return counts
+	}
+
+	full := run(nil)
+	first := run(newLineSampler(0.2, 42))
+	second := run(newLineSampler(0.2, 42))
+
+	if !reflect.DeepEqual(first, second) {
+		t.Fatalf("same seed gave different counts: %v vs %v", first, second)
+	}
+	// ogni riga scelta porta entrambe le parole
+	if first["alfa"] != first["beta"] {
+		t.Errorf("sampling split a line: %v", first)
+	}
+	if n := first["alfa"]; n >= full["alfa"] || n < 100 || n > 300 {
+		t.Errorf("sampled alfa = %d, want about 200 of %d", n, full["alfa"])
+	}
+}
+
+func TestParallelTopKMatchesSequential(t *testing.T) {
+	dir := t.TempDir()
+	words := []string{"alfa", "beta", "gamma", "delta", "eps", "zeta", "eta", "theta", "iota", "kappa",
+		"lambda", "mu", "nu", "xi", "omicron", "pi", "rho", "sigma", "tau", "ups", "phi", "chi", "psi", "omega"}
+	var files []string
+	for f := 0; f < 7; f++ {
+		var b strings.Builder
+		for i := 0; i < 200; i++ {
+			// distribuzione irregolare con molti pareggi di frequenza
+			fmt.Fprintf(&b, "%s %s\n", words[(i*f+i/3)%len(words)], words[(i+f)%7])
+		}
+		path := filepath.Join(dir, fmt.Sprintf("part%d.txt", f))
+		if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	pipeline := buildPipeline(true, false, false, false, nil)
+
+	render := func(items []WordCount) string {
+		var b strings.Builder
+		printRanked(&b, items[:min(20, len(items))], 0)
+		return b.String()
+	}
+	want := render(countFiles(files, 1, countOptions{pipeline: pipeline}).TopAtLeast(0, 2))
+
+	for _, workers := range []int{1, 2, 4} {
+		got := render(countFiles(files, workers, countOptions{pipeline: pipeline}).TopAtLeast(20, 2))
+		if got != want {
+			t.Errorf("workers=%d: output differs from sequential full sort\ngot:\n%s\nwant:\n%s", workers, got, want)
+		}
+	}
+}
+
+func TestTFIDFRanking(t *testing.T) {
+	pipeline := buildPipeline(true, false, false, false, nil)
+	count := func(text string) map[string]int {
+		counter := NewWordCounter(countOptions{pipeline: pipeline})
+		if err := counter.Feed(strings.NewReader(text)); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		return counts
+	}
+	// "il" è la parola più frequente in entrambi, ma compare ovunque
+	docs := []map[string]int{
+		count("il gatto il cane il gatto il topo\n"),
+		count("il mare il sole il mare\n"),
+	}
+	scores := tfidf(docs)
+
+	if top := topWords(docs[0], 1, 0, wordBefore); top[0].Word != "il" {
+		t.Fatalf("raw frequency top = %q, want \"il\"", top[0].Word)
+	}
+	if scores[0][0].Word != "gatto" || scores[1][0].Word != "mare" {
+		t.Errorf("tf-idf top = %q, %q; want gatto, mare", scores[0][0].Word, scores[1][0].Word)
+	}
+	for _, s := range scores[0] {
+		if s.Word == "il" && s.Score != 0 {
+			t.Errorf("score of a term in every document = %v, want 0", s.Score)
+		}
+	}
+}
+
+func TestWordCounterFeedCJK(t *testing.T) {
+	input := "我爱Go语言, hello世界 国\n"
+	tests := []struct {
+		mode string
+		want map[string]int
+	}{
+		{"", map[string]int{"我爱go语言": 1, "hello世界": 1, "国": 1}},
+		{"chars", map[string]int{"我": 1, "爱": 1, "go": 1, "语": 1, "言": 1, "hello": 1, "世": 1, "界": 1, "国": 1}},
+		{"bigrams", map[string]int{"我爱": 1, "go": 1, "语言": 1, "hello": 1, "世界": 1, "国": 1}},
+	}
+	for _, tt := range tests {
+		segment, err := parseSegmenter(tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := countOptions{pipeline: buildPipeline(true, false, false, false, nil), segment: segment}
+		counter := NewWordCounter(opts)
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("-cjk=%q: got %v, want %v", tt.mode, counts, tt.want)
+		}
+	}
+	if _, err := parseSegmenter("words"); err == nil {
+		t.Error("expected error for unknown -cjk mode")
+	}
+}
+
+func TestStopwords(t *testing.T) {
+	pipeline := buildPipeline(true, false, false, false, nil)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "stop.txt")
+	if err := os.WriteFile(file, []byte("The\n\nGatto\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	empty := filepath.Join(dir, "empty.txt")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := "The cat and the Gatto, il gatto\n"
+	tests := []struct {
+		spec string
+		want map[string]int
+	}{
+		{file, map[string]int{"cat": 1, "and": 1, "il": 1}},
+		{"en", map[string]int{"cat": 1, "gatto": 2, "il": 1}},
+		{"it", map[string]int{"the": 2, "cat": 1, "and": 1, "gatto": 2}},
+		{empty, map[string]int{"the": 2, "cat": 1, "and": 1, "gatto": 2, "il": 1}},
+	}
+	for _, tt := range tests {
+		stop, err := loadStopwords(tt.spec, pipeline)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := countOptions{pipeline: pipeline, filter: combineFilters(nil, stopwordFilter(stop))}
+		counter := NewWordCounter(opts)
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("-stopwords=%s: got %v, want %v", filepath.Base(tt.spec), counts, tt.want)
+		}
+	}
+}
+
+func TestMachineReadableReports(t *testing.T) {
+	items := []WordCount{{"ciao", 3}, {"a,b", 1}}
+
+	var js strings.Builder
+	if err := writeJSONReport(&js, 4, 2, 0.5, items); err != nil {
+		t.Fatal(err)
+	}
+	var report jsonReport
+	if err := json.Unmarshal([]byte(js.String()), &report); err != nil {
+		t.Fatalf("invalid JSON %q: %v", js.String(), err)
+	}
+	want := jsonReport{Total: 4, Unique: 2, Sample: 0.5, Words: []jsonWord{{"ciao", 3}, {"a,b", 1}}}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("json = %+v, want %+v", report, want)
+	}
+	if !strings.Contains(js.String(), `"word": "ciao"`) {
+		t.Errorf("json keys not lowercase: %s", js.String())
+	}
+
+	var csvOut strings.Builder
+	if err := writeCSVReport(&csvOut, items); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := csvOut.String(), "word,count\nciao,3\n\"a,b\",1\n"; got != want {
+		t.Errorf("csv = %q, want %q", got, want)
+	}
+}
+
+func TestWordCounterFeedNgrams(t *testing.T) {
+	input := "New York is big, new york\nis\nNew\n"
+	pipeline := buildPipeline(true, false, false, false, nil)
+	tests := []struct {
+		n    int
+		want map[string]int
+	}{
+		{2, map[string]int{"new york": 2, "york is": 1, "is big": 1, "big new": 1}},
+		{3, map[string]int{"new york is": 1, "york is big": 1, "is big new": 1, "big new york": 1}},
+		{7, map[string]int{}},
+	}
+	for _, tt := range tests {
+		counter := NewWordCounter(countOptions{pipeline: pipeline, ngram: tt.n})
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		counts := counter.counts
+		if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("ngram=%d: got %v, want %v", tt.n, counts, tt.want)
+		}
+	}
+}
+
+func TestWordCounterMerge(t *testing.T) {
+	a := NewWordCounter(countOptions{pipeline: buildPipeline(true, false, false, false, nil)})
+	if err := a.Feed(strings.NewReader("Go go, rust\n")); err != nil {
+		t.Fatal(err)
+	}
+	b := NewWordCounter(countOptions{})
+	b.Add("rust")
+	b.Add("Zig")
+	a.Merge(b)
+
+	want := []WordCount{{"go", 2}, {"rust", 2}, {"Zig", 1}}
+	if got := a.TopN(0); !reflect.DeepEqual(got, want) {
+		t.Errorf("TopN(0) = %v, want %v", got, want)
+	}
+	if got := a.TopN(1); !reflect.DeepEqual(got, want[:1]) {
+		t.Errorf("TopN(1) = %v, want %v", got, want[:1])
+	}
+	if a.Total() != 5 || a.Unique() != 3 {
+		t.Errorf("Total, Unique = %d, %d; want 5, 3", a.Total(), a.Unique())
+	}
+}
+
+func TestTopAppliesMinCountBeforeLimit(t *testing.T) {
+	counter := NewWordCounter(countOptions{})
+	for _, w := range strings.Fields("a a a b c d e f f g g") {
+		counter.Add(w)
+	}
+	// con il vecchio ciclo le parole singole occupavano posti del top 3
+	want := []WordCount{{"a", 3}, {"f", 2}, {"g", 2}}
+	for _, n := range []int{3, 0} {
+		if got := counter.TopAtLeast(n, 2); !reflect.DeepEqual(got, want) {
+			t.Errorf("TopAtLeast(%d, 2) = %v, want %v", n, got, want)
+		}
+	}
+	var out strings.Builder
+	printRanked(&out, counter.TopAtLeast(2, 2), 0)
+	if got := out.String(); got != "1. \"a\" - 3 occorrenze\n2. \"f\" - 2 occorrenze\n" {
+		t.Errorf("printRanked = %q", got)
+	}
+
+	// la percentuale usa il totale di tutte le parole, non solo delle mostrate
+	out.Reset()
+	printRanked(&out, counter.TopAtLeast(1, 2), counter.Total())
+	if got := out.String(); got != "1. \"a\" - 3 occorrenze (27.27%)\n" {
+		t.Errorf("printRanked with percent = %q", got)
+	}
+}
+
+func TestCountFilesGzip(t *testing.T) {
+	dir := t.TempDir()
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	zw.Write([]byte("ciao mondo\nciao\n"))
+	zw.Close()
+	compressed := filepath.Join(dir, "a.txt.gz")
+	if err := os.WriteFile(compressed, zbuf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	broken := filepath.Join(dir, "broken.txt.gz")
+	if err := os.WriteFile(broken, []byte("non sono gzip\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plain := filepath.Join(dir, "b.txt")
+	if err := os.WriteFile(plain, []byte("mondo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openInput(broken, false); err == nil || !strings.Contains(err.Error(), "broken.txt.gz") {
+		t.Errorf("openInput(broken) err = %v, want a decompression error naming the file", err)
+	}
+	counter := countFiles([]string{compressed, broken, plain}, 1, countOptions{})
+	want := map[string]int{"ciao": 2, "mondo": 2}
+	if !reflect.DeepEqual(counter.counts, want) {
+		t.Errorf("counts = %v, want %v", counter.counts, want)
+	}
+}
+
+func TestRarestAtLeast(t *testing.T) {
+	counter := NewWordCounter(countOptions{})
+	for _, w := range strings.Fields("a a a b c c d d e e e e f") {
+		counter.Add(w)
+	}
+	tests := []struct {
+		n, minCount int
+		want        []WordCount
+	}{
+		{2, 1, []WordCount{{"b", 1}, {"f", 1}}},
+		{3, 2, []WordCount{{"c", 2}, {"d", 2}, {"a", 3}}},
+		{0, 2, []WordCount{{"c", 2}, {"d", 2}, {"a", 3}, {"e", 4}}},
+	}
+	for _, tt := range tests {
+		if got := counter.RarestAtLeast(tt.n, tt.minCount); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("RarestAtLeast(%d, %d) = %v, want %v", tt.n, tt.minCount, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeComposedAndDecomposed(t *testing.T) {
+	composed, decomposed := "caf\u00e9", "cafe\u0301"
+	input := composed + " " + decomposed + " CAF\u00c9 cafe\n"
+	count := func(normalize, fold bool) map[string]int {
+		counter := NewWordCounter(countOptions{pipeline: buildPipeline(true, normalize, fold, false, nil)})
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		return counter.counts
+	}
+
+	if got := count(true, false); !reflect.DeepEqual(got, map[string]int{composed: 3, "cafe": 1}) {
+		t.Errorf("-normalize: got %v", got)
+	}
+	if got := count(true, true); !reflect.DeepEqual(got, map[string]int{"cafe": 4}) {
+		t.Errorf("-normalize -fold-accents: got %v", got)
+	}
+	if got := count(false, false); got[composed] != 2 {
+		t.Errorf("without -normalize the decomposed form should count apart: %v", got)
+	}
+}
+
+func TestLengthFilter(t *testing.T) {
+	input := "a il of perché città universo\n"
+	tests := []struct {
+		minLen, maxLen int
+		want           map[string]int
+	}{
+		{0, 0, map[string]int{"a": 1, "il": 1, "of": 1, "perché": 1, "città": 1, "universo": 1}},
+		// "perché" è 6 rune ma 7 byte: deve restare con -max-len 6
+		{4, 6, map[string]int{"perché": 1, "città": 1}},
+		{3, 0, map[string]int{"perché": 1, "città": 1, "universo": 1}},
+	}
+	for _, tt := range tests {
+		counter := NewWordCounter(countOptions{filter: lengthFilter(tt.minLen, tt.maxLen)})
+		if err := counter.Feed(strings.NewReader(input)); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(counter.counts, tt.want) {
+			t.Errorf("min=%d max=%d: got %v, want %v", tt.minLen, tt.maxLen, counter.counts, tt.want)
+		}
+	}
+}
@@ -3,15 +3,24 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang-course-ex-Mauro/internal/retry"
+
 	"golang.org/x/net/html"
 )
 
@@ -21,17 +30,38 @@ type PageInfo struct {
 	StatusCode  int
 	ContentSize int
 	LinkCount   int
-	Error       error
+	ContentType string
+	// Redirects è il numero di redirect seguiti prima della risposta finale.
+	Redirects int
+	// Skipped indica che il Content-Type non era tra quelli ammessi:
+	// il body non è stato scaricato, ma non è un errore.
+	Skipped bool
+	Error   error
 }
 
 func main() {
 	workers := flag.Int("workers", 5, "numero massimo di workers")
 	timeout := flag.Duration("timeout", 10*time.Second, "timeout per richiesta HTTP")
+	retries := flag.Int("retries", 0, "tentativi aggiuntivi per errori di rete o status 5xx")
+	retryDelay := flag.Duration("retry-delay", 500*time.Millisecond, "attesa iniziale tra i tentativi (raddoppia ad ogni retry)")
+	queueSize := flag.Int("queue-size", 0, "dimensione del buffer della coda di URL (0 = non bufferizzata)")
+	onFull := flag.String("on-full", "block", "politica con coda piena: block|drop")
+	csvPath := flag.String("csv", "", "file CSV su cui esportare i risultati")
+	contentTypesFlag := flag.String("content-types", "", "Content-Type ammessi separati da virgola, es. text/html,application/xhtml+xml (vuoto = tutti)")
+	flushInterval := flag.Duration("flush-interval", time.Second, "ogni quanto svuotare il buffer di stdout (0 = dopo ogni risultato)")
+	maxRedirects := flag.Int("max-redirects", -1, "redirect da seguire al massimo, poi si riporta il 3xx (0 = nessuno, -1 = default di net/http)")
+	failFast := flag.Bool("fail-fast", false, "interrompe il run al primo errore (come -max-errors=1)")
+	maxErrors := flag.Int("max-errors", 0, "interrompe il run dopo N errori, con exit code 1 (0 = nessun limite)")
 	flag.Parse()
 
+	// stdout bufferizzato: un Printf per risultato è lento su run grandi.
+	// Il defer garantisce il flush anche sui return anticipati.
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
 	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Println("Uso: go run main.go [-workers=N] [-timeout=10s] <urls.txt | url1 url2 ...>")
+		fmt.Fprintln(out, "Uso: go run main.go [-workers=N] [-timeout=10s] [-retries=N] [-queue-size=N -on-full=block|drop] [-csv=out.csv] [-content-types=text/html] [-flush-interval=1s] [-max-redirects=N] <urls.txt | url1 url2 ...>")
 		return
 	}
 
@@ -41,54 +71,413 @@ func main() {
 		return
 	}
 	if len(urls) == 0 {
-		fmt.Println("Nessun URL valido")
+		fmt.Fprintln(out, "Nessun URL valido")
 		return
 	}
 	if *workers < 1 {
 		*workers = 1
 	}
+	if *queueSize < 0 {
+		*queueSize = 0
+	}
+	if *onFull != "block" && *onFull != "drop" {
+		fmt.Fprintf(os.Stderr, "Politica -on-full non valida: %s (usa block o drop)\n", *onFull)
+		return
+	}
+
+	var exporter *csvExporter
+	if *csvPath != "" {
+		f, err := os.Create(*csvPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Errore creazione CSV: %v\n", err)
+			return
+		}
+		defer f.Close()
+		exporter, err = newCSVExporter(f)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Errore scrittura CSV: %v\n", err)
+			return
+		}
+	}
 
 	start := time.Now()
-	fmt.Printf("Scraping %d URLs con %d workers...\n\n", len(urls), *workers)
+	fmt.Fprintf(out, "Scraping %d URLs con %d workers...\n\n", len(urls), *workers)
 
-	client := &http.Client{Timeout: *timeout}
-	jobs := make(chan string)
-	results := make(chan PageInfo)
+	// SIGINT ferma il run in modo pulito, un secondo SIGINT esce subito;
+	// SIGUSR1 stampa l'avanzamento su stderr
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	prog := newProgress(start)
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, watchedSignals...)
+	defer signal.Stop(sigs)
+	finished := make(chan struct{})
+	go watchSignals(finished, sigs, prog, os.Stderr, stop, func() { os.Exit(130) })
+
+	contentTypes := parseContentTypes(*contentTypesFlag)
+	client := &http.Client{Timeout: *timeout, CheckRedirect: redirectPolicy(*maxRedirects)}
+	policy := retry.RetryPolicy{
+		MaxAttempts: *retries + 1,
+		BaseDelay:   *retryDelay,
+		Multiplier:  2,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.2,
+	}
+	cfg := scrapeConfig{
+		workers:   *workers,
+		queueSize: *queueSize,
+		drop:      *onFull == "drop",
+		maxErrors: *maxErrors,
+		fetch: func(ctx context.Context, url string) PageInfo {
+			return fetchWithRetry(ctx, url, client, policy, contentTypes)
+		},
+	}
+	if *failFast {
+		cfg.maxErrors = 1
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(*workers)
-	for i := 0; i < *workers; i++ {
-		go func() {
-			defer wg.Done()
-			for url := range jobs {
-				results <- fetch(url, client)
+	successes, skippedType := 0, 0
+	lastFlush := time.Now()
+	skipped, runErr := scrape(ctx, urls, cfg, func(res PageInfo) {
+		prog.record(res)
+		if exporter != nil {
+			if err := exporter.Write(res); err != nil {
+				fmt.Fprintf(os.Stderr, "Errore scrittura CSV: %v\n", err)
+				exporter = nil
 			}
-		}()
+		}
+		printResult(out, res)
+		switch {
+		case res.Error != nil:
+		case res.Skipped:
+			skippedType++
+		default:
+			successes++
+		}
+		if time.Since(lastFlush) >= *flushInterval {
+			out.Flush()
+			lastFlush = time.Now()
+		}
+	})
+	close(finished)
+
+	if runErr != nil {
+		fmt.Fprintf(out, "Interrotto (%v): %d/%d URL processati\n", runErr, prog.completed.Load(), len(urls))
+	}
+	fmt.Fprintf(out, "Completato in %s\nSuccessi: %d/%d\n", time.Since(start), successes, len(urls))
+	if skipped > 0 {
+		fmt.Fprintf(out, "Saltati (coda piena): %d\n", skipped)
+	}
+	if skippedType > 0 {
+		fmt.Fprintf(out, "Saltati (Content-Type): %d\n", skippedType)
+	}
+	if errors.Is(runErr, ErrTooManyErrors) {
+		// os.Exit salta i defer: il buffer va svuotato a mano
+		out.Flush()
+		os.Exit(1)
 	}
+}
+
+var ErrTooManyErrors = errors.New("troppi errori")
+
+type scrapeConfig struct {
+	workers   int
+	queueSize int
+	drop      bool
+	// maxErrors > 0 interrompe il run quando gli errori raggiungono la soglia.
+	maxErrors int
+	fetch     func(ctx context.Context, url string) PageInfo
+}
+
+// scrape accoda urls, li scarica con cfg.fetch e chiama handle per ogni
+// risultato dal goroutine chiamante. Ritorna quanti URL sono stati scartati
+// per coda piena e, se il run è stato interrotto, il motivo: ErrTooManyErrors
+// se si è raggiunta cfg.maxErrors, altrimenti l'errore del context.
+func scrape(ctx context.Context, urls []string, cfg scrapeConfig, handle func(PageInfo)) (int, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan string, cfg.queueSize)
+	results := make(chan PageInfo)
+	fetchErr := make(chan error, 1)
 	go func() {
-		wg.Wait()
-		close(results)
+		fetchErr <- fetchAll(ctx, cfg.workers, jobs, results, cfg.fetch)
 	}()
-
+	skippedCh := make(chan int, 1)
 	go func() {
-		for _, u := range urls {
-			jobs <- u
-		}
+		skippedCh <- enqueue(ctx, urls, jobs, cfg.drop)
 		close(jobs)
 	}()
 
-	successes := 0
+	errCount := 0
+	var abortErr error
 	for res := range results {
-		if res.Error != nil {
-			fmt.Printf("[ERROR] %s\n     Error: %v\n\n", res.URL, res.Error)
+		handle(res)
+		if res.Error == nil {
 			continue
 		}
-		successes++
-		fmt.Printf("[OK] %s\n     Status: %d | Size: %d bytes | Links: %d | Title: %q\n\n",
+		errCount++
+		if abortErr == nil && cfg.maxErrors > 0 && errCount >= cfg.maxErrors {
+			abortErr = fmt.Errorf("%w: %d", ErrTooManyErrors, errCount)
+			cancel()
+		}
+	}
+
+	skipped := <-skippedCh
+	err := <-fetchErr
+	if abortErr != nil {
+		return skipped, abortErr
+	}
+	return skipped, err
+}
+
+// group è un errgroup minimale: raccoglie il primo errore ritornato dalle
+// goroutine e cancella il context condiviso, così le altre si fermano.
+type group struct {
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+	once   sync.Once
+	err    error
+}
+
+func newGroup(ctx context.Context) (*group, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &group{cancel: cancel}, ctx
+}
+
+func (g *group) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Wait attende tutte le goroutine e ritorna il primo errore.
+func (g *group) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// fetchAll esegue fetchFn sugli URL di jobs con al massimo workers fetch
+// concorrenti, inviando ogni PageInfo su results e chiudendolo alla fine.
+// Gli errori dei singoli URL restano nel PageInfo e non fermano il run: solo la
+// cancellazione di ctx lo interrompe. In quel caso gli URL non ancora iniziati
+// vengono abbandonati, i risultati già ottenuti sono comunque consegnati e
+// fetchAll ritorna l'errore del context.
+func fetchAll(ctx context.Context, workers int, jobs <-chan string, results chan<- PageInfo, fetchFn func(context.Context, string) PageInfo) error {
+	defer close(results)
+	g, ctx := newGroup(ctx)
+	for i := 0; i < workers; i++ {
+		g.Go(func() error {
+			for {
+				// controllo separato: con entrambi pronti select sceglie a caso
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case url, ok := <-jobs:
+					if !ok {
+						return nil
+					}
+					results <- fetchFn(ctx, url)
+				}
+			}
+		})
+	}
+	return g.Wait()
+}
+
+// progress tiene i contatori del run; sono atomici perché vengono letti
+// dal goroutine dei segnali mentre il loop dei risultati li aggiorna.
+type progress struct {
+	start     time.Time
+	completed atomic.Int64
+	successes atomic.Int64
+	errors    atomic.Int64
+}
+
+func newProgress(start time.Time) *progress {
+	return &progress{start: start}
+}
+
+func (p *progress) record(res PageInfo) {
+	p.completed.Add(1)
+	switch {
+	case res.Error != nil:
+		p.errors.Add(1)
+	case !res.Skipped:
+		p.successes.Add(1)
+	}
+}
+
+func (p *progress) String() string {
+	return fmt.Sprintf("[STATS] completati: %d | successi: %d | errori: %d | trascorso: %s",
+		p.completed.Load(), p.successes.Load(), p.errors.Load(), time.Since(p.start).Round(time.Millisecond))
+}
+
+// watchSignals stampa lo stato su w a ogni statusSignal senza fermare il run.
+// Il primo altro segnale chiama stop e lascia finire le richieste in corso,
+// il successivo chiama forceExit. Termina quando finished viene chiuso.
+func watchSignals(finished <-chan struct{}, sigs <-chan os.Signal, p *progress, w io.Writer, stop context.CancelFunc, forceExit func()) {
+	interrupted := false
+	for {
+		select {
+		case <-finished:
+			return
+		case sig := <-sigs:
+			switch {
+			case statusSignal != nil && sig == statusSignal:
+				fmt.Fprintln(w, p)
+			case interrupted:
+				fmt.Fprintln(w, "Secondo segnale, uscita immediata")
+				forceExit()
+				return
+			default:
+				fmt.Fprintln(w, "Interruzione richiesta, attendo le richieste in corso (ripeti per uscire subito)...")
+				interrupted = true
+				stop()
+			}
+		}
+	}
+}
+
+func printResult(w io.Writer, res PageInfo) {
+	switch {
+	case res.Error != nil:
+		fmt.Fprintf(w, "[ERROR] %s\n     Error: %v\n\n", res.URL, res.Error)
+	case res.Skipped:
+		fmt.Fprintf(w, "[SKIP] %s\n     Content-Type: %s\n\n", res.URL, res.ContentType)
+	default:
+		fmt.Fprintf(w, "[OK] %s\n     Status: %d | Size: %d bytes | Links: %d | Title: %q",
 			res.URL, res.StatusCode, res.ContentSize, res.LinkCount, res.Title)
+		if res.Redirects > 0 {
+			fmt.Fprintf(w, " | Redirects: %d", res.Redirects)
+		}
+		fmt.Fprint(w, "\n\n")
+	}
+}
+
+// redirectPolicy ritorna un CheckRedirect che segue al massimo max redirect;
+// oltre, la risposta 3xx viene restituita come finale invece di un errore.
+// Con max < 0 resta la politica di default del client.
+func redirectPolicy(max int) func(req *http.Request, via []*http.Request) error {
+	if max < 0 {
+		return nil
+	}
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) > max {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+}
+
+// redirectCount risale la catena delle risposte che hanno portato a resp.
+func redirectCount(resp *http.Response) int {
+	n := 0
+	for r := resp.Request; r != nil && r.Response != nil; r = r.Response.Request {
+		n++
+	}
+	return n
+}
+
+func parseContentTypes(s string) []string {
+	var types []string
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t != "" {
+			types = append(types, t)
+		}
+	}
+	return types
+}
+
+// contentTypeAllowed confronta solo il media type, ignorando parametri come charset.
+// Una lista vuota ammette tutto.
+func contentTypeAllowed(header string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(header)
+	if err != nil {
+		return false
+	}
+	for _, a := range allowed {
+		if mediaType == a {
+			return true
+		}
+	}
+	return false
+}
+
+// csvExporter scrive un PageInfo per riga man mano che i risultati arrivano,
+// senza tenerli in memoria. encoding/csv gestisce il quoting di virgole e
+// virgolette nei titoli.
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func newCSVExporter(w io.Writer) (*csvExporter, error) {
+	e := &csvExporter{w: csv.NewWriter(w)}
+	if err := e.w.Write([]string{"url", "status", "size", "links", "title", "error"}); err != nil {
+		return nil, err
 	}
+	e.w.Flush()
+	return e, e.w.Error()
+}
 
-	fmt.Printf("Completato in %s\nSuccessi: %d/%d\n", time.Since(start), successes, len(urls))
+func (e *csvExporter) Write(p PageInfo) error {
+	errMsg := ""
+	if p.Error != nil {
+		errMsg = p.Error.Error()
+	}
+	record := []string{
+		p.URL,
+		strconv.Itoa(p.StatusCode),
+		strconv.Itoa(p.ContentSize),
+		strconv.Itoa(p.LinkCount),
+		p.Title,
+		errMsg,
+	}
+	if err := e.w.Write(record); err != nil {
+		return err
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// enqueue invia gli URL su jobs. Con drop gli URL che trovano la coda piena
+// vengono scartati invece di bloccare il feeder; ritorna quanti sono stati scartati.
+// Se ctx viene cancellato smette di accodare.
+func enqueue(ctx context.Context, urls []string, jobs chan<- string, drop bool) int {
+	skipped := 0
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			break
+		}
+		if !drop {
+			select {
+			case jobs <- u:
+			case <-ctx.Done():
+			}
+			continue
+		}
+		select {
+		case jobs <- u:
+		default:
+			skipped++
+		}
+	}
+	return skipped
 }
 
 func readURLs(args []string) ([]string, error) {
@@ -156,12 +545,26 @@ func extractTitleAndLinks(r io.Reader) (string, int) {
 	return title, linkCount
 }
 
-func fetch(url string, client *http.Client) PageInfo {
+// fetchWithRetry ritenta fetch secondo policy. Gli status 4xx sono errori
+// definitivi e non vengono ritentati.
+func fetchWithRetry(ctx context.Context, url string, client *http.Client, policy retry.RetryPolicy, contentTypes []string) PageInfo {
+	var page PageInfo
+	retry.Do(ctx, policy, func() error {
+		page = fetch(ctx, url, client, contentTypes)
+		if page.StatusCode >= 400 && page.StatusCode < 500 {
+			return retry.Permanent(page.Error)
+		}
+		return page.Error
+	})
+	return page
+}
+
+func fetch(ctx context.Context, url string, client *http.Client, contentTypes []string) PageInfo {
 	page := PageInfo{
 		URL: url,
 	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		page.Error = err
 		return page
@@ -177,10 +580,16 @@ func fetch(url string, client *http.Client) PageInfo {
 	}
 	defer resp.Body.Close()
 	page.StatusCode = resp.StatusCode
+	page.Redirects = redirectCount(resp)
 	if resp.StatusCode >= 400 {
 		page.Error = fmt.Errorf("bad status: %d", resp.StatusCode)
 		return page
 	}
+	page.ContentType = resp.Header.Get("Content-Type")
+	if !contentTypeAllowed(page.ContentType, contentTypes) {
+		page.Skipped = true
+		return page
+	}
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func runEnqueue(t *testing.T, drop bool) (skipped, processed int) {
+	t.Helper()
+	urls := make([]string, 10)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://example.com/%d", i)
+	}
+
+	jobs := make(chan string, 2)
+	done := make(chan int)
+	go func() {
+		n := 0
+		for range jobs {
+			time.Sleep(20 * time.Millisecond) // worker lento
+			n++
+		}
+		done <- n
+	}()
+
+	skipped = enqueue(context.Background(), urls, jobs, drop)
+	close(jobs)
+	return skipped, <-done
+}
+
+func TestEnqueueDropSkipsWhenFull(t *testing.T) {
+	skipped, processed := runEnqueue(t, true)
+	if skipped == 0 {
+		t.Fatal("drop mode: expected some URLs to be skipped")
+	}
+	if skipped+processed != 10 {
+		t.Fatalf("skipped %d + processed %d != 10", skipped, processed)
+	}
+}
+
+func TestEnqueueBlockProcessesAll(t *testing.T) {
+	skipped, processed := runEnqueue(t, false)
+	if skipped != 0 || processed != 10 {
+		t.Fatalf("block mode: skipped=%d processed=%d, want 0 and 10", skipped, processed)
+	}
+}
+
+func TestCSVExporterQuotesTitle(t *testing.T) {
+	var buf bytes.Buffer
+	e, err := newCSVExporter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.Write(PageInfo{URL: "http://a", StatusCode: 200, ContentSize: 10, LinkCount: 2, Title: `Hello, "World"`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Write(PageInfo{URL: "http://b", Error: errors.New("bad status: 404"), StatusCode: 404}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "url,status,size,links,title,error\n" +
+		"http://a,200,10,2,\"Hello, \"\"World\"\"\",\n" +
+		"http://b,404,0,0,,bad status: 404\n"
+	if buf.String() != want {
+		t.Fatalf("csv =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
+
+func TestFetchSkipsDisallowedContentType(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/doc.pdf" {
+			w.Header().Set("Content-Type", "application/pdf")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		w.Write([]byte("<html><title>T</title><a href='x'></a></html>"))
+	}))
+	defer ts.Close()
+
+	allowed := parseContentTypes("text/html, application/xhtml+xml")
+
+	pdf := fetch(context.Background(), ts.URL+"/doc.pdf", ts.Client(), allowed)
+	if pdf.Error != nil || !pdf.Skipped {
+		t.Fatalf("pdf: %+v, want skipped without error", pdf)
+	}
+	if pdf.Title != "" || pdf.ContentSize != 0 {
+		t.Fatalf("pdf body should not be parsed: %+v", pdf)
+	}
+
+	page := fetch(context.Background(), ts.URL+"/", ts.Client(), allowed)
+	if page.Skipped || page.Title != "T" || page.LinkCount != 1 {
+		t.Fatalf("html: %+v, want parsed page", page)
+	}
+
+	if all := fetch(context.Background(), ts.URL+"/doc.pdf", ts.Client(), nil); all.Skipped {
+		t.Fatal("empty allowlist should accept every content type")
+	}
+}
+
+func benchmarkPrintResults(b *testing.B, buffered bool) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "out.txt"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	res := PageInfo{URL: "http://example.com/page", StatusCode: 200, ContentSize: 1234, LinkCount: 12, Title: "Example"}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var w io.Writer = f
+		var bw *bufio.Writer
+		if buffered {
+			bw = bufio.NewWriter(f)
+			w = bw
+		}
+		for j := 0; j < 1000; j++ {
+			printResult(w, res)
+		}
+		if bw != nil {
+			bw.Flush()
+		}
+	}
+}
+
+func BenchmarkPrintResultsUnbuffered(b *testing.B) { benchmarkPrintResults(b, false) }
+func BenchmarkPrintResultsBuffered(b *testing.B)   { benchmarkPrintResults(b, true) }
+
+func TestWatchSignalsStatsDoesNotStop(t *testing.T) {
+	if statusSignal == nil {
+		t.Skip("no status signal on this platform")
+	}
+	stopped := make(chan struct{})
+	stop := func() { close(stopped) }
+	exited := make(chan struct{})
+	forceExit := func() { close(exited) }
+
+	prog := newProgress(time.Now())
+	sigs := make(chan os.Signal)
+	var out syncBuffer
+	done := make(chan struct{})
+	go func() {
+		watchSignals(make(chan struct{}), sigs, prog, &out, stop, forceExit)
+		close(done)
+	}()
+
+	prog.record(PageInfo{URL: "a", StatusCode: 200})
+	prog.record(PageInfo{URL: "b", Error: errors.New("boom")})
+	sigs <- statusSignal
+	waitForLines(t, &out, 1)
+	// a metà run: altri risultati arrivano dopo il dump
+	prog.record(PageInfo{URL: "c", StatusCode: 200})
+	sigs <- statusSignal
+	waitForLines(t, &out, 2)
+
+	select {
+	case <-stopped:
+		t.Fatal("SIGUSR1 stopped the run")
+	default:
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("stats lines = %q, want 2", lines)
+	}
+	if !strings.Contains(lines[0], "completati: 2 | successi: 1 | errori: 1") {
+		t.Errorf("first dump = %q", lines[0])
+	}
+	if !strings.Contains(lines[1], "completati: 3 | successi: 2") {
+		t.Errorf("second dump = %q", lines[1])
+	}
+
+	// il primo SIGINT ferma il run ma continua ad ascoltare
+	sigs <- os.Interrupt
+	<-stopped
+	select {
+	case <-exited:
+		t.Fatal("first SIGINT forced the exit")
+	default:
+	}
+	sigs <- os.Interrupt
+	<-done
+	select {
+	case <-exited:
+	default:
+		t.Fatal("second SIGINT did not force the exit")
+	}
+}
+
+func TestWatchSignalsReturnsWhenFinished(t *testing.T) {
+	finished := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		watchSignals(finished, make(chan os.Signal), newProgress(time.Now()), io.Discard, func() {}, func() {
+			t.Error("forceExit called without signals")
+		})
+		close(done)
+	}()
+	close(finished)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("watchSignals did not return after finished was closed")
+	}
+}
+
+func waitForLines(t *testing.T, b *syncBuffer, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for strings.Count(b.String(), "\n") < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d lines, got %q", n, b.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// syncBuffer è un bytes.Buffer sicuro da usare tra goroutine.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestFetchAllCancelStopsRemaining(t *testing.T) {
+	urls := make([]string, 20)
+	for i := range urls {
+		urls[i] = fmt.Sprintf("http://example.com/%d", i)
+	}
+	jobs := make(chan string, len(urls))
+	for _, u := range urls {
+		jobs <- u
+	}
+	close(jobs)
+
+	var mu sync.Mutex
+	calls := 0
+	fetchFn := func(ctx context.Context, url string) PageInfo {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		if n == 1 {
+			// un errore sul singolo URL non deve fermare il run
+			return PageInfo{URL: url, Error: errors.New("boom")}
+		}
+		return PageInfo{URL: url, StatusCode: 200}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan PageInfo)
+	errCh := make(chan error, 1)
+	go func() { errCh <- fetchAll(ctx, 2, jobs, results, fetchFn) }()
+
+	received := 0
+	for range results {
+		received++
+		if received == 5 {
+			cancel()
+		}
+	}
+
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("fetchAll err = %v, want context.Canceled", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls >= len(urls) {
+		t.Fatalf("all %d URLs fetched despite cancel", calls)
+	}
+	if received != calls {
+		t.Errorf("received %d results for %d fetches", received, calls)
+	}
+	if received < 5 {
+		t.Errorf("received %d results, want at least the 5 before cancel", received)
+	}
+}
+
+func TestFetchAllCompletesWithoutCancel(t *testing.T) {
+	jobs := make(chan string, 3)
+	for _, u := range []string{"a", "b", "c"} {
+		jobs <- u
+	}
+	close(jobs)
+	results := make(chan PageInfo)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fetchAll(context.Background(), 2, jobs, results, func(_ context.Context, url string) PageInfo {
+			return PageInfo{URL: url, Error: errors.New("bad status: 500")}
+		})
+	}()
+	n := 0
+	for range results {
+		n++
+	}
+	if err := <-errCh; err != nil || n != 3 {
+		t.Fatalf("err = %v, results = %d; want nil and 3", err, n)
+	}
+}
+
+func TestRedirectPolicy(t *testing.T) {
+	// /r/3 -> /r/2 -> /r/1 -> /r/0 -> /final
+	mux := http.NewServeMux()
+	mux.HandleFunc("/r/", func(w http.ResponseWriter, r *http.Request) {
+		n := r.URL.Path[len("/r/"):]
+		next := "/final"
+		if n != "0" {
+			next = fmt.Sprintf("/r/%c", n[0]-1)
+		}
+		http.Redirect(w, r, next, http.StatusFound)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "<html><title>Final</title></html>")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	tests := []struct {
+		max        int
+		wantStatus int
+		wantHops   int
+	}{
+		{-1, http.StatusOK, 4},
+		{10, http.StatusOK, 4},
+		{2, http.StatusFound, 2},
+		{0, http.StatusFound, 0},
+	}
+	for _, tt := range tests {
+		client := &http.Client{CheckRedirect: redirectPolicy(tt.max)}
+		page := fetch(context.Background(), ts.URL+"/r/3", client, nil)
+		if page.Error != nil {
+			t.Fatalf("max=%d: %v", tt.max, page.Error)
+		}
+		if page.StatusCode != tt.wantStatus || page.Redirects != tt.wantHops {
+			t.Errorf("max=%d: status=%d redirects=%d, want %d and %d",
+				tt.max, page.StatusCode, page.Redirects, tt.wantStatus, tt.wantHops)
+		}
+	}
+}
+
+func TestScrapeAbortsAfterMaxErrors(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "<html><title>ok</title></html>")
+	}))
+	defer ts.Close()
+
+	var urls []string
+	for i := 0; i < 30; i++ {
+		if i%3 == 0 {
+			urls = append(urls, fmt.Sprintf("%s/fail/%d", ts.URL, i))
+		} else {
+			urls = append(urls, fmt.Sprintf("%s/ok/%d", ts.URL, i))
+		}
+	}
+	cfg := scrapeConfig{
+		workers: 1,
+		fetch: func(ctx context.Context, url string) PageInfo {
+			return fetch(ctx, url, ts.Client(), nil)
+		},
+	}
+	run := func(maxErrors int) (processed, failed int, err error) {
+		cfg.maxErrors = maxErrors
+		_, err = scrape(context.Background(), urls, cfg, func(res PageInfo) {
+			processed++
+			if res.Error != nil {
+				failed++
+			}
+		})
+		return processed, failed, err
+	}
+
+	processed, failed, err := run(3)
+	if !errors.Is(err, ErrTooManyErrors) {
+		t.Fatalf("err = %v, want ErrTooManyErrors", err)
+	}
+	if failed < 3 || processed >= len(urls) {
+		t.Fatalf("processed %d URLs with %d errors, want abort after 3 errors", processed, failed)
+	}
+
+	// -fail-fast: il primo URL fallisce e basta quello
+	if _, _, err := run(1); !errors.Is(err, ErrTooManyErrors) {
+		t.Fatalf("fail-fast: err = %v", err)
+	}
+
+	processed, failed, err = run(0)
+	if err != nil || processed != len(urls) || failed != 10 {
+		t.Fatalf("no limit: processed=%d failed=%d err=%v; want all 30, 10 failed, nil", processed, failed, err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// statusSignal è nil dove SIGUSR1 non esiste: l'avanzamento non si può chiedere.
+var statusSignal os.Signal
+
+var watchedSignals = []os.Signal{os.Interrupt}
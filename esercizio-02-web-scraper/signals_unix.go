@@ -0,0 +1,14 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statusSignal chiede la stampa dell'avanzamento senza fermare il run.
+var statusSignal os.Signal = syscall.SIGUSR1
+
+// watchedSignals sono i segnali che main passa a watchSignals.
+var watchedSignals = []os.Signal{os.Interrupt, syscall.SIGUSR1}
@@ -1,12 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"golang-course-ex-Mauro/internal/semaphore"
 )
 
 type Book struct {
@@ -16,80 +35,570 @@ type Book struct {
 	ISBN        string    `json:"isbn"`
 	PublishYear int       `json:"publish_year"`
 	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
 }
 
+var (
+	ErrNotFound           = errors.New("not found")
+	ErrDuplicateISBN      = errors.New("duplicate isbn")
+	ErrPreconditionFailed = errors.New("precondition failed")
+)
+
 type BookStore struct {
 	mu     sync.RWMutex
 	books  map[string]Book
+	byISBN map[string]string // ISBN -> ID, per rifiutare i duplicati
 	nextID int64
 }
 
+// ETag identifica la versione di b: è un hash del suo contenuto JSON, quindi
+// cambia a ogni modifica (anche solo di UpdatedAt) ed è stabile tra richieste.
+func (b Book) ETag() string {
+	data, _ := json.Marshal(b)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// etagMatches confronta l'header If-Match con etag: accetta "*" e liste
+// separate da virgole. Gli ETag deboli (W/) non corrispondono mai, come
+// richiesto da If-Match.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func NewBookStore() *BookStore {
+	return &BookStore{books: make(map[string]Book), byISBN: make(map[string]string)}
+}
+
 func main() {
+	addr := flag.String("addr", ":8080", "indirizzo di ascolto del server")
+	requestTimeout := flag.Duration("request-timeout", 5*time.Second, "timeout per richiesta (0 = nessun timeout)")
+	expensiveLimit := flag.Int("expensive-limit", 2, "richieste concorrenti massime su /stats e /export")
+	dataFile := flag.String("data", "", "file JSON da cui caricare i libri all'avvio e su cui salvarli allo shutdown")
+	flag.Parse()
+
+	store := NewBookStore()
+	if *dataFile != "" {
+		err := store.LoadFromFile(*dataFile)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			log.Printf("%s non esiste, si parte da un catalogo vuoto", *dataFile)
+		case err != nil:
+			log.Fatal(err)
+		}
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: newHandler(store, *requestTimeout, *expensiveLimit),
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("Server in ascolto su %s", *addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		log.Fatal(err)
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	// si salva dopo lo shutdown, così il file include le richieste drenate
+	if *dataFile != "" {
+		if err := store.SaveToFile(*dataFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
 
-	store := &BookStore{
-		books: make(map[string]Book),
+// newHandler monta le route con i middleware. /books/stream resta fuori da
+// withTimeout: TimeoutHandler bufferizza la risposta, non espone Flusher né
+// Unwrap e taglierebbe gli import lunghi allo scadere del timeout.
+func newHandler(store *BookStore, requestTimeout time.Duration, expensiveLimit int) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/books", handleBooks(store))
+	mux.HandleFunc("/books/", handleBook(store))
+	mux.HandleFunc("/books/bulk", handleBulk(store))
+	mux.Handle("/stats", limitConcurrent(expensiveLimit, handleStats(store)))
+	mux.Handle("/export", limitConcurrent(expensiveLimit, handleExport(store)))
+
+	root := http.NewServeMux()
+	root.HandleFunc("/books/stream", handleStream(store))
+	root.Handle("/", withTimeout(requestTimeout, mux))
+	return logging(root)
+}
+
+// statusRecorder avvolge un ResponseWriter registrando status e byte scritti.
+// È il wrapper comune a tutti i middleware che devono osservare la risposta.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+	return &statusRecorder{ResponseWriter: w}
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
 	}
+	r.ResponseWriter.WriteHeader(status)
+}
 
-	http.HandleFunc("/books", handleBooks(store))
-	http.HandleFunc("/books/", handleBook(store))
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
 
-	http.ListenAndServe(":8080", nil)
+// Status ritorna 200 se l'handler non ha scritto niente, come farebbe net/http.
+func (r *statusRecorder) Status() int {
+	if r.status == 0 {
+		return http.StatusOK
+	}
+	return r.status
+}
 
+func (r *statusRecorder) Bytes() int {
+	return r.bytes
 }
 
-func (s *BookStore) Get(id string) (Book, bool) {
+// Flush e Hijack inoltrano al writer sottostante quando lo supporta;
+// senza, avvolgere la risposta toglierebbe streaming e upgrade agli handler.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		if r.status == 0 {
+			r.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijack not supported")
+	}
+	return h.Hijack()
+}
+
+// Unwrap permette a http.ResponseController di raggiungere il writer originale.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logging scrive una riga strutturata per richiesta sul logger slog di
+// default, con metodo, path, status, byte della risposta e latenza.
+func logging(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := newStatusRecorder(w)
+		next.ServeHTTP(rec, r)
+		slog.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.Status(),
+			"bytes", rec.Bytes(),
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// limitConcurrent lascia eseguire al massimo n richieste alla volta; le altre
+// ricevono subito 503 con Retry-After invece di accodarsi.
+func limitConcurrent(n int, next http.Handler) http.Handler {
+	if n <= 0 {
+		return next
+	}
+	sem := semaphore.New(n)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !sem.TryAcquire() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, http.StatusServiceUnavailable, "too many concurrent requests")
+			return
+		}
+		defer sem.Release()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withTimeout limita la durata di ogni richiesta a d, rispondendo 503 con il
+// body di errore JSON standard. Il context della richiesta scade insieme al
+// timeout, così le chiamate allo store possono interrompersi.
+func withTimeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+	body, _ := json.Marshal(map[string]string{"error": "request timeout"})
+	th := http.TimeoutHandler(next, d, string(body))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		th.ServeHTTP(timeoutBodyWriter{w}, r)
+	})
+}
+
+// timeoutBodyWriter dà Content-Type JSON alla risposta di timeout, che
+// TimeoutHandler scrive senza. Le risposte arrivate in tempo hanno già gli
+// header dell'handler quando passano da WriteHeader e restano come sono.
+type timeoutBodyWriter struct {
+	http.ResponseWriter
+}
+
+func (w timeoutBodyWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (s *BookStore) Get(ctx context.Context, id string) (Book, error) {
+	if err := ctx.Err(); err != nil {
+		return Book{}, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	b, ok := s.books[id]
-	return b, ok
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	return b, nil
 }
 
-func (s *BookStore) List() []Book {
+func (s *BookStore) List(ctx context.Context) ([]Book, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 	list := make([]Book, 0, len(s.books))
 	for _, b := range s.books {
 		list = append(list, b)
 	}
-	return list
+	return list, nil
 }
 
-func (s *BookStore) Create(b Book) Book {
+// Le operazioni di scrittura ricontrollano ctx dopo aver preso il lock: se
+// l'attesa ha superato il timeout, il client ha già ricevuto 503 e la modifica
+// non deve essere applicata.
+func (s *BookStore) Create(ctx context.Context, b Book) (Book, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return Book{}, err
+	}
+	if _, taken := s.byISBN[b.ISBN]; taken {
+		return Book{}, ErrDuplicateISBN
+	}
+	return s.insert(b), nil
+}
+
+// insert assegna ID e timestamp a b e lo salva; va chiamata con il lock in
+// scrittura dopo aver escluso i duplicati.
+func (s *BookStore) insert(b Book) Book {
 	s.nextID++
 	b.ID = strconv.FormatInt(s.nextID, 10)
 	if b.CreatedAt.IsZero() {
 		b.CreatedAt = time.Now().UTC()
 	}
+	b.UpdatedAt = b.CreatedAt
 	s.books[b.ID] = b
+	s.byISBN[b.ISBN] = b.ID
 	return b
+}
+
+// bulkError è il fallimento di un elemento di un batch, identificato dalla
+// sua posizione nell'input.
+type bulkError struct {
+	Index int    `json:"index"`
+	Error string `json:"error"`
+}
+
+// BatchError è l'errore di CreateMany quando uno o più elementi non sono
+// stati creati.
+type BatchError struct {
+	Items []bulkError
+}
 
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d books rejected", len(e.Items))
 }
 
-func (s *BookStore) Update(id string, b Book) (Book, bool) {
+// CreateMany valida e crea tutti i libri in un solo passaggio sotto lock.
+// Ritorna i libri creati nell'ordine dell'input e, se qualcuno è stato
+// scartato (non valido o ISBN duplicato, anche all'interno del batch), un
+// *BatchError con i motivi. Con atomic basta uno scarto perché non venga
+// creato nulla.
+func (s *BookStore) CreateMany(ctx context.Context, books []Book, atomic bool) ([]Book, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	accepted, rejected := s.checkBatch(books)
+	if atomic && len(rejected) > 0 {
+		return nil, &BatchError{Items: rejected}
+	}
+
+	created := make([]Book, len(accepted))
+	for i, b := range accepted {
+		created[i] = s.insert(b)
+	}
+	if len(rejected) > 0 {
+		return created, &BatchError{Items: rejected}
+	}
+	return created, nil
+}
+
+// CheckMany esegue su books gli stessi controlli di CreateMany senza creare
+// nulla: ritorna i libri che verrebbero creati, in forma canonica ma senza
+// ID né date, e gli scarti nello stesso *BatchError. Il risultato vale per
+// lo store al momento della chiamata: una scrittura successiva può ancora
+// rubare un ISBN.
+func (s *BookStore) CheckMany(ctx context.Context, books []Book, atomic bool) ([]Book, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	accepted, rejected := s.checkBatch(books)
+	if atomic && len(rejected) > 0 {
+		return nil, &BatchError{Items: rejected}
+	}
+	if len(rejected) > 0 {
+		return accepted, &BatchError{Items: rejected}
+	}
+	return accepted, nil
+}
+
+// checkBatch valida books e scarta gli ISBN già presenti o ripetuti nel
+// batch. Va chiamata con il lock, in lettura o in scrittura.
+func (s *BookStore) checkBatch(books []Book) (accepted []Book, rejected []bulkError) {
+	accepted = make([]Book, 0, len(books))
+	inBatch := make(map[string]bool)
+	for i, b := range books {
+		err := validateBook(&b)
+		if err == nil {
+			if _, taken := s.byISBN[b.ISBN]; taken || inBatch[b.ISBN] {
+				err = ErrDuplicateISBN
+			}
+		}
+		if err != nil {
+			rejected = append(rejected, bulkError{Index: i, Error: err.Error()})
+			continue
+		}
+		inBatch[b.ISBN] = true
+		accepted = append(accepted, b)
+	}
+	return accepted, rejected
+}
+
+func (s *BookStore) Update(ctx context.Context, id string, b Book) (Book, error) {
+	return s.UpdateIfMatch(ctx, id, b, "")
+}
+
+// UpdateIfMatch è Update condizionata: se ifMatch non è vuoto deve
+// corrispondere all'ETag della versione salvata, altrimenti ritorna
+// ErrPreconditionFailed senza modificare nulla. Il confronto avviene sotto
+// lock, quindi due client con lo stesso ETag non possono vincere entrambi.
+func (s *BookStore) UpdateIfMatch(ctx context.Context, id string, b Book, ifMatch string) (Book, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return Book{}, err
+	}
 	old, ok := s.books[id]
 	if !ok {
-		return Book{}, false
+		return Book{}, ErrNotFound
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, old.ETag()) {
+		return Book{}, ErrPreconditionFailed
+	}
+	if err := s.reindexISBN(id, old.ISBN, b.ISBN); err != nil {
+		return Book{}, err
 	}
 
 	b.ID = old.ID
 	b.CreatedAt = old.CreatedAt
+	b.UpdatedAt = time.Now().UTC()
 	s.books[id] = b
-	return b, true
+	return b, nil
+
+}
+
+// bookPatch è il corpo di PATCH /books/{id}: i campi nil non vengono toccati.
+// ID e CreatedAt non ci sono perché sono immutabili.
+type bookPatch struct {
+	Title       *string `json:"title"`
+	Author      *string `json:"author"`
+	ISBN        *string `json:"isbn"`
+	PublishYear *int    `json:"publish_year"`
+}
 
+func (p bookPatch) apply(b *Book) {
+	if p.Title != nil {
+		b.Title = *p.Title
+	}
+	if p.Author != nil {
+		b.Author = *p.Author
+	}
+	if p.ISBN != nil {
+		b.ISBN = *p.ISBN
+	}
+	if p.PublishYear != nil {
+		b.PublishYear = *p.PublishYear
+	}
 }
 
-func (s *BookStore) Delete(id string) bool {
+// Patch applica p al libro id e valida il risultato, tutto sotto lock così
+// una PUT concorrente non può finire in mezzo tra lettura e scrittura.
+func (s *BookStore) Patch(ctx context.Context, id string, p bookPatch) (Book, error) {
+	return s.PatchIfMatch(ctx, id, p, "")
+}
+
+// PatchIfMatch è Patch con la stessa precondizione di UpdateIfMatch.
+func (s *BookStore) PatchIfMatch(ctx context.Context, id string, p bookPatch, ifMatch string) (Book, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if _, ok := s.books[id]; !ok {
-		return false
+	if err := ctx.Err(); err != nil {
+		return Book{}, err
+	}
+	b, ok := s.books[id]
+	if !ok {
+		return Book{}, ErrNotFound
+	}
+	if ifMatch != "" && !etagMatches(ifMatch, b.ETag()) {
+		return Book{}, ErrPreconditionFailed
+	}
+	oldISBN := b.ISBN
+	p.apply(&b)
+	if err := validateBook(&b); err != nil {
+		return Book{}, err
+	}
+	if err := s.reindexISBN(id, oldISBN, b.ISBN); err != nil {
+		return Book{}, err
+	}
+	b.UpdatedAt = time.Now().UTC()
+	s.books[id] = b
+	return b, nil
+}
+
+func (s *BookStore) Delete(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	b, ok := s.books[id]
+	if !ok {
+		return ErrNotFound
 	}
 	delete(s.books, id)
-	return true
+	delete(s.byISBN, b.ISBN)
+	return nil
+}
+
+// storeSnapshot è il formato su disco di SaveToFile e LoadFromFile.
+type storeSnapshot struct {
+	NextID int64  `json:"next_id"`
+	Books  []Book `json:"books"`
+}
+
+// SaveToFile scrive il catalogo su path in modo atomico: il JSON va prima in
+// un file temporaneo nella stessa directory, poi os.Rename lo sostituisce a
+// path, così un crash a metà lascia intatta la versione precedente.
+func (s *BookStore) SaveToFile(path string) error {
+	s.mu.RLock()
+	snap := storeSnapshot{NextID: s.nextID, Books: make([]Book, 0, len(s.books))}
+	for _, b := range s.books {
+		snap.Books = append(snap.Books, b)
+	}
+	s.mu.RUnlock()
+	sortByID(snap.Books)
+
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// LoadFromFile sostituisce il contenuto dello store con quello salvato su
+// path. Se il file non esiste ritorna un errore che soddisfa
+// errors.Is(err, os.ErrNotExist).
+func (s *BookStore) LoadFromFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap storeSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	books := make(map[string]Book, len(snap.Books))
+	byISBN := make(map[string]string, len(snap.Books))
+	nextID := snap.NextID
+	for _, b := range snap.Books {
+		// file salvati prima dell'introduzione di updated_at
+		if b.UpdatedAt.IsZero() {
+			b.UpdatedAt = b.CreatedAt
+		}
+		// e prima della forma canonica dell'ISBN
+		if isbn, ok := canonicalISBN(b.ISBN); ok {
+			b.ISBN = isbn
+		}
+		books[b.ID] = b
+		byISBN[b.ISBN] = b.ID
+		// nextID non deve mai riassegnare un ID esistente, anche se il file
+		// è stato modificato a mano
+		if n, err := strconv.ParseInt(b.ID, 10, 64); err == nil && n > nextID {
+			nextID = n
+		}
+	}
+	s.mu.Lock()
+	s.books, s.byISBN, s.nextID = books, byISBN, nextID
+	s.mu.Unlock()
+	return nil
+}
+
+// reindexISBN sposta il libro id da oldISBN a newISBN nell'indice, o ritorna
+// ErrDuplicateISBN se newISBN è già di un altro libro. Va chiamata con il
+// lock in scrittura.
+func (s *BookStore) reindexISBN(id, oldISBN, newISBN string) error {
+	if owner, taken := s.byISBN[newISBN]; taken && owner != id {
+		return ErrDuplicateISBN
+	}
+	delete(s.byISBN, oldISBN)
+	s.byISBN[newISBN] = id
+	return nil
 }
 
 func writeJSON(w http.ResponseWriter, status int, v any) {
@@ -102,27 +611,397 @@ func writeError(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
+// writeStoreError traduce gli errori dello store nello status HTTP corrispondente.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		writeError(w, http.StatusNotFound, "not found")
+	case errors.Is(err, errInvalidBook), errors.Is(err, errInvalidISBN):
+		writeError(w, http.StatusBadRequest, err.Error())
+	case errors.Is(err, ErrDuplicateISBN):
+		writeError(w, http.StatusConflict, err.Error())
+	case errors.Is(err, ErrPreconditionFailed):
+		writeError(w, http.StatusPreconditionFailed, err.Error())
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		writeError(w, http.StatusServiceUnavailable, "request timeout")
+	default:
+		writeError(w, http.StatusInternalServerError, "internal error")
+	}
+}
+
+var (
+	errInvalidBook = errors.New("invalid book data")
+	errInvalidISBN = errors.New("invalid isbn")
+)
+
+// validateBook normalizza i campi di b e verifica che siano tutti valorizzati
+// e che l'ISBN sia valido.
+func validateBook(b *Book) error {
+	b.Title = strings.TrimSpace(b.Title)
+	b.Author = strings.TrimSpace(b.Author)
+	b.ISBN = strings.TrimSpace(b.ISBN)
+	if b.Title == "" || b.Author == "" || b.ISBN == "" || b.PublishYear <= 0 {
+		return errInvalidBook
+	}
+	isbn, ok := canonicalISBN(b.ISBN)
+	if !ok {
+		return errInvalidISBN
+	}
+	b.ISBN = isbn
+	return nil
+}
+
+// validateISBN accetta ISBN-10 e ISBN-13 (solo prefissi 978 e 979), con o
+// senza trattini e spazi, e ne verifica la cifra di controllo.
+func validateISBN(s string) bool {
+	_, ok := canonicalISBN(s)
+	return ok
+}
+
+// canonicalISBN ritorna la forma con cui un ISBN valido viene salvato e
+// indicizzato: ISBN-13 di sole cifre. Senza, "0306406152", "0-306-40615-2"
+// e "9780306406157" sarebbero tre libri diversi per il controllo duplicati.
+func canonicalISBN(s string) (string, bool) {
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+	switch len(s) {
+	case 10:
+		// pesi da 10 a 1; l'ultima cifra può essere X (= 10)
+		sum := 0
+		for i, r := range s {
+			var d int
+			switch {
+			case r >= '0' && r <= '9':
+				d = int(r - '0')
+			case (r == 'X' || r == 'x') && i == 9:
+				d = 10
+			default:
+				return "", false
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", false
+		}
+		// l'ISBN-13 equivalente è 978 + le prime 9 cifre + una nuova cifra di controllo
+		s13 := "978" + s[:9]
+		return s13 + strconv.Itoa((10-isbn13Sum(s13)%10)%10), true
+	case 13:
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", false
+		}
+		for _, r := range s {
+			if r < '0' || r > '9' {
+				return "", false
+			}
+		}
+		if isbn13Sum(s)%10 != 0 {
+			return "", false
+		}
+		return s, true
+	}
+	return "", false
+}
+
+// isbn13Sum somma le cifre di s con pesi alternati 1 e 3; s sono solo cifre.
+func isbn13Sum(s string) int {
+	sum := 0
+	for i, r := range s {
+		d := int(r - '0')
+		if i%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum
+}
+
+// bulkResponse è la risposta di POST /books/bulk.
+type bulkResponse struct {
+	Created []Book      `json:"created"`
+	Errors  []bulkError `json:"errors"`
+}
+
+// handleBulk importa un array di libri con CreateMany: di default un elemento
+// scartato viene riportato in errors senza far fallire gli altri, con
+// ?atomic=true invece ne basta uno perché non venga creato niente e la
+// risposta è 422.
+// Con ?validate_only=true esegue solo i controlli, compresi i duplicati, con
+// CheckMany: non tocca lo store e risponde con la stessa forma, dove created
+// elenca i libri che l'import creerebbe, con id vuoto e date a zero.
+func handleBulk(store *BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		q := r.URL.Query()
+		validateOnly, err := strconv.ParseBool(q.Get("validate_only"))
+		if err != nil && q.Has("validate_only") {
+			writeError(w, http.StatusBadRequest, "invalid validate_only")
+			return
+		}
+		atomic, err := strconv.ParseBool(q.Get("atomic"))
+		if err != nil && q.Has("atomic") {
+			writeError(w, http.StatusBadRequest, "invalid atomic")
+			return
+		}
+
+		var books []Book
+		if err := json.NewDecoder(r.Body).Decode(&books); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid json")
+			return
+		}
+
+		var created []Book
+		if validateOnly {
+			created, err = store.CheckMany(r.Context(), books, atomic)
+		} else {
+			created, err = store.CreateMany(r.Context(), books, atomic)
+		}
+		resp := bulkResponse{Created: []Book{}, Errors: []bulkError{}}
+		status := http.StatusOK
+		var batchErr *BatchError
+		switch {
+		case errors.As(err, &batchErr):
+			resp.Errors = batchErr.Items
+			// in modalità atomica non è stato creato niente
+			if atomic {
+				status = http.StatusUnprocessableEntity
+			}
+		case err != nil:
+			writeStoreError(w, err)
+			return
+		}
+		if created != nil {
+			resp.Created = created
+		}
+		writeJSON(w, status, resp)
+	}
+}
+
+// handleStats riassume il catalogo: totale e numero di libri per autore e per anno.
+func handleStats(store *BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		books, err := store.List(r.Context())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		byAuthor := make(map[string]int)
+		byYear := make(map[string]int)
+		for _, b := range books {
+			byAuthor[b.Author]++
+			byYear[strconv.Itoa(b.PublishYear)]++
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"total":     len(books),
+			"by_author": byAuthor,
+			"by_year":   byYear,
+		})
+	}
+}
+
+// handleExport scarica l'intero catalogo in CSV, ordinato per ID.
+func handleExport(store *BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		books, err := store.List(r.Context())
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		sortByID(books)
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="books.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "title", "author", "isbn", "publish_year"})
+		for _, b := range books {
+			cw.Write([]string{b.ID, b.Title, b.Author, b.ISBN, strconv.Itoa(b.PublishYear)})
+		}
+		cw.Flush()
+	}
+}
+
+// streamLineResult è l'esito di una riga di POST /books/stream; Line parte da 1.
+type streamLineResult struct {
+	Line  int    `json:"line"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// handleStream importa libri in formato NDJSON (un oggetto JSON per riga)
+// leggendo il body man mano, e risponde con un risultato NDJSON per riga.
+// Ogni riga viene decodificata per conto suo: un json.Decoder sull'intero
+// body non saprebbe ripartire dopo un errore di sintassi, mentre così una
+// riga malformata produce solo il suo errore. Le righe vuote sono ignorate.
+func handleStream(store *BookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		// con HTTP/1.x serve per continuare a leggere il body dopo aver
+		// iniziato a rispondere; se il writer non lo supporta si va avanti
+		http.NewResponseController(w).EnableFullDuplex()
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.WriteHeader(http.StatusOK)
+		enc := json.NewEncoder(w)
+		flusher, _ := w.(http.Flusher)
+
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		lineNum := 0
+		for scanner.Scan() {
+			lineNum++
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			res := streamLineResult{Line: lineNum}
+			var b Book
+			if err := json.Unmarshal(line, &b); err != nil {
+				res.Error = "invalid json"
+			} else if err := validateBook(&b); err != nil {
+				res.Error = err.Error()
+			} else {
+				created, err := store.Create(r.Context(), b)
+				switch {
+				case errors.Is(err, ErrDuplicateISBN):
+					res.Error = err.Error()
+				case err != nil:
+					// context scaduto o client andato via: inutile continuare
+					log.Printf("stream import stopped at line %d: %v", lineNum, err)
+					return
+				default:
+					res.ID = created.ID
+				}
+			}
+			enc.Encode(res)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			enc.Encode(streamLineResult{Line: lineNum + 1, Error: "read error: " + err.Error()})
+		}
+	}
+}
+
+// sortByID ordina i libri per ID numerico, l'ordine di creazione.
+func sortByID(books []Book) {
+	sort.Slice(books, func(i, j int) bool {
+		a, _ := strconv.Atoi(books[i].ID)
+		b, _ := strconv.Atoi(books[j].ID)
+		return a < b
+	})
+}
+
+const defaultPageLimit = 50
+
+// parsePage legge limit e offset dalla query; limit assente o 0 vale
+// defaultPageLimit.
+func parsePage(q url.Values) (limit, offset int, err error) {
+	limit = defaultPageLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid limit")
+		}
+		if n > 0 {
+			limit = n
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0, 0, errors.New("invalid offset")
+		}
+		offset = n
+	}
+	return limit, offset, nil
+}
+
+// filterBooks tiene i libri il cui autore è author e il cui titolo o autore
+// contiene q, senza distinguere maiuscole e minuscole. Un parametro vuoto non
+// filtra.
+func filterBooks(books []Book, author, q string) []Book {
+	if author == "" && q == "" {
+		return books
+	}
+	q = strings.ToLower(q)
+	out := books[:0]
+	for _, b := range books {
+		if author != "" && !strings.EqualFold(b.Author, author) {
+			continue
+		}
+		if q != "" && !strings.Contains(strings.ToLower(b.Title), q) && !strings.Contains(strings.ToLower(b.Author), q) {
+			continue
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bookPage è la risposta di GET /books; total conta tutti i libri che
+// passano i filtri, non solo quelli della pagina.
+type bookPage struct {
+	Books  []Book `json:"books"`
+	Total  int    `json:"total"`
+	Limit  int    `json:"limit"`
+	Offset int    `json:"offset"`
+}
+
 func handleBooks(store *BookStore) http.HandlerFunc {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
-			books := store.List()
-			writeJSON(w, http.StatusOK, map[string]any{"books": books})
+			limit, offset, err := parsePage(r.URL.Query())
+			if err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			books, err := store.List(r.Context())
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			books = filterBooks(books, r.URL.Query().Get("author"), r.URL.Query().Get("q"))
+			// la mappa dello store non ha ordine: senza sort le pagine
+			// cambierebbero tra una richiesta e l'altra
+			sortByID(books)
+			page := bookPage{Books: []Book{}, Total: len(books), Limit: limit, Offset: offset}
+			if offset < len(books) {
+				end := len(books)
+				if limit < end-offset {
+					end = offset + limit
+				}
+				page.Books = books[offset:end]
+			}
+			writeJSON(w, http.StatusOK, page)
 		case http.MethodPost:
 			var b Book
 			if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
 				writeError(w, http.StatusBadRequest, "invalid json")
 				return
 			}
-			b.Title = strings.TrimSpace(b.Title)
-			b.Author = strings.TrimSpace(b.Author)
-			b.ISBN = strings.TrimSpace(b.ISBN)
-			if b.Title == "" || b.Author == "" || b.ISBN == "" || b.PublishYear <= 0 {
-				writeError(w, http.StatusBadRequest, "invalid book data")
+			if err := validateBook(&b); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+			created, err := store.Create(r.Context(), b)
+			if err != nil {
+				writeStoreError(w, err)
 				return
 			}
-			created := store.Create(b)
 			writeJSON(w, http.StatusCreated, created)
 		default:
 			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
@@ -147,11 +1026,12 @@ func handleBook(store *BookStore) http.HandlerFunc {
 		switch r.Method {
 
 		case http.MethodGet:
-			book, ok := store.Get(id)
-			if !ok {
-				writeError(w, http.StatusNotFound, "not found")
+			book, err := store.Get(r.Context(), id)
+			if err != nil {
+				writeStoreError(w, err)
 				return
 			}
+			w.Header().Set("ETag", book.ETag())
 			writeJSON(w, http.StatusOK, book)
 		case http.MethodPut:
 			var b Book
@@ -159,22 +1039,33 @@ func handleBook(store *BookStore) http.HandlerFunc {
 				writeError(w, http.StatusBadRequest, "invalid json")
 				return
 			}
-			b.Title = strings.TrimSpace(b.Title)
-			b.Author = strings.TrimSpace(b.Author)
-			b.ISBN = strings.TrimSpace(b.ISBN)
-			if b.Title == "" || b.Author == "" || b.ISBN == "" || b.PublishYear <= 0 {
-				writeError(w, http.StatusBadRequest, "invalid book data")
+			if err := validateBook(&b); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error())
 				return
 			}
-			updated, ok := store.Update(id, b)
-			if !ok {
-				writeError(w, http.StatusNotFound, "not found")
+			updated, err := store.UpdateIfMatch(r.Context(), id, b, r.Header.Get("If-Match"))
+			if err != nil {
+				writeStoreError(w, err)
 				return
 			}
+			w.Header().Set("ETag", updated.ETag())
 			writeJSON(w, http.StatusOK, updated)
+		case http.MethodPatch:
+			var p bookPatch
+			if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid json")
+				return
+			}
+			patched, err := store.PatchIfMatch(r.Context(), id, p, r.Header.Get("If-Match"))
+			if err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			w.Header().Set("ETag", patched.ETag())
+			writeJSON(w, http.StatusOK, patched)
 		case http.MethodDelete:
-			if !store.Delete(id) {
-				writeError(w, http.StatusNotFound, "not found")
+			if err := store.Delete(r.Context(), id); err != nil {
+				writeStoreError(w, err)
 				return
 			}
 			w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestStore() *BookStore {
+	return NewBookStore()
+}
+
+func TestWithTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+			writeJSON(w, http.StatusOK, map[string]string{"status": "done"})
+		case <-r.Context().Done():
+		}
+	})
+	mux.HandleFunc("/books", handleBooks(newTestStore()))
+	mux.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	h := withTimeout(50*time.Millisecond, mux)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("slow handler: status = %d, want 503", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("slow handler: Content-Type = %q", ct)
+	}
+	if !strings.Contains(rec.Body.String(), `"error":"request timeout"`) {
+		t.Errorf("slow handler: body = %q", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("fast handler: status = %d, want 200", rec.Code)
+	}
+
+	// il Content-Type JSON riguarda solo il body di timeout
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/empty", nil))
+	if ct := rec.Header().Get("Content-Type"); rec.Code != http.StatusNoContent || ct != "" {
+		t.Errorf("204 handler: status = %d, Content-Type = %q", rec.Code, ct)
+	}
+}
+
+func TestStoreAbortsOnExpiredContext(t *testing.T) {
+	store := newTestStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := store.Create(ctx, Book{Title: "t", Author: "a", ISBN: "i", PublishYear: 2000})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Create err = %v, want context.Canceled", err)
+	}
+	if books, _ := store.List(context.Background()); len(books) != 0 {
+		t.Fatalf("store has %d books after cancelled Create", len(books))
+	}
+}
+
+func TestStatusRecorderCapturesWriteJSON(t *testing.T) {
+	rec := newStatusRecorder(httptest.NewRecorder())
+	writeJSON(rec, http.StatusCreated, map[string]string{"id": "1"})
+
+	if rec.Status() != http.StatusCreated {
+		t.Errorf("status = %d, want 201", rec.Status())
+	}
+	if want := len("{\"id\":\"1\"}\n"); rec.Bytes() != want {
+		t.Errorf("bytes = %d, want %d", rec.Bytes(), want)
+	}
+
+	empty := newStatusRecorder(httptest.NewRecorder())
+	if empty.Status() != http.StatusOK {
+		t.Errorf("status without writes = %d, want 200", empty.Status())
+	}
+}
+
+func TestStatusRecorderFlusher(t *testing.T) {
+	inner := httptest.NewRecorder()
+	var w http.ResponseWriter = newStatusRecorder(inner)
+	f, ok := w.(http.Flusher)
+	if !ok {
+		t.Fatal("statusRecorder does not implement http.Flusher")
+	}
+	w.Write([]byte("chunk"))
+	f.Flush()
+	if !inner.Flushed {
+		t.Error("Flush not passed through to the underlying writer")
+	}
+
+	if _, _, err := w.(http.Hijacker).Hijack(); err == nil {
+		t.Error("Hijack on a non-hijackable writer should fail")
+	}
+}
+
+func TestBulkValidateOnly(t *testing.T) {
+	store := newTestStore()
+	h := handleBulk(store)
+	body := `[
+		{"title":"Il nome della rosa","author":"Umberto Eco","isbn":"9788845292613","publish_year":1980},
+		{"title":"","author":"Anonimo","isbn":"123","publish_year":2000}
+	]`
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/bulk?validate_only=true", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, body = %s", rec.Code, rec.Body)
+	}
+	var dry bulkResponse
+	if err := json.NewDecoder(rec.Body).Decode(&dry); err != nil {
+		t.Fatal(err)
+	}
+	if len(dry.Created) != 1 || dry.Created[0].ISBN != "9788845292613" || dry.Created[0].ID != "" {
+		t.Errorf("validate_only created = %+v, want the valid book without id", dry.Created)
+	}
+	if want := []bulkError{{Index: 1, Error: "invalid book data"}}; !reflect.DeepEqual(dry.Errors, want) {
+		t.Errorf("validate_only errors = %+v, want %+v", dry.Errors, want)
+	}
+	if books, _ := store.List(context.Background()); len(books) != 0 {
+		t.Fatalf("validate_only created %d books", len(books))
+	}
+
+	// senza validate_only lo stesso batch crea solo il libro valido
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/bulk", strings.NewReader(body)))
+	var resp bulkResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Created) != 1 || resp.Created[0].ID == "" || len(resp.Errors) != 1 || resp.Errors[0].Index != 1 {
+		t.Errorf("real import response = %+v", resp)
+	}
+	if books, _ := store.List(context.Background()); len(books) != 1 {
+		t.Fatalf("store has %d books, want 1", len(books))
+	}
+}
+
+func TestBulkValidateOnlyDuplicates(t *testing.T) {
+	store := newTestStore()
+	store.Create(context.Background(), Book{Title: "Esistente", Author: "X", ISBN: "9780131103627", PublishYear: 1988})
+	body := `[
+		{"title":"A","author":"X","isbn":"0306406152","publish_year":2000},
+		{"title":"B","author":"X","isbn":"978-0-306-40615-7","publish_year":2000},
+		{"title":"C","author":"X","isbn":"0131103628","publish_year":2000}
+	]`
+
+	rec := httptest.NewRecorder()
+	handleBulk(store).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/bulk?validate_only=true", strings.NewReader(body)))
+	var dry bulkResponse
+	if err := json.NewDecoder(rec.Body).Decode(&dry); err != nil {
+		t.Fatal(err)
+	}
+	// B ripete A nel batch, C è già nello store
+	want := []bulkError{{Index: 1, Error: "duplicate isbn"}, {Index: 2, Error: "duplicate isbn"}}
+	if len(dry.Created) != 1 || dry.Created[0].Title != "A" || !reflect.DeepEqual(dry.Errors, want) {
+		t.Errorf("validate_only response = %+v", dry)
+	}
+	if books, _ := store.List(context.Background()); len(books) != 1 {
+		t.Fatalf("validate_only changed the store: %d books", len(books))
+	}
+}
+
+func TestBulkAtomic(t *testing.T) {
+	body := `[
+		{"title":"A","author":"X","isbn":"0306406152","publish_year":2000},
+		{"title":"B","author":"X","isbn":"9780131103627","publish_year":2000},
+		{"title":"C","author":"X","isbn":"1234567890","publish_year":2000},
+		{"title":"D","author":"X","isbn":"0-306-40615-2","publish_year":2000}
+	]`
+	post := func(store *BookStore, query string, wantStatus int) bulkResponse {
+		rec := httptest.NewRecorder()
+		handleBulk(store).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/bulk"+query, strings.NewReader(body)))
+		if rec.Code != wantStatus {
+			t.Errorf("%s: status = %d, want %d", query, rec.Code, wantStatus)
+		}
+		var resp bulkResponse
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatalf("%s: %v (status %d)", query, err, rec.Code)
+		}
+		return resp
+	}
+	// D è A con i trattini: stesso libro
+	wantErrors := []bulkError{{Index: 2, Error: "invalid isbn"}, {Index: 3, Error: "duplicate isbn"}}
+
+	partial := newTestStore()
+	resp := post(partial, "", http.StatusOK)
+	if len(resp.Created) != 2 || !reflect.DeepEqual(resp.Errors, wantErrors) {
+		t.Errorf("partial: %+v", resp)
+	} else if resp.Created[0].ISBN != "9780306406157" {
+		t.Errorf("stored isbn = %q, want the canonical ISBN-13", resp.Created[0].ISBN)
+	}
+
+	atomic := newTestStore()
+	resp = post(atomic, "?atomic=true", http.StatusUnprocessableEntity)
+	if len(resp.Created) != 0 || !reflect.DeepEqual(resp.Errors, wantErrors) {
+		t.Errorf("atomic: %+v", resp)
+	}
+	if books, _ := atomic.List(context.Background()); len(books) != 0 {
+		t.Errorf("atomic batch with a bad record created %d books", len(books))
+	}
+	if resp = post(atomic, "?atomic=true&validate_only=true", http.StatusUnprocessableEntity); len(resp.Created) != 0 {
+		t.Errorf("atomic validate_only: %+v", resp)
+	}
+
+	// ISBN ripetuto dentro lo stesso batch
+	_, err := newTestStore().CreateMany(context.Background(), []Book{
+		{Title: "A", Author: "X", ISBN: "0306406152", PublishYear: 2000},
+		{Title: "B", Author: "X", ISBN: "0306406152", PublishYear: 2000},
+	}, false)
+	var batchErr *BatchError
+	if !errors.As(err, &batchErr) || !reflect.DeepEqual(batchErr.Items, []bulkError{{Index: 1, Error: "duplicate isbn"}}) {
+		t.Errorf("duplicate inside batch: err = %v", err)
+	}
+}
+
+func TestLimitConcurrentRejectsExcess(t *testing.T) {
+	const limit = 2
+	entered := make(chan struct{}, limit)
+	release := make(chan struct{})
+	h := limitConcurrent(limit, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		writeJSON(w, http.StatusOK, map[string]string{"status": "done"})
+	}))
+	ts := httptest.NewServer(h)
+	defer ts.Close()
+
+	codes := make(chan int, limit)
+	for i := 0; i < limit; i++ {
+		go func() {
+			resp, err := http.Get(ts.URL)
+			if err != nil {
+				codes <- 0
+				return
+			}
+			resp.Body.Close()
+			codes <- resp.StatusCode
+		}()
+	}
+	for i := 0; i < limit; i++ {
+		<-entered
+	}
+
+	// con entrambi gli slot occupati le richieste in più vengono respinte subito
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("excess request: status = %d, want 503", resp.StatusCode)
+		}
+		if resp.Header.Get("Retry-After") == "" {
+			t.Error("excess request: missing Retry-After")
+		}
+	}
+
+	close(release)
+	for i := 0; i < limit; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("permitted request: status = %d, want 200", code)
+		}
+	}
+}
+
+func TestStatsAndExport(t *testing.T) {
+	store := newTestStore()
+	ctx := context.Background()
+	store.Create(ctx, Book{Title: "A, con virgola", Author: "Eco", ISBN: "1", PublishYear: 1980})
+	store.Create(ctx, Book{Title: "B", Author: "Eco", ISBN: "2", PublishYear: 1988})
+
+	rec := httptest.NewRecorder()
+	handleStats(store).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Total    int            `json:"total"`
+		ByAuthor map[string]int `json:"by_author"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 2 || stats.ByAuthor["Eco"] != 2 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	handleExport(store).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/export", nil))
+	want := "id,title,author,isbn,publish_year\n1,\"A, con virgola\",Eco,1,1980\n2,B,Eco,2,1988\n"
+	if rec.Body.String() != want {
+		t.Errorf("export = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestStreamImport(t *testing.T) {
+	store := newTestStore()
+	body := strings.Join([]string{
+		`{"title":"Primo","author":"A","isbn":"0306406152","publish_year":2001}`,
+		`{"title":"Secondo","author":"B",`,
+		``,
+		`{"title":"","author":"C","isbn":"3","publish_year":2003}`,
+		`{"title":"Quarto","author":"D","isbn":"9780306406157","publish_year":2004}`,
+	}, "\n")
+
+	rec := httptest.NewRecorder()
+	handleStream(store).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books/stream", strings.NewReader(body)))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	dec := json.NewDecoder(rec.Body)
+	var got []streamLineResult
+	for dec.More() {
+		var res streamLineResult
+		if err := dec.Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, res)
+	}
+	want := []streamLineResult{
+		{Line: 1, ID: "1"},
+		{Line: 2, Error: "invalid json"},
+		{Line: 4, Error: "invalid book data"},
+		// l'ISBN-13 della riga 1
+		{Line: 5, Error: "duplicate isbn"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("results = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	books, _ := store.List(context.Background())
+	if len(books) != 1 {
+		t.Fatalf("store has %d books, want 1", len(books))
+	}
+}
+
+// TestStreamImportThroughServer passa dallo stack completo di newHandler:
+// il primo risultato deve arrivare prima che il client finisca di mandare
+// il body, e l'import deve sopravvivere al request timeout.
+func TestStreamImportThroughServer(t *testing.T) {
+	store := newTestStore()
+	const timeout = 50 * time.Millisecond
+	ts := httptest.NewServer(newHandler(store, timeout, 2))
+	defer ts.Close()
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, _ := http.NewRequest(http.MethodPost, ts.URL+"/books/stream", pr)
+	respCh := make(chan *http.Response, 1)
+	errCh := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		respCh <- resp
+	}()
+
+	io.WriteString(pw, `{"title":"Primo","author":"A","isbn":"0306406152","publish_year":2001}`+"\n")
+	var resp *http.Response
+	select {
+	case resp = <-respCh:
+	case err := <-errCh:
+		t.Fatal(err)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no response while the body is still open: output is buffered")
+	}
+	defer resp.Body.Close()
+	dec := json.NewDecoder(resp.Body)
+	var first streamLineResult
+	if err := dec.Decode(&first); err != nil {
+		t.Fatal(err)
+	}
+	if first != (streamLineResult{Line: 1, ID: "1"}) {
+		t.Errorf("first result = %+v", first)
+	}
+
+	time.Sleep(2 * timeout)
+	io.WriteString(pw, `{"title":"Secondo","author":"B","isbn":"9780131103627","publish_year":2002}`+"\n")
+	pw.Close()
+	var second streamLineResult
+	if err := dec.Decode(&second); err != nil {
+		t.Fatalf("second result after the request timeout: %v", err)
+	}
+	if second != (streamLineResult{Line: 2, ID: "2"}) {
+		t.Errorf("second result = %+v", second)
+	}
+}
+
+func TestStreamImportStopsOnCancel(t *testing.T) {
+	store := newTestStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	body := `{"title":"Primo","author":"A","isbn":"0306406152","publish_year":2001}` + "\n"
+	req := httptest.NewRequest(http.MethodPost, "/books/stream", strings.NewReader(body)).WithContext(ctx)
+	handleStream(store).ServeHTTP(httptest.NewRecorder(), req)
+	if books, _ := store.List(context.Background()); len(books) != 0 {
+		t.Fatalf("cancelled stream created %d books", len(books))
+	}
+}
+
+func TestDeleteBook(t *testing.T) {
+	store := newTestStore()
+	h := handleBook(store)
+	created, err := store.Create(context.Background(), Book{Title: "T", Author: "A", ISBN: "1", PublishYear: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := "/books/" + created.ID
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, path, nil))
+	if rec.Code != http.StatusNoContent || rec.Body.Len() != 0 {
+		t.Fatalf("DELETE: status %d, body %q; want 204 and no body", rec.Code, rec.Body.String())
+	}
+
+	for _, method := range []string{http.MethodGet, http.MethodDelete} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+		var body map[string]string
+		json.NewDecoder(rec.Body).Decode(&body)
+		if rec.Code != http.StatusNotFound || body["error"] != "not found" {
+			t.Errorf("%s after delete: status %d, body %v; want 404 not found", method, rec.Code, body)
+		}
+	}
+}
+
+func TestListBooksPagination(t *testing.T) {
+	store := newTestStore()
+	for i := 0; i < 12; i++ {
+		store.Create(context.Background(), Book{Title: "T", Author: "A", ISBN: strconv.Itoa(i), PublishYear: 2000})
+	}
+	h := handleBooks(store)
+	get := func(query string) (int, bookPage) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books"+query, nil))
+		var page bookPage
+		json.NewDecoder(rec.Body).Decode(&page)
+		return rec.Code, page
+	}
+	ids := func(books []Book) string {
+		var out []string
+		for _, b := range books {
+			out = append(out, b.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	// ordinamento numerico: "10" dopo "9", non dopo "1"
+	if code, page := get("?limit=4&offset=8"); code != http.StatusOK || ids(page.Books) != "9,10,11,12" ||
+		page.Total != 12 || page.Limit != 4 || page.Offset != 8 {
+		t.Errorf("limit=4 offset=8: %d %+v", code, page)
+	}
+	if _, page := get(""); len(page.Books) != 12 || page.Limit != defaultPageLimit {
+		t.Errorf("default page: %+v", page)
+	}
+	if _, page := get("?limit=0&offset=20"); page.Books == nil || len(page.Books) != 0 || page.Limit != defaultPageLimit {
+		t.Errorf("offset past the end: %+v", page)
+	}
+	for _, q := range []string{"?limit=-1", "?limit=x", "?offset=-3"} {
+		if code, _ := get(q); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, code)
+		}
+	}
+}
+
+func TestListBooksFilters(t *testing.T) {
+	store := newTestStore()
+	for _, b := range []Book{
+		{Title: "Il nome della rosa", Author: "Umberto Eco"},
+		{Title: "Il pendolo di Foucault", Author: "Umberto Eco"},
+		{Title: "Le città invisibili", Author: "Italo Calvino"},
+		{Title: "Eco e Narciso", Author: "Anonimo"},
+	} {
+		b.ISBN, b.PublishYear = b.Title, 2000
+		store.Create(context.Background(), b)
+	}
+	h := handleBooks(store)
+	list := func(query string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/books"+query, nil))
+		var page bookPage
+		json.NewDecoder(rec.Body).Decode(&page)
+		var ids []string
+		for _, b := range page.Books {
+			ids = append(ids, b.ID)
+		}
+		if len(ids) != page.Total {
+			t.Errorf("%s: total = %d, page has %d books", query, page.Total, len(ids))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	tests := map[string]string{
+		"":                                "1,2,3,4",
+		"?author=umberto+eco":             "1,2",
+		"?author=eco":                     "",
+		"?q=ECO":                          "1,2,4",
+		"?q=il":                           "1,2,3",
+		"?author=Umberto%20Eco&q=pendolo": "2",
+	}
+	for query, want := range tests {
+		if got := list(query); got != want {
+			t.Errorf("%q: ids = %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestPatchBook(t *testing.T) {
+	store := newTestStore()
+	orig, _ := store.Create(context.Background(), Book{Title: "Vecchio", Author: "A", ISBN: "9780306406157", PublishYear: 2000})
+	h := handleBook(store)
+	patch := func(id, body string) (int, Book) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPatch, "/books/"+id, strings.NewReader(body)))
+		var b Book
+		json.NewDecoder(rec.Body).Decode(&b)
+		return rec.Code, b
+	}
+
+	code, got := patch(orig.ID, `{"title":"  Nuovo ","id":"99","created_at":"2001-01-01T00:00:00Z"}`)
+	want := orig
+	want.Title = "Nuovo"
+	if code != http.StatusOK || !got.CreatedAt.Equal(want.CreatedAt) || got.ID != want.ID ||
+		got.Title != want.Title || got.Author != want.Author || got.ISBN != want.ISBN || got.PublishYear != want.PublishYear {
+		t.Fatalf("PATCH title: %d %+v, want %+v", code, got, want)
+	}
+
+	if code, _ := patch(orig.ID, `{"author":""}`); code != http.StatusBadRequest {
+		t.Errorf("PATCH empty author: status %d, want 400", code)
+	}
+	if code, _ := patch(orig.ID, `{"publish_year":0}`); code != http.StatusBadRequest {
+		t.Errorf("PATCH zero year: status %d, want 400", code)
+	}
+	if stored, _ := store.Get(context.Background(), orig.ID); stored.Author != "A" || stored.PublishYear != 2000 {
+		t.Errorf("rejected PATCH modified the book: %+v", stored)
+	}
+	if code, _ := patch("404", `{"title":"x"}`); code != http.StatusNotFound {
+		t.Errorf("PATCH missing book: status %d, want 404", code)
+	}
+}
+
+func TestDuplicateISBN(t *testing.T) {
+	store := newTestStore()
+	ctx := context.Background()
+	a, _ := store.Create(ctx, Book{Title: "A", Author: "X", ISBN: "9780000000019", PublishYear: 2000})
+	b, _ := store.Create(ctx, Book{Title: "B", Author: "X", ISBN: "9780000000026", PublishYear: 2000})
+
+	rec := httptest.NewRecorder()
+	handleBooks(store).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books",
+		strings.NewReader(`{"title":"C","author":"X","isbn":"9780000000019","publish_year":2000}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("create duplicate: status %d, want 409", rec.Code)
+	}
+
+	// stesso ISBN sullo stesso libro va bene, quello di un altro no
+	if _, err := store.Update(ctx, a.ID, Book{Title: "A2", Author: "X", ISBN: "9780000000019", PublishYear: 2001}); err != nil {
+		t.Errorf("update keeping own isbn: %v", err)
+	}
+	rec = httptest.NewRecorder()
+	handleBook(store).ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/books/"+b.ID,
+		strings.NewReader(`{"title":"B","author":"X","isbn":"9780000000019","publish_year":2000}`)))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("update into duplicate: status %d, want 409", rec.Code)
+	}
+	if _, err := store.Patch(ctx, b.ID, bookPatch{ISBN: &a.ISBN}); !errors.Is(err, ErrDuplicateISBN) {
+		t.Errorf("patch into duplicate: err = %v", err)
+	}
+
+	// dopo un cambio o una cancellazione il vecchio ISBN torna libero
+	newISBN := "9780000000033"
+	if _, err := store.Patch(ctx, b.ID, bookPatch{ISBN: &newISBN}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Delete(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	for _, isbn := range []string{"9780000000019", "9780000000026"} {
+		if _, err := store.Create(ctx, Book{Title: "N", Author: "X", ISBN: isbn, PublishYear: 2000}); err != nil {
+			t.Errorf("create with freed isbn %s: %v", isbn, err)
+		}
+	}
+}
+
+func TestValidateISBN(t *testing.T) {
+	valid := []string{"0306406152", "0-8044-2957-X", "080442957x", "978-0-306-40615-7", "9791000000008", "978 0134 190440"}
+	invalid := []string{"", "0306406153", "X306406152", "03064061521", "9780306406158", "9770306406150", "978030640615a"}
+	for _, s := range valid {
+		if !validateISBN(s) {
+			t.Errorf("validateISBN(%q) = false, want true", s)
+		}
+	}
+	for _, s := range invalid {
+		if validateISBN(s) {
+			t.Errorf("validateISBN(%q) = true, want false", s)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	handleBooks(newTestStore()).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/books",
+		strings.NewReader(`{"title":"T","author":"A","isbn":"1234567890","publish_year":2000}`)))
+	var body map[string]string
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusBadRequest || body["error"] != "invalid isbn" {
+		t.Errorf("POST with bad isbn: %d %v", rec.Code, body)
+	}
+}
+
+func TestCanonicalISBN(t *testing.T) {
+	for in, want := range map[string]string{
+		"0306406152":        "9780306406157",
+		"0-306-40615-2":     "9780306406157",
+		"0 306 40615 2":     "9780306406157",
+		"978-0-306-40615-7": "9780306406157",
+		"080442957X":        "9780804429573",
+		"9791234567896":     "9791234567896",
+	} {
+		if got, ok := canonicalISBN(in); !ok || got != want {
+			t.Errorf("canonicalISBN(%q) = %q, %v; want %q", in, got, ok, want)
+		}
+	}
+
+	store := newTestStore()
+	ctx := context.Background()
+	for i, isbn := range []string{"0306406152", "0-306-40615-2", "0 306 40615 2", "9780306406157"} {
+		b := Book{Title: "T", Author: "A", ISBN: isbn, PublishYear: 2000}
+		if err := validateBook(&b); err != nil {
+			t.Fatal(err)
+		}
+		_, err := store.Create(ctx, b)
+		if i == 0 && err != nil || i > 0 && !errors.Is(err, ErrDuplicateISBN) {
+			t.Errorf("create %q: err = %v", isbn, err)
+		}
+	}
+}
+
+func TestSaveAndLoadFile(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "books.json")
+	store := newTestStore()
+	a, _ := store.Create(ctx, Book{Title: "A", Author: "X", ISBN: "0306406152", PublishYear: 2000})
+	b, _ := store.Create(ctx, Book{Title: "B", Author: "Y", ISBN: "9780306406157", PublishYear: 2001})
+	store.Delete(ctx, a.ID)
+	if err := store.SaveToFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+
+	loaded := newTestStore()
+	if err := loaded.LoadFromFile(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loaded.Get(ctx, b.ID)
+	if err != nil || got.Title != "B" || !got.CreatedAt.Equal(b.CreatedAt) {
+		t.Fatalf("Get after load = %+v, %v", got, err)
+	}
+	// l'ID cancellato non va riusato e l'indice ISBN va ricostruito
+	c, err := loaded.Create(ctx, Book{Title: "C", Author: "Z", ISBN: "080442957X", PublishYear: 2002})
+	if err != nil || c.ID != "3" {
+		t.Errorf("Create after load = %+v, %v; want id 3", c, err)
+	}
+	if _, err := loaded.Create(ctx, Book{Title: "D", Author: "Z", ISBN: b.ISBN, PublishYear: 2002}); !errors.Is(err, ErrDuplicateISBN) {
+		t.Errorf("duplicate isbn after load: err = %v", err)
+	}
+
+	if err := newTestStore().LoadFromFile(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want os.ErrNotExist", err)
+	}
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var buf strings.Builder
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+
+	h := logging(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusTeapot, "short and stout")
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/books/7", nil))
+
+	var entry struct {
+		Msg      string `json:"msg"`
+		Method   string `json:"method"`
+		Path     string `json:"path"`
+		Status   int    `json:"status"`
+		Bytes    int    `json:"bytes"`
+		Duration int64  `json:"duration"`
+	}
+	if err := json.Unmarshal([]byte(buf.String()), &entry); err != nil {
+		t.Fatalf("log line %q is not one JSON object: %v", buf.String(), err)
+	}
+	want := len(`{"error":"short and stout"}` + "\n")
+	if entry.Msg != "request" || entry.Method != "GET" || entry.Path != "/books/7" ||
+		entry.Status != http.StatusTeapot || entry.Bytes != want || entry.Duration <= 0 {
+		t.Errorf("log entry = %+v", entry)
+	}
+}
+
+func TestUpdatedAt(t *testing.T) {
+	store := newTestStore()
+	ctx := context.Background()
+	created, _ := store.Create(ctx, Book{Title: "A", Author: "X", ISBN: "0306406152", PublishYear: 2000})
+	if !created.UpdatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("Create: updated_at %v != created_at %v", created.UpdatedAt, created.CreatedAt)
+	}
+
+	time.Sleep(time.Millisecond)
+	updated, err := store.Update(ctx, created.ID, Book{Title: "B", Author: "X", ISBN: "0306406152", PublishYear: 2000, CreatedAt: time.Unix(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.UpdatedAt.After(created.UpdatedAt) || !updated.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("Update: created_at %v, updated_at %v", updated.CreatedAt, updated.UpdatedAt)
+	}
+
+	time.Sleep(time.Millisecond)
+	title := "C"
+	patched, err := store.Patch(ctx, created.ID, bookPatch{Title: &title})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !patched.UpdatedAt.After(updated.UpdatedAt) || !patched.CreatedAt.Equal(created.CreatedAt) {
+		t.Errorf("Patch: created_at %v, updated_at %v", patched.CreatedAt, patched.UpdatedAt)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	store := newTestStore()
+	created, _ := store.Create(context.Background(), Book{Title: "A", Author: "X", ISBN: "0306406152", PublishYear: 2000})
+	h := handleBook(store)
+	do := func(method, body, ifMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/books/"+created.ID, strings.NewReader(body))
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	etag := do(http.MethodGet, "", "").Header().Get("ETag")
+	if etag == "" || etag != do(http.MethodGet, "", "").Header().Get("ETag") {
+		t.Fatalf("ETag %q missing or unstable", etag)
+	}
+
+	// il primo client aggiorna con l'ETag corrente, il secondo ha quello vecchio
+	first := do(http.MethodPatch, `{"title":"B"}`, etag)
+	if first.Code != http.StatusOK || first.Header().Get("ETag") == etag {
+		t.Fatalf("PATCH with current ETag: %d, ETag %q", first.Code, first.Header().Get("ETag"))
+	}
+	if rec := do(http.MethodPut, `{"title":"C","author":"X","isbn":"0306406152","publish_year":2000}`, etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT with stale ETag: status %d, want 412", rec.Code)
+	}
+	if rec := do(http.MethodPatch, `{"title":"C"}`, `W/`+etag); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("PATCH with weak ETag: status %d, want 412", rec.Code)
+	}
+	if b, _ := store.Get(context.Background(), created.ID); b.Title != "B" {
+		t.Errorf("rejected update was applied: title %q", b.Title)
+	}
+
+	current := first.Header().Get("ETag")
+	if rec := do(http.MethodPatch, `{"title":"D"}`, `"stale", `+current); rec.Code != http.StatusOK {
+		t.Errorf("PATCH with ETag list: status %d", rec.Code)
+	}
+	if rec := do(http.MethodPatch, `{"title":"E"}`, "*"); rec.Code != http.StatusOK {
+		t.Errorf("PATCH with If-Match *: status %d", rec.Code)
+	}
+	if rec := do(http.MethodPatch, `{"title":"F"}`, ""); rec.Code != http.StatusOK {
+		t.Errorf("PATCH without If-Match: status %d", rec.Code)
+	}
+}
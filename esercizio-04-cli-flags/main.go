@@ -2,12 +2,27 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/spf13/cobra"
+
+	"golang-course-ex-Mauro/internal/semaphore"
 )
 
 var rootCmd = &cobra.Command{
@@ -23,42 +38,79 @@ var countCmd = &cobra.Command{
 			return fmt.Errorf("cannot use --verbose and --quiet together")
 		}
 		if len(args) == 0 {
-			return fmt.Errorf("no files provided")
+			args = []string{stdinName}
 		}
 		f := strings.ToLower(flagFormat)
 		if f != "text" && f != "json" && f != "csv" {
 			return fmt.Errorf("invalid format: %s", flagFormat)
 		}
 		flagFormat = f
-		type FileStats struct {
-			File  string
-			Stats Stats
+		runes, err := parseCharsMode(flagChars)
+		if err != nil {
+			return err
 		}
-		results := []FileStats{}
-		for _, path := range args {
-			stats, err := countFile(path, flagLines)
-			if err != nil {
+		var fields []string
+		var delim rune
+		if flagFormat == "csv" {
+			if fields, err = parseFields(flagFields); err != nil {
 				return err
 			}
+			if delim, err = parseDelimiter(flagDelimiter); err != nil {
+				return err
+			}
+		}
+		out, errOut := cmd.OutOrStdout(), cmd.ErrOrStderr()
+		paths, err := expandPaths(args, flagRecursive, errOut)
+		if err != nil {
+			return err
+		}
+		if err := checkJobs(flagJobs); err != nil {
+			return err
+		}
+		results := []FileStats{}
+		failed := 0
+		budget := newByteBudget(maxBytes)
+		for i, o := range countPaths(paths, flagJobs, flagLines, runes, budget) {
+			path, stats := paths[i], o.stats
+			if !o.done {
+				break
+			}
+			if skipUnreadable(errOut, o.err) {
+				continue
+			}
+			if o.err != nil {
+				fmt.Fprintf(errOut, "%s: %v\n", path, o.err)
+				failed++
+				continue
+			}
+			if flagVerbose {
+				fmt.Fprintf(errOut, "%s: %d bytes in %s\n", path, o.bytes, o.elapsed)
+			}
 			results = append(results, FileStats{File: path, Stats: stats})
 		}
+		budget.Report(errOut)
 
 		switch flagFormat {
 		case "text":
+			// --quiet only silences the human-readable lines; json and csv
+			// are data and are always written.
+			if flagQuiet {
+				break
+			}
 			for _, r := range results {
-				fmt.Printf("%s: lines=%d words=%d chars=%d\n", r.File, r.Stats.Lines, r.Stats.Words, r.Stats.Chars)
+				fmt.Fprintf(out, "%s: lines=%d words=%d chars=%d\n", r.File, r.Stats.Lines, r.Stats.Words, r.Stats.Chars)
 			}
 		case "json":
-			json.NewEncoder(os.Stdout).Encode(results)
+			if err := writeJSON(out, results); err != nil {
+				return err
+			}
 		case "csv":
-			fmt.Println("file,lines,words,chars")
-			for _, r := range results {
-				fmt.Printf("%s,%d,%d,%d\n", r.File, r.Stats.Lines, r.Stats.Words, r.Stats.Chars)
+			if err := writeCountCSV(out, results, fields, delim); err != nil {
+				return err
 			}
-
 		}
 
-		return nil
+		return failedFiles(failed, len(paths))
 	},
 }
 
@@ -67,28 +119,97 @@ var searchCmd = &cobra.Command{
 	Short: "Search for a pattern in files",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
-			return fmt.Errorf("no files provided")
+			args = []string{stdinName}
+		}
+		// a bad regex is a usage error: report it before touching any file
+		match, err := newMatcher(flagPattern, flagRegex, flagIgnoreCase)
+		if err != nil {
+			return err
 		}
-		for _, path := range args {
-			matches, err := searchFile(path, flagPattern, flagLines)
+		before, after := flagBefore, flagAfter
+		if !cmd.Flags().Changed("before") {
+			before = flagContext
+		}
+		if !cmd.Flags().Changed("after") {
+			after = flagContext
+		}
+		if before < 0 || after < 0 {
+			return fmt.Errorf("context line counts cannot be negative")
+		}
+		ranked := flagRank || flagSummaryOnly
+		if flagCount && ranked {
+			return fmt.Errorf("cannot use --count with --rank or --summary-only")
+		}
+		out, errOut := cmd.OutOrStdout(), cmd.ErrOrStderr()
+		paths, err := expandPaths(args, flagRecursive, errOut)
+		if err != nil {
+			return err
+		}
+		printer := &searchPrinter{w: out, separate: before > 0 || after > 0, hideNumbers: !flagLineNumber || flagNoLineNumber}
+		budget := newByteBudget(maxBytes)
+		var results []searchResult
+		total, failed := 0, 0
+		for _, path := range paths {
+			lines, err := searchFile(path, match, flagLines, before, after, budget)
+			if skipUnreadable(errOut, err) {
+				continue
+			}
 			if err != nil {
-				return err
+				fmt.Fprintf(errOut, "%s: %v\n", path, err)
+				failed++
+				continue
+			}
+			r := searchResult{File: path, Lines: lines}
+			total += r.Matches()
+			switch {
+			case flagCount:
+				fmt.Fprintf(out, "%s:%d\n", path, r.Matches())
+			case ranked:
+				// ranking needs every file's count, so nothing is printed yet
+				results = append(results, r)
+			default:
+				printer.Print(path, lines)
 			}
-			for _, m := range matches {
-				fmt.Printf("%s:%s\n", path, m)
+			if budget.Exhausted() {
+				break
 			}
 		}
+		if ranked {
+			results = rankResults(results)
+			for _, r := range results {
+				fmt.Fprintf(out, "%s: %d matches\n", r.File, r.Matches())
+			}
+			if !flagSummaryOnly {
+				fmt.Fprintln(out)
+				for _, r := range results {
+					printer.Print(r.File, r.Lines)
+				}
+			}
+		}
+		budget.Report(errOut)
 
+		if failed > 0 {
+			return failedFiles(failed, len(paths))
+		}
+		if total == 0 {
+			// like grep: no match is exit status 1, but not an error to print
+			cmd.SilenceErrors = true
+			cmd.SilenceUsage = true
+			return errNoMatches
+		}
 		return nil
 	},
 }
 
+// errNoMatches makes search exit non-zero when nothing matched in any file.
+var errNoMatches = errors.New("no matches")
+
 var statsCmd = &cobra.Command{
 	Use:   "stats [files...]",
 	Short: "Stats for a pattern in files",
 	RunE: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
-			return fmt.Errorf("no files provided")
+			args = []string{stdinName}
 		}
 
 		f := strings.ToLower(statsFormat)
@@ -96,36 +217,89 @@ var statsCmd = &cobra.Command{
 			return fmt.Errorf("invalid format: %s", statsFormat)
 		}
 		statsFormat = f
+		runes, err := parseCharsMode(statsChars)
+		if err != nil {
+			return err
+		}
 
+		out, errOut := cmd.OutOrStdout(), cmd.ErrOrStderr()
+		paths, err := expandPaths(args, flagRecursive, errOut)
+		if err != nil {
+			return err
+		}
+		if err := checkJobs(statsJobs); err != nil {
+			return err
+		}
 		total := Stats{}
-		for _, path := range args {
-			s, err := countFile(path, statsLines)
-			if err != nil {
-				return err
+		// only files actually counted: skipped, failed and the ones past
+		// the byte budget are left out
+		files, failed := 0, 0
+		budget := newByteBudget(maxBytes)
+		for i, o := range countPaths(paths, statsJobs, statsLines, runes, budget) {
+			if !o.done {
+				break
+			}
+			if skipUnreadable(errOut, o.err) {
+				continue
 			}
+			if o.err != nil {
+				fmt.Fprintf(errOut, "%s: %v\n", paths[i], o.err)
+				failed++
+				continue
+			}
+			files++
+			s := o.stats
 			total.Lines += s.Lines
 			total.Words += s.Words
 			total.Chars += s.Chars
+			total.EmptyLines += s.EmptyLines
+			if s.LongestLine > total.LongestLine {
+				total.LongestLine = s.LongestLine
+			}
 		}
+		budget.Report(errOut)
+		avg := total.AverageLineLength()
 
 		switch statsFormat {
 		case "text":
-			fmt.Printf("Files: %d\n", len(args))
-			fmt.Printf("Total lines: %d\n", total.Lines)
-			fmt.Printf("Total words: %d\n", total.Words)
-			fmt.Printf("Total chars: %d\n", total.Chars)
+			fmt.Fprintf(out, "Files: %d\n", files)
+			fmt.Fprintf(out, "Total lines: %d\n", total.Lines)
+			fmt.Fprintf(out, "Total words: %d\n", total.Words)
+			fmt.Fprintf(out, "Total chars: %d\n", total.Chars)
+			fmt.Fprintf(out, "Empty lines: %d\n", total.EmptyLines)
+			fmt.Fprintf(out, "Longest line: %d\n", total.LongestLine)
+			fmt.Fprintf(out, "Average line length: %.2f\n", avg)
 		case "json":
-			json.NewEncoder(os.Stdout).Encode(map[string]any{
-				"files": len(args),
-				"lines": total.Lines,
-				"words": total.Words,
-				"chars": total.Chars,
+			err := writeJSON(out, map[string]any{
+				"files":        files,
+				"lines":        total.Lines,
+				"words":        total.Words,
+				"chars":        total.Chars,
+				"empty_lines":  total.EmptyLines,
+				"longest_line": total.LongestLine,
+				"avg_line_len": avg,
 			})
+			if err != nil {
+				return err
+			}
 		case "csv":
-			fmt.Println("files,lines,words,chars")
-			fmt.Printf("%d,%d,%d,%d\n", len(args), total.Lines, total.Words, total.Chars)
+			delim, err := parseDelimiter(flagDelimiter)
+			if err != nil {
+				return err
+			}
+			cw := csv.NewWriter(out)
+			cw.Comma = delim
+			cw.Write([]string{"files", "lines", "words", "chars", "empty_lines", "longest_line", "avg_line_len"})
+			cw.Write([]string{
+				strconv.Itoa(files), strconv.Itoa(total.Lines), strconv.Itoa(total.Words), strconv.Itoa(total.Chars),
+				strconv.Itoa(total.EmptyLines), strconv.Itoa(total.LongestLine), strconv.FormatFloat(avg, 'f', 2, 64),
+			})
+			cw.Flush()
+			if err := cw.Error(); err != nil {
+				return err
+			}
 		}
-		return nil
+		return failedFiles(failed, len(paths))
 	},
 }
 
@@ -137,22 +311,175 @@ var (
 	flagPattern string
 	statsLines  int
 	statsFormat string
+	flagChars   string
+	statsChars  string
+	// maxLineBytes is the longest line scanLines accepts, shared by all commands.
+	maxLineBytes int
+	// maxBytes caps the bytes read across all files of a command (0 = no limit).
+	maxBytes int
+	// flagPretty makes every JSON output indented instead of one line per value.
+	flagPretty bool
+	// flagDelimiter separates CSV fields for every command; flagFields picks
+	// and orders the count columns.
+	flagDelimiter string
+	flagFields    string
+	// flagRank sorts search output by matches per file; flagSummaryOnly
+	// prints only the ranked counts.
+	flagRank        bool
+	flagSummaryOnly bool
+	// flagRegex treats --pattern as a regular expression; flagIgnoreCase
+	// matches without regard to case in both modes.
+	flagRegex      bool
+	flagIgnoreCase bool
+	// flagCount prints only the matches per file; flagLineNumber prefixes
+	// printed lines with their number.
+	flagCount      bool
+	flagLineNumber bool
+	// flagNoLineNumber is the grep-style spelling of --line-number=false.
+	flagNoLineNumber bool
+	// flagBefore and flagAfter are the context lines around each match;
+	// flagContext sets both unless they are given explicitly.
+	flagBefore  int
+	flagAfter   int
+	flagContext int
+	// flagJobs and statsJobs are how many files count and stats read at once.
+	flagJobs  int
+	statsJobs int
+	// flagGzip decompresses every input, not only the files ending in .gz.
+	flagGzip bool
+	// flagRecursive lets every command take directories and walk them.
+	flagRecursive bool
 )
 
-type Stats struct{ Lines, Words, Chars int }
+type searchResult struct {
+	File  string
+	Lines []searchLine
+}
+
+// Matches counts the matching lines, context excluded.
+func (r searchResult) Matches() int {
+	n := 0
+	for _, l := range r.Lines {
+		if l.Match {
+			n++
+		}
+	}
+	return n
+}
+
+// searchLine is a line search prints: a match or context around one.
+type searchLine struct {
+	Num   int
+	Text  string
+	Match bool
+}
+
+// searchPrinter writes lines the way grep does: "file:num:text" for matches,
+// "file-num-text" for context and, when separate is set, "--" between
+// groups of lines that are not adjacent. hideNumbers drops the "num" part.
+type searchPrinter struct {
+	w           io.Writer
+	separate    bool
+	hideNumbers bool
+	printed     bool
+}
+
+func (p *searchPrinter) Print(file string, lines []searchLine) {
+	prev := -1
+	for _, l := range lines {
+		if p.separate && p.printed && l.Num != prev+1 {
+			fmt.Fprintln(p.w, "--")
+		}
+		sep := "-"
+		if l.Match {
+			sep = ":"
+		}
+		if p.hideNumbers {
+			fmt.Fprintf(p.w, "%s%s%s\n", file, sep, l.Text)
+		} else {
+			fmt.Fprintf(p.w, "%s%s%d%s%s\n", file, sep, l.Num, sep, l.Text)
+		}
+		prev = l.Num
+		p.printed = true
+	}
+}
+
+// rankResults drops files without matches and sorts the rest by match count,
+// highest first; ties keep the command-line order.
+func rankResults(results []searchResult) []searchResult {
+	ranked := make([]searchResult, 0, len(results))
+	for _, r := range results {
+		if r.Matches() > 0 {
+			ranked = append(ranked, r)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Matches() > ranked[j].Matches()
+	})
+	return ranked
+}
+
+type FileStats struct {
+	File  string
+	Stats Stats
+}
+
+// countColumns maps each selectable count CSV column to its value.
+var countColumns = map[string]func(FileStats) string{
+	"file":  func(r FileStats) string { return r.File },
+	"lines": func(r FileStats) string { return strconv.Itoa(r.Stats.Lines) },
+	"words": func(r FileStats) string { return strconv.Itoa(r.Stats.Words) },
+	"chars": func(r FileStats) string { return strconv.Itoa(r.Stats.Chars) },
+}
+
+type Stats struct {
+	Lines, Words, Chars int
+	// EmptyLines are also included in Lines. LongestLine uses the same
+	// unit as Chars (bytes or runes).
+	EmptyLines, LongestLine int
+}
+
+// AverageLineLength returns Chars/Lines, or 0 when there are no lines.
+func (s Stats) AverageLineLength() float64 {
+	if s.Lines == 0 {
+		return 0
+	}
+	return float64(s.Chars) / float64(s.Lines)
+}
 
 func init() {
+	rootCmd.PersistentFlags().IntVar(&maxLineBytes, "max-line-bytes", bufio.MaxScanTokenSize, "maximum length of a single line in bytes")
+	rootCmd.PersistentFlags().BoolVar(&flagPretty, "pretty", false, "indent JSON output for humans (default is compact, one line)")
+	rootCmd.PersistentFlags().StringVar(&flagDelimiter, "delimiter", ",", `CSV field separator, a single character or "tab"`)
+	rootCmd.PersistentFlags().BoolVarP(&flagRecursive, "recursive", "r", false, "walk directory arguments and process every regular file in them")
+	rootCmd.PersistentFlags().BoolVar(&flagGzip, "gzip", false, "treat every input as gzip-compressed (.gz files always are)")
+	rootCmd.PersistentFlags().IntVar(&maxBytes, "max-bytes", 0, "stop after reading this many bytes in total across all files (0 = no limit)")
 	rootCmd.AddCommand(countCmd)
 	countCmd.Flags().IntVar(&flagLines, "lines", 0, "number of lines to process")
 	countCmd.Flags().StringVar(&flagFormat, "format", "text", "output format")
-	countCmd.Flags().BoolVar(&flagVerbose, "verbose", false, "verbose output")
-	countCmd.Flags().BoolVar(&flagQuiet, "quiet", false, "quiet output")
+	countCmd.Flags().BoolVar(&flagVerbose, "verbose", false, "print per-file size and timing to stderr")
+	countCmd.Flags().BoolVar(&flagQuiet, "quiet", false, "suppress the per-file text lines (json/csv output is kept)")
+	countCmd.Flags().StringVar(&flagFields, "fields", "file,lines,words,chars", "comma-separated CSV columns, in output order")
+	countCmd.Flags().IntVar(&flagJobs, "jobs", 1, "number of files processed in parallel")
+	countCmd.Flags().StringVar(&flagChars, "chars", "runes", "how chars are counted: runes (Unicode code points) or bytes (UTF-8 length, the old default)")
 	searchCmd.Flags().StringVar(&flagPattern, "pattern", "", "pattern to search")
 	searchCmd.MarkFlagRequired("pattern")
+	searchCmd.Flags().BoolVar(&flagRegex, "regex", false, "treat the pattern as a Go regular expression (default is a plain substring)")
+	searchCmd.Flags().BoolVar(&flagCount, "count", false, `print only "file:N", the number of matching lines per file`)
+	searchCmd.Flags().BoolVarP(&flagLineNumber, "line-number", "n", true, "prefix each printed line with its line number (--line-number=false for bare lines)")
+	searchCmd.Flags().BoolVar(&flagNoLineNumber, "no-line-number", false, "print bare lines without line numbers, same as --line-number=false")
+	searchCmd.Flags().IntVar(&flagBefore, "before", 0, "print N lines of context before each match")
+	searchCmd.Flags().IntVar(&flagAfter, "after", 0, "print N lines of context after each match")
+	searchCmd.Flags().IntVar(&flagContext, "context", 0, "print N lines of context around each match (--before/--after override it)")
+	searchCmd.Flags().BoolVar(&flagIgnoreCase, "ignore-case", false, "match the pattern case-insensitively")
+	searchCmd.Flags().BoolVar(&flagRank, "rank", false, "print a matches-per-file summary, most matches first, before the matching lines")
+	searchCmd.Flags().BoolVar(&flagSummaryOnly, "summary-only", false, "like --rank but print only the per-file counts")
 	rootCmd.AddCommand(searchCmd)
 	rootCmd.AddCommand(statsCmd)
 	statsCmd.Flags().IntVar(&statsLines, "lines", 0, "number of lines to process")
 	statsCmd.Flags().StringVar(&statsFormat, "format", "text", "output format")
+	statsCmd.Flags().IntVar(&statsJobs, "jobs", 1, "number of files processed in parallel")
+	statsCmd.Flags().StringVar(&statsChars, "chars", "runes", "how chars are counted: runes (Unicode code points) or bytes (UTF-8 length, the old default)")
 
 }
 
@@ -162,53 +489,445 @@ func main() {
 	}
 }
 
-func countFile(path string, maxLines int) (Stats, error) {
-	f, err := os.Open(path)
+// stdinName is the file name that stands for standard input, used when a
+// command gets no files at all.
+const stdinName = "-"
+
+// stdin is where "-" reads from; tests replace it.
+var stdin io.Reader = os.Stdin
+
+// openInput opens path, or standard input when path is "-". Files ending in
+// .gz, and every input with --gzip, are decompressed while they are read.
+func openInput(path string) (io.ReadCloser, error) {
+	var f io.ReadCloser = io.NopCloser(stdin)
+	if path != stdinName {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		f = file
+	}
+	if !flagGzip && !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+	zr, err := gzip.NewReader(f)
 	if err != nil {
-		return Stats{}, err
+		f.Close()
+		return nil, fmt.Errorf("gzip: %w", err)
 	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	stats := Stats{}
-	for scanner.Scan() {
-		line := scanner.Text()
-		stats.Lines++
-		stats.Words += len(strings.Fields(line))
-		stats.Chars += len(line)
-		if maxLines > 0 && stats.Lines >= maxLines {
-			break
+	return gzipFile{zr, f}, nil
+}
+
+// gzipFile streams the decompressed content of a file; Close closes both the
+// gzip reader and the file underneath.
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (g gzipFile) Close() error {
+	g.Reader.Close()
+	return g.file.Close()
+}
+
+// expandPaths returns the files a command should process. Without recursive
+// args are returned unchanged. With it every directory argument is replaced by
+// the regular files below it, in lexical order; symlinked directories are not
+// followed, so links cannot create cycles. Entries the walk cannot read are
+// reported on warn and skipped.
+func expandPaths(args []string, recursive bool, warn io.Writer) ([]string, error) {
+	if !recursive {
+		return args, nil
+	}
+	var paths []string
+	for _, arg := range args {
+		if arg == stdinName {
+			paths = append(paths, arg)
+			continue
+		}
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			paths = append(paths, arg)
+			continue
+		}
+		err = filepath.WalkDir(arg, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(warn, "warning: skipping %v\n", err)
+				return nil
+			}
+			mode := d.Type()
+			if mode&fs.ModeSymlink != 0 {
+				// links to files are processed, links to directories are not
+				fi, err := os.Stat(path)
+				if err != nil {
+					fmt.Fprintf(warn, "warning: skipping %v\n", err)
+					return nil
+				}
+				mode = fi.Mode()
+			}
+			if mode.IsRegular() {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
 		}
 	}
-	if err := scanner.Err(); err != nil {
-		return Stats{}, err
+	return paths, nil
+}
+
+// skipUnreadable reports whether err is a file that --recursive cannot open,
+// printing a warning on w: one bad file in a tree does not abort the command.
+func skipUnreadable(w io.Writer, err error) bool {
+	var pathErr *fs.PathError
+	if !flagRecursive || !errors.As(err, &pathErr) || pathErr.Op != "open" {
+		return false
 	}
+	fmt.Fprintf(w, "warning: skipping %v\n", err)
+	return true
+}
 
-	return stats, nil
+// writeJSON is the single place JSON is emitted, so --pretty applies to every command.
+func writeJSON(w io.Writer, v any) error {
+	enc := json.NewEncoder(w)
+	if flagPretty {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(v)
+}
 
+// parseFields validates a --fields list against countColumns.
+func parseFields(spec string) ([]string, error) {
+	var fields []string
+	for _, f := range strings.Split(spec, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if _, ok := countColumns[f]; !ok {
+			return nil, fmt.Errorf("invalid field: %q (want file, lines, words or chars)", f)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
 }
 
-func searchFile(path, pattern string, maxLines int) ([]string, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// parseDelimiter accepts a single character, or "tab" / `\t` for TSV.
+func parseDelimiter(s string) (rune, error) {
+	if s == "tab" || s == `\t` {
+		return '\t', nil
 	}
-	defer f.Close()
+	if utf8.RuneCountInString(s) != 1 {
+		return 0, fmt.Errorf("invalid delimiter: %q (want a single character)", s)
+	}
+	r, _ := utf8.DecodeRuneInString(s)
+	if r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		return 0, fmt.Errorf("invalid delimiter: %q", s)
+	}
+	return r, nil
+}
 
-	scanner := bufio.NewScanner(f)
-	matches := []string{}
+// writeCountCSV writes a header with the selected fields and one row per file.
+// encoding/csv quotes file names containing the delimiter or quotes.
+func writeCountCSV(w io.Writer, results []FileStats, fields []string, delim rune) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = delim
+	if err := cw.Write(fields); err != nil {
+		return err
+	}
+	for _, r := range results {
+		row := make([]string, len(fields))
+		for i, f := range fields {
+			row[i] = countColumns[f](r)
+		}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// parseCharsMode reports whether chars should be counted as runes.
+// "bytes" counts the UTF-8 encoded length, so "è" is 2 chars; "runes" counts it as 1.
+func parseCharsMode(mode string) (bool, error) {
+	switch strings.ToLower(mode) {
+	case "bytes":
+		return false, nil
+	case "runes":
+		return true, nil
+	default:
+		return false, fmt.Errorf("invalid chars mode: %s (want bytes or runes)", mode)
+	}
+}
+
+// scanLines calls fn for each line of r with its 1-based line number,
+// stopping after maxLines lines when maxLines > 0. An error from fn stops the
+// scan and is returned as is. Lines longer than maxLineBytes fail with an
+// error naming the line and the flag to raise.
+func scanLines(r io.Reader, maxLines int, fn func(lineNum int, line string) error) error {
+	scanner := bufio.NewScanner(r)
+	limit := maxLineBytes
+	if limit <= 0 {
+		limit = bufio.MaxScanTokenSize
+	}
+	scanner.Buffer(make([]byte, 0, min(limit, bufio.MaxScanTokenSize)), limit)
 	lineNum := 0
 	for scanner.Scan() {
 		lineNum++
-		line := scanner.Text()
-		if strings.Contains(line, pattern) {
-			matches = append(matches, fmt.Sprintf("%d:%s", lineNum, line))
+		if err := fn(lineNum, scanner.Text()); err != nil {
+			return err
 		}
 		if maxLines > 0 && lineNum >= maxLines {
 			break
 		}
 	}
 	if err := scanner.Err(); err != nil {
+		if errors.Is(err, bufio.ErrTooLong) {
+			return fmt.Errorf("line %d is longer than %d bytes (use --max-line-bytes to raise the limit)", lineNum+1, limit)
+		}
+		return err
+	}
+	return nil
+}
+
+// errBudgetExhausted stops scanLines once the byte budget is used up; it never
+// leaves countFile or searchFile.
+var errBudgetExhausted = errors.New("byte budget exhausted")
+
+// byteBudget is a byte allowance shared by all files of a command. A nil
+// budget is unlimited.
+type byteBudget struct {
+	max, used int
+	exhausted bool
+}
+
+func newByteBudget(max int) *byteBudget {
+	if max <= 0 {
+		return nil
+	}
+	return &byteBudget{max: max}
+}
+
+// take charges n bytes to the budget. It returns false, charging nothing,
+// when n does not fit, so a line is either processed whole or not at all.
+func (b *byteBudget) take(n int) bool {
+	if b == nil {
+		return true
+	}
+	if b.exhausted || b.used+n > b.max {
+		b.exhausted = true
+		return false
+	}
+	b.used += n
+	if b.used == b.max {
+		b.exhausted = true
+	}
+	return true
+}
+
+func (b *byteBudget) Exhausted() bool {
+	return b != nil && b.exhausted
+}
+
+// Report notes on w that the output is partial because the budget ran out.
+func (b *byteBudget) Report(w io.Writer) {
+	if b.Exhausted() {
+		fmt.Fprintf(w, "byte budget of %d reached after %d bytes, remaining input skipped\n", b.max, b.used)
+	}
+}
+
+// lineBytes is what a scanned line costs against the budget, newline included.
+func lineBytes(line string) int {
+	return len(line) + 1
+}
+
+// countOutcome is the result of counting one of the paths given to countPaths.
+type countOutcome struct {
+	stats   Stats
+	bytes   int64
+	elapsed time.Duration
+	err     error
+	// done is false for the files left unread once the byte budget ran out.
+	done bool
+}
+
+// checkJobs validates --jobs. The byte budget is consumed in file order, which
+// only holds when files are read one at a time.
+func checkJobs(jobs int) error {
+	if jobs < 1 {
+		return fmt.Errorf("invalid jobs: %d (want at least 1)", jobs)
+	}
+	if jobs > 1 && maxBytes > 0 {
+		return fmt.Errorf("cannot use --max-bytes with --jobs greater than 1")
+	}
+	return nil
+}
+
+// countPaths counts every path, at most jobs at a time, and returns the
+// outcomes in the order of paths whatever order the files finished in. A
+// failing file only sets its own err. With jobs == 1 files are read in order
+// and the ones after the budget runs out are not opened at all.
+func countPaths(paths []string, jobs, maxLines int, runes bool, budget *byteBudget) []countOutcome {
+	outcomes := make([]countOutcome, len(paths))
+	count := func(i int) {
+		start := time.Now()
+		stats, n, err := countFileBytes(paths[i], maxLines, runes, budget)
+		outcomes[i] = countOutcome{stats: stats, bytes: n, elapsed: time.Since(start), err: err, done: true}
+	}
+	if jobs <= 1 {
+		for i := range paths {
+			count(i)
+			if budget.Exhausted() {
+				break
+			}
+		}
+		return outcomes
+	}
+
+	sem := semaphore.New(jobs)
+	var wg sync.WaitGroup
+	for i := range paths {
+		sem.Acquire(context.Background())
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sem.Release()
+			count(i)
+		}()
+	}
+	wg.Wait()
+	return outcomes
+}
+
+// failedFiles is the command error when some files could not be processed;
+// each failure has already been reported on stderr.
+func failedFiles(failed, total int) error {
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d files failed", failed, total)
+}
+
+func countFile(path string, maxLines int, runes bool, budget *byteBudget) (Stats, error) {
+	stats, _, err := countFileBytes(path, maxLines, runes, budget)
+	return stats, err
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countFileBytes is countFile that also returns how many bytes were read
+// from the input: decompressed for gzip, and known for stdin too, unlike
+// the size on disk. The reader is buffered, so when the byte budget cuts the
+// file short this includes the read-ahead.
+func countFileBytes(path string, maxLines int, runes bool, budget *byteBudget) (Stats, int64, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return Stats{}, 0, err
+	}
+	defer f.Close()
+	in := &countingReader{r: f}
+	stats := Stats{}
+	err = scanLines(in, maxLines, func(_ int, line string) error {
+		if !budget.take(lineBytes(line)) {
+			return errBudgetExhausted
+		}
+		stats.Lines++
+		stats.Words += len(strings.Fields(line))
+		n := len(line)
+		if runes {
+			n = utf8.RuneCountInString(line)
+		}
+		stats.Chars += n
+		if n == 0 {
+			stats.EmptyLines++
+		}
+		if n > stats.LongestLine {
+			stats.LongestLine = n
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBudgetExhausted) {
+		return Stats{}, in.n, err
+	}
+	return stats, in.n, nil
+}
+
+// matcher reports whether a line matches the search pattern.
+type matcher func(line string) bool
+
+// newMatcher builds the matcher for --pattern. The default is a plain
+// substring test; with regex the pattern is compiled with regexp, and
+// ignoreCase adds (?i) in both modes (a literal is quoted first).
+func newMatcher(pattern string, regex, ignoreCase bool) (matcher, error) {
+	if !regex && !ignoreCase {
+		return func(line string) bool { return strings.Contains(line, pattern) }, nil
+	}
+	expr := pattern
+	if !regex {
+		expr = regexp.QuoteMeta(pattern)
+	}
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return re.MatchString, nil
+}
+
+// searchFile returns the matching lines of path together with up to before
+// lines preceding and after lines following each match. Windows of nearby
+// matches are merged, so every line appears at most once and in order.
+func searchFile(path string, match matcher, maxLines, before, after int, budget *byteBudget) ([]searchLine, error) {
+	f, err := openInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []searchLine{}
+	// recent holds the last lines not yet printed, candidates for the
+	// before-context of the next match
+	recent := make([]searchLine, 0, before)
+	afterLeft := 0
+	err = scanLines(f, maxLines, func(lineNum int, line string) error {
+		if !budget.take(lineBytes(line)) {
+			return errBudgetExhausted
+		}
+		l := searchLine{Num: lineNum, Text: line, Match: match(line)}
+		switch {
+		case l.Match:
+			lines = append(lines, recent...)
+			lines = append(lines, l)
+			recent = recent[:0]
+			afterLeft = after
+		case afterLeft > 0:
+			lines = append(lines, l)
+			afterLeft--
+		case before > 0:
+			if len(recent) == before {
+				copy(recent, recent[1:])
+				recent = recent[:before-1]
+			}
+			recent = append(recent, l)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errBudgetExhausted) {
 		return nil, err
 	}
-	return matches, nil
+	return lines, nil
 }
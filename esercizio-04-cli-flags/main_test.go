@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestCountFileCharsMode(t *testing.T) {
+	// "perché così" is 11 runes but 13 bytes: é and ì take 2 bytes each.
+	path := writeTemp(t, "utf8.txt", "perché così\n")
+
+	bytesStats, err := countFile(path, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runesStats, err := countFile(path, 0, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesStats.Chars != 13 {
+		t.Errorf("bytes mode: chars = %d, want 13", bytesStats.Chars)
+	}
+	if runesStats.Chars != 11 {
+		t.Errorf("runes mode: chars = %d, want 11", runesStats.Chars)
+	}
+}
+
+func TestCountDefaultsToRunes(t *testing.T) {
+	// five accented letters: 5 runes, 10 bytes
+	path := writeTemp(t, "accents.txt", "àèìòù\n")
+
+	stdout, _ := runCount(t, path)
+	if !strings.Contains(stdout, "chars=5\n") {
+		t.Errorf("default: stdout = %q, want chars=5", stdout)
+	}
+	stdout, _ = runCount(t, "--chars", "bytes", path)
+	if !strings.Contains(stdout, "chars=10\n") {
+		t.Errorf("--chars bytes: stdout = %q, want chars=10", stdout)
+	}
+}
+
+func TestParseCharsMode(t *testing.T) {
+	if _, err := parseCharsMode("glyphs"); err == nil {
+		t.Fatal("expected error for unknown mode")
+	}
+}
+
+func TestCountFileLineStats(t *testing.T) {
+	path := writeTemp(t, "lines.txt", "abc\n\nabcdefgh\n\nab\n")
+
+	s, err := countFile(path, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Lines != 5 {
+		t.Errorf("lines = %d, want 5", s.Lines)
+	}
+	if s.EmptyLines != 2 {
+		t.Errorf("empty lines = %d, want 2", s.EmptyLines)
+	}
+	if s.LongestLine != 8 {
+		t.Errorf("longest line = %d, want 8", s.LongestLine)
+	}
+	if avg := s.AverageLineLength(); avg != 13.0/5 {
+		t.Errorf("average = %v, want %v", avg, 13.0/5)
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	input := "a\nb\nc\nd\n"
+	tests := []struct {
+		maxLines int
+		want     []string
+	}{
+		{0, []string{"1:a", "2:b", "3:c", "4:d"}},
+		{2, []string{"1:a", "2:b"}},
+		{10, []string{"1:a", "2:b", "3:c", "4:d"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		err := scanLines(strings.NewReader(input), tt.maxLines, func(n int, line string) error {
+			got = append(got, fmt.Sprintf("%d:%s", n, line))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("maxLines=%d: got %v, want %v", tt.maxLines, got, tt.want)
+		}
+	}
+}
+
+func TestScanLinesCallbackError(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := scanLines(strings.NewReader("a\nb\nc\n"), 0, func(n int, line string) error {
+		calls++
+		if n == 2 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) || calls != 2 {
+		t.Fatalf("err=%v calls=%d, want stop after 2 lines", err, calls)
+	}
+}
+
+func TestCountFileLongLine(t *testing.T) {
+	path := writeTemp(t, "long.txt", "short\n"+strings.Repeat("x", 70*1024)+"\n")
+
+	_, err := countFile(path, 0, false, nil)
+	if err == nil || !strings.Contains(err.Error(), "line 2") || !strings.Contains(err.Error(), "--max-line-bytes") {
+		t.Fatalf("default limit: err = %v, want a clear line-too-long error", err)
+	}
+
+	old := maxLineBytes
+	maxLineBytes = 128 * 1024
+	defer func() { maxLineBytes = old }()
+	s, err := countFile(path, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.LongestLine != 70*1024 {
+		t.Fatalf("longest line = %d, want %d", s.LongestLine, 70*1024)
+	}
+}
+
+func TestByteBudgetAcrossFiles(t *testing.T) {
+	// each line costs 6 bytes ("lineN" + newline)
+	paths := []string{
+		writeTemp(t, "a.txt", "line1\nline2\n"),
+		writeTemp(t, "b.txt", "line3\nline4\n"),
+		writeTemp(t, "c.txt", "line5\nline6\n"),
+	}
+	budget := newByteBudget(20) // three whole lines, the fourth does not fit
+
+	var lines []int
+	for _, p := range paths {
+		s, err := countFile(p, 0, false, budget)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, s.Lines)
+		if budget.Exhausted() {
+			break
+		}
+	}
+	if !reflect.DeepEqual(lines, []int{2, 1}) {
+		t.Fatalf("lines per file = %v, want [2 1]", lines)
+	}
+	if budget.used != 18 {
+		t.Errorf("used = %d, want 18", budget.used)
+	}
+
+	var note strings.Builder
+	budget.Report(&note)
+	if !strings.Contains(note.String(), "byte budget of 20 reached") {
+		t.Errorf("report = %q", note.String())
+	}
+
+	matches, err := searchFile(paths[0], literal(t, "line"), 0, 0, 0, newByteBudget(6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 {
+		t.Errorf("search with 6-byte budget: %v, want 1 match", matches)
+	}
+}
+
+func TestStatsFilesExcludesUnread(t *testing.T) {
+	paths := []string{
+		writeTemp(t, "a.txt", "line1\nline2\n"),
+		writeTemp(t, "b.txt", "line3\nline4\n"),
+		writeTemp(t, "c.txt", "line5\nline6\n"),
+	}
+	defer func() {
+		maxBytes = 0
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+	}()
+	var out, errOut strings.Builder
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&errOut)
+	// the budget runs out inside b.txt: c.txt is never opened
+	rootCmd.SetArgs(append([]string{"stats", "--max-bytes", "20"}, paths...))
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Files: 2\n") || !strings.Contains(out.String(), "Total lines: 3\n") {
+		t.Errorf("stats output = %q, want 2 files and 3 lines", out.String())
+	}
+}
+
+func TestWriteJSONPretty(t *testing.T) {
+	v := map[string]int{"lines": 2, "words": 5}
+	defer func(old bool) { flagPretty = old }(flagPretty)
+
+	var compact, pretty strings.Builder
+	flagPretty = false
+	if err := writeJSON(&compact, v); err != nil {
+		t.Fatal(err)
+	}
+	flagPretty = true
+	if err := writeJSON(&pretty, v); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := compact.String(), "{\"lines\":2,\"words\":5}\n"; got != want {
+		t.Errorf("compact = %q, want %q", got, want)
+	}
+	if got, want := pretty.String(), "{\n  \"lines\": 2,\n  \"words\": 5\n}\n"; got != want {
+		t.Errorf("pretty = %q, want %q", got, want)
+	}
+}
+
+func TestWriteCountCSVQuotesFileName(t *testing.T) {
+	results := []FileStats{{File: "a,b.txt", Stats: Stats{Lines: 1, Words: 2, Chars: 3}}}
+	var out strings.Builder
+	if err := writeCountCSV(&out, results, []string{"file", "lines", "words", "chars"}, ','); err != nil {
+		t.Fatal(err)
+	}
+	want := "file,lines,words,chars\n\"a,b.txt\",1,2,3\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
+
+func TestWriteCountCSVFieldOrder(t *testing.T) {
+	fields, err := parseFields("words,file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	delim, err := parseDelimiter("tab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []FileStats{{File: "x.txt", Stats: Stats{Lines: 1, Words: 7, Chars: 30}}}
+	var out strings.Builder
+	if err := writeCountCSV(&out, results, fields, delim); err != nil {
+		t.Fatal(err)
+	}
+	want := "words\tfile\n7\tx.txt\n"
+	if out.String() != want {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+
+	if _, err := parseFields("words,size"); err == nil {
+		t.Error("expected error for unknown field")
+	}
+}
+
+func TestRankResults(t *testing.T) {
+	paths := []string{
+		writeTemp(t, "one.txt", "go\nrust\n"),
+		writeTemp(t, "none.txt", "python\n"),
+		writeTemp(t, "three.txt", "go\ngo run\ngopher\n"),
+		writeTemp(t, "also-one.txt", "let's go\n"),
+	}
+	var results []searchResult
+	for _, p := range paths {
+		lines, err := searchFile(p, literal(t, "go"), 0, 1, 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, searchResult{File: filepath.Base(p), Lines: lines})
+	}
+
+	var got []string
+	for _, r := range rankResults(results) {
+		got = append(got, fmt.Sprintf("%s=%d", r.File, r.Matches()))
+	}
+	want := []string{"three.txt=3", "one.txt=1", "also-one.txt=1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ranking = %v, want %v", got, want)
+	}
+}
+
+// runCount executes the count command with args, resetting its flags afterwards.
+func runCount(t *testing.T, args ...string) (stdout, stderr string) {
+	t.Helper()
+	defer func() {
+		flagVerbose, flagQuiet, flagFormat, flagRecursive, flagChars, flagJobs = false, false, "text", false, "runes", 1
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+	}()
+	var out, errOut strings.Builder
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&errOut)
+	rootCmd.SetArgs(append([]string{"count"}, args...))
+	if err := rootCmd.Execute(); err != nil {
+		t.Fatalf("count %v: %v", args, err)
+	}
+	return out.String(), errOut.String()
+}
+
+func TestCountVerboseAndQuiet(t *testing.T) {
+	path := writeTemp(t, "v.txt", "one two\nthree\n")
+
+	stdout, stderr := runCount(t, path)
+	if !strings.Contains(stdout, "lines=2 words=3") || stderr != "" {
+		t.Fatalf("default: stdout=%q stderr=%q", stdout, stderr)
+	}
+
+	stdout, stderr = runCount(t, "--verbose", path)
+	if !strings.Contains(stdout, "lines=2") {
+		t.Errorf("verbose: stdout = %q", stdout)
+	}
+	if !strings.Contains(stderr, path+": 14 bytes in ") {
+		t.Errorf("verbose: stderr = %q, want size and timing", stderr)
+	}
+
+	stdout, _ = runCount(t, "--quiet", path)
+	if stdout != "" {
+		t.Errorf("quiet: stdout = %q, want nothing", stdout)
+	}
+
+	stdout, _ = runCount(t, "--quiet", "--format", "json", path)
+	if !strings.Contains(stdout, `"Lines":2`) {
+		t.Errorf("quiet json: stdout = %q, want the data", stdout)
+	}
+}
+
+func TestExpandPathsRecursive(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{
+		"a.txt":         "one\n",
+		"sub/b.txt":     "two words\n",
+		"sub/deep/c.md": "three\n",
+	} {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a link back to root would loop forever if directories were followed
+	if err := os.Symlink(root, filepath.Join(root, "sub", "loop")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "a.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	var warn strings.Builder
+	got, err := expandPaths([]string{root}, true, &warn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(root, "a.txt"),
+		filepath.Join(root, "link.txt"),
+		filepath.Join(root, "sub", "b.txt"),
+		filepath.Join(root, "sub", "deep", "c.md"),
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paths = %v, want %v", got, want)
+	}
+	if !strings.Contains(warn.String(), "dangling") {
+		t.Errorf("warnings = %q, want the dangling link", warn.String())
+	}
+
+	if got, _ := expandPaths([]string{root}, false, &warn); !reflect.DeepEqual(got, []string{root}) {
+		t.Errorf("without recursive paths = %v", got)
+	}
+
+	stdout, _ := runCount(t, "-r", "--format", "json", root)
+	var results []FileStats
+	if err := json.Unmarshal([]byte(stdout), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 4 || results[2].Stats.Words != 2 {
+		t.Errorf("count -r = %+v", results)
+	}
+}
+
+func TestRecursiveSkipsUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any file")
+	}
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "ok.txt"), []byte("fine\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), []byte("hidden\n"), 0o000); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, stderr := runCount(t, "-r", root)
+	if !strings.Contains(stdout, "ok.txt: lines=1") || strings.Contains(stdout, "secret.txt") {
+		t.Errorf("stdout = %q", stdout)
+	}
+	if !strings.Contains(stderr, "warning: skipping") || !strings.Contains(stderr, "secret.txt") {
+		t.Errorf("stderr = %q, want a warning for secret.txt", stderr)
+	}
+}
+
+// literal returns the default substring matcher for pattern.
+func literal(t *testing.T, pattern string) matcher {
+	t.Helper()
+	m, err := newMatcher(pattern, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestNewMatcher(t *testing.T) {
+	tests := []struct {
+		pattern           string
+		regex, ignoreCase bool
+		line              string
+		want              bool
+	}{
+		{"a.c", false, false, "a.c", true},
+		{"a.c", false, false, "abc", false},
+		{"a.c", true, false, "abc", true},
+		{"ERROR", false, false, "error: disk full", false},
+		{"ERROR", false, true, "error: disk full", true},
+		{"(", false, true, "f(x)", true},
+		{`^err\w+:`, true, true, "Error: disk full", true},
+		{`^err\w+:`, true, false, "Error: disk full", false},
+	}
+	for _, tt := range tests {
+		m, err := newMatcher(tt.pattern, tt.regex, tt.ignoreCase)
+		if err != nil {
+			t.Fatalf("newMatcher(%q, %v, %v): %v", tt.pattern, tt.regex, tt.ignoreCase, err)
+		}
+		if got := m(tt.line); got != tt.want {
+			t.Errorf("newMatcher(%q, regex=%v, ignoreCase=%v)(%q) = %v, want %v", tt.pattern, tt.regex, tt.ignoreCase, tt.line, got, tt.want)
+		}
+	}
+
+	if _, err := newMatcher("a(b", true, false); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("invalid regex: err = %v", err)
+	}
+}
+
+func TestSearchContext(t *testing.T) {
+	// matches on lines 2, 4 and 9: the first two windows overlap
+	path := writeTemp(t, "ctx.txt", "a\nhit\nb\nhit\nc\nd\ne\nf\nhit\ng\n")
+
+	lines, err := searchFile(path, literal(t, "hit"), 0, 1, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	p := &searchPrinter{w: &out, separate: true}
+	p.Print("f", lines)
+	want := "f-1-a\nf:2:hit\nf-3-b\nf:4:hit\nf-5-c\n--\nf-8-f\nf:9:hit\nf-10-g\n"
+	if out.String() != want {
+		t.Errorf("output:\n%s\nwant:\n%s", out.String(), want)
+	}
+
+	lines, err = searchFile(path, literal(t, "hit"), 0, 0, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var nums []int
+	for _, l := range lines {
+		nums = append(nums, l.Num)
+	}
+	if !reflect.DeepEqual(nums, []int{2, 3, 4, 5, 6, 9, 10}) {
+		t.Errorf("--after 2 lines = %v", nums)
+	}
+
+	// without context the output is unchanged: matches only, no separators
+	lines, _ = searchFile(path, literal(t, "hit"), 0, 0, 0, nil)
+	out.Reset()
+	(&searchPrinter{w: &out}).Print("f", lines)
+	if out.String() != "f:2:hit\nf:4:hit\nf:9:hit\n" {
+		t.Errorf("no context: %q", out.String())
+	}
+}
+
+func TestCountReadsStdin(t *testing.T) {
+	defer func(old io.Reader) { stdin = old }(stdin)
+	stdin = strings.NewReader("one two\nthree\n")
+
+	stdout, _ := runCount(t)
+	if stdout != "-: lines=2 words=3 chars=12\n" {
+		t.Errorf("stdout = %q", stdout)
+	}
+
+	stdin = strings.NewReader("a b c\n")
+	stdout, _ = runCount(t, "--format", "json")
+	if !strings.Contains(stdout, `"File":"-"`) || !strings.Contains(stdout, `"Words":3`) {
+		t.Errorf("json stdout = %q", stdout)
+	}
+}
+
+func TestCountVerboseReportsBytesRead(t *testing.T) {
+	defer func(old io.Reader) { stdin = old }(stdin)
+	stdin = strings.NewReader("one two\nthree\n")
+	content := strings.Repeat("GET /books\n", 100)
+	gz := writeGzip(t, "log.txt.gz", content)
+
+	_, stderr := runCount(t, "--verbose", stdinName, gz)
+	if !strings.Contains(stderr, "-: 14 bytes in ") {
+		t.Errorf("stdin: stderr = %q, want 14 bytes", stderr)
+	}
+	// the decompressed size, not the size of the .gz on disk
+	if want := fmt.Sprintf("%s: %d bytes in ", gz, len(content)); !strings.Contains(stderr, want) {
+		t.Errorf("gzip: stderr = %q, want %q", stderr, want)
+	}
+}
+
+func TestCountParallelKeepsOrder(t *testing.T) {
+	dir := t.TempDir()
+	var args []string
+	var want strings.Builder
+	for i := 0; i < 20; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("f%02d.txt", i))
+		if err := os.WriteFile(path, []byte(strings.Repeat("w ", i)+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		args = append(args, path)
+		fmt.Fprintf(&want, "%s: lines=1 words=%d chars=%d\n", path, i, 2*i)
+	}
+	stdout, _ := runCount(t, append([]string{"--jobs", "8"}, args...)...)
+	if stdout != want.String() {
+		t.Errorf("parallel output:\n%s\nwant:\n%s", stdout, want.String())
+	}
+
+	// a missing file is reported but the others are still counted
+	missing := filepath.Join(dir, "missing.txt")
+	defer func() {
+		flagJobs = 1
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+	}()
+	var out, errOut strings.Builder
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&errOut)
+	rootCmd.SetArgs([]string{"count", "--jobs", "4", args[0], missing, args[1]})
+	err := rootCmd.Execute()
+	if err == nil || !strings.Contains(err.Error(), "1 of 3 files failed") {
+		t.Errorf("err = %v, want a failure count", err)
+	}
+	if !strings.Contains(out.String(), args[0]+": lines=1") || !strings.Contains(out.String(), args[1]+": lines=1") {
+		t.Errorf("stdout = %q, want both readable files", out.String())
+	}
+	if !strings.Contains(errOut.String(), missing+": open ") {
+		t.Errorf("stderr = %q, want the missing file", errOut.String())
+	}
+}
+
+func TestCheckJobs(t *testing.T) {
+	defer func(old int) { maxBytes = old }(maxBytes)
+	maxBytes = 0
+	if err := checkJobs(0); err == nil {
+		t.Error("jobs=0 accepted")
+	}
+	maxBytes = 100
+	if err := checkJobs(4); err == nil {
+		t.Error("--jobs 4 accepted with a byte budget")
+	}
+	if err := checkJobs(1); err != nil {
+		t.Errorf("--jobs 1 with a byte budget: %v", err)
+	}
+}
+
+// runSearch executes the search command with args, resetting its flags afterwards.
+func runSearch(t *testing.T, args ...string) (stdout, stderr string, err error) {
+	t.Helper()
+	defer func() {
+		flagCount, flagLineNumber, flagNoLineNumber, flagRegex, flagIgnoreCase = false, true, false, false, false
+		rootCmd.SetOut(nil)
+		rootCmd.SetErr(nil)
+	}()
+	var out, errOut strings.Builder
+	rootCmd.SetOut(&out)
+	rootCmd.SetErr(&errOut)
+	rootCmd.SetArgs(append([]string{"search"}, args...))
+	err = rootCmd.Execute()
+	return out.String(), errOut.String(), err
+}
+
+func TestSearchCountAndLineNumbers(t *testing.T) {
+	a := writeTemp(t, "a.txt", "Error one\nok\nerror two\n")
+	b := writeTemp(t, "b.txt", "fine\n")
+
+	stdout, _, err := runSearch(t, "--pattern", "error", "--ignore-case", "--count", a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := a + ":2\n" + b + ":0\n"; stdout != want {
+		t.Errorf("--count: %q, want %q", stdout, want)
+	}
+
+	stdout, _, err = runSearch(t, "--pattern", "^error", "--regex", "--line-number=false", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := a + ":error two\n"; stdout != want {
+		t.Errorf("--line-number=false: %q, want %q", stdout, want)
+	}
+	stdout, _, err = runSearch(t, "--pattern", "^error", "--regex", "--no-line-number", a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := a + ":error two\n"; stdout != want {
+		t.Errorf("--no-line-number: %q, want %q", stdout, want)
+	}
+
+	stdout, _, err = runSearch(t, "--pattern", "missing", a, b)
+	if !errors.Is(err, errNoMatches) || stdout != "" {
+		t.Errorf("no matches: stdout=%q err=%v, want errNoMatches", stdout, err)
+	}
+}
+
+func TestSearchWritesErrorsToCommandStderr(t *testing.T) {
+	a := writeTemp(t, "a.txt", "error\n")
+	missing := filepath.Join(t.TempDir(), "missing.txt")
+
+	stdout, stderr, err := runSearch(t, "--pattern", "error", a, missing)
+	if err == nil {
+		t.Error("missing file: err = nil")
+	}
+	if !strings.Contains(stdout, "error") {
+		t.Errorf("stdout = %q, want the match in a", stdout)
+	}
+	if !strings.Contains(stderr, missing+": open ") {
+		t.Errorf("stderr = %q, want the missing file", stderr)
+	}
+}
+
+func writeGzip(t *testing.T, name, content string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(content))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return writeTemp(t, name, buf.String())
+}
+
+func TestGzipInput(t *testing.T) {
+	path := writeGzip(t, "log.txt.gz", "GET /\nPOST /books\nGET /books\n")
+
+	s, err := countFile(path, 0, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Lines != 3 || s.Words != 6 {
+		t.Errorf("gz stats = %+v, want 3 lines and 6 words", s)
+	}
+	lines, err := searchFile(path, literal(t, "books"), 0, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0].Num != 2 {
+		t.Errorf("gz search = %+v", lines)
+	}
+
+	// --gzip also decompresses files without the extension
+	plain := writeGzip(t, "log.bin", "one\n")
+	defer func() { flagGzip = false }()
+	flagGzip = true
+	if s, err := countFile(plain, 0, false, nil); err != nil || s.Lines != 1 {
+		t.Errorf("--gzip: stats = %+v, err = %v", s, err)
+	}
+	flagGzip = false
+
+	// a corrupted archive is an error for that file, not a crash
+	gz, _ := os.ReadFile(path)
+	bad := writeTemp(t, "bad.gz", string(gz[:len(gz)/2]))
+	if _, err := countFile(bad, 0, false, nil); err == nil {
+		t.Error("truncated gzip: no error")
+	}
+	notGzip := writeTemp(t, "plain.gz", "not compressed\n")
+	if _, err := countFile(notGzip, 0, false, nil); err == nil || !strings.Contains(err.Error(), "gzip") {
+		t.Errorf("plain text named .gz: err = %v", err)
+	}
+}
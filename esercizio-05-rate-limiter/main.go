@@ -1,26 +1,63 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
 	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+var ErrLimiterClosed = errors.New("rate limiter closed")
+
+// ErrExceedsBurst is returned by WaitN for more tokens than the bucket holds,
+// a request that could never be granted.
+var ErrExceedsBurst = errors.New("rate limiter: n exceeds bucket size")
+
 type TokenBucketLimiter struct {
 	tokens     chan struct{}
-	ticker     *time.Ticker
+	clock      Clock
+	ticker     Ticker
 	maxTokens  int
 	refillRate time.Duration
+	closed     chan struct{}
+	closeOnce  sync.Once
+	// stop ends the refill goroutine: a stopped ticker never closes its C.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// multi is held by the one WaitN/AllowN collecting several tokens, so
+	// two of them never each hold part of the bucket waiting for the rest.
+	multi chan struct{}
+
+	granted, throttled atomic.Int64
 }
 
 func main() {
 	rate := flag.Int("rate", 5, "requests per second")
 	workers := flag.Int("workers", 10, "number of workers")
 	duration := flag.Duration("duration", 10*time.Second, "test duration")
+	serve := flag.String("serve", "", "serve a rate-limited HTTP endpoint on this address instead of running the test")
+	metrics := flag.Bool("metrics", false, "print granted vs throttled requests at the end of the test")
 	flag.Parse()
 
+	if *serve != "" {
+		if *rate <= 0 {
+			fmt.Println("invalid config")
+			return
+		}
+		if err := serveLimited(*serve, *rate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if *rate <= 0 || *workers <= 0 || *duration <= 0 {
 		fmt.Println("invalid config")
 		return
@@ -63,25 +100,97 @@ func main() {
 
 	fmt.Printf("Total requests: %d\n", total)
 	fmt.Printf("Actual rate: %.2f req/s\n", float64(total)/duration.Seconds())
+	if *metrics {
+		st := limiter.Stats()
+		fmt.Printf("Granted: %d\n", st.Granted)
+		fmt.Printf("Throttled: %d\n", st.Throttled)
+		fmt.Printf("Tokens available: %d\n", limiter.Available())
+	}
+
+}
+
+// Clock is the time source of a limiter, so tests can drive refills and
+// timeouts by hand instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker is the part of *time.Ticker a limiter uses.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// realClock is the default Clock, backed by package time.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) NewTicker(d time.Duration) Ticker       { return realTicker{time.NewTicker(d)} }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+type realTicker struct{ t *time.Ticker }
+
+func (r realTicker) C() <-chan time.Time { return r.t.C }
+func (r realTicker) Stop()               { r.t.Stop() }
+
+// Option configures a limiter at construction.
+type Option func(*limiterOptions)
 
+type limiterOptions struct {
+	clock Clock
 }
 
-func NewTokenBucketLimiter(maxTokens int, refillRate time.Duration) *TokenBucketLimiter {
+func applyOptions(opts []Option) limiterOptions {
+	o := limiterOptions{clock: realClock{}}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithClock makes the limiter take the time, refills and timeouts from c.
+func WithClock(c Clock) Option {
+	return func(o *limiterOptions) { o.clock = c }
+}
+
+// Limiter is what TokenBucketLimiter and SlidingWindowLimiter have in common,
+// so callers can swap one for the other.
+type Limiter interface {
+	Allow() bool
+	WaitCtx(ctx context.Context) error
+}
+
+var (
+	_ Limiter = (*TokenBucketLimiter)(nil)
+	_ Limiter = (*SlidingWindowLimiter)(nil)
+)
+
+func NewTokenBucketLimiter(maxTokens int, refillRate time.Duration, opts ...Option) *TokenBucketLimiter {
 	tokens := make(chan struct{}, maxTokens)
 	for i := 0; i < maxTokens; i++ {
 		tokens <- struct{}{}
 	}
 
-	ticker := time.NewTicker(refillRate)
 	rl := &TokenBucketLimiter{
 		tokens:     tokens,
-		ticker:     ticker,
+		clock:      applyOptions(opts).clock,
 		maxTokens:  maxTokens,
 		refillRate: refillRate,
+		closed:     make(chan struct{}),
+		multi:      make(chan struct{}, 1),
+		stop:       make(chan struct{}),
 	}
+	rl.ticker = rl.clock.NewTicker(refillRate)
 
 	go func() {
-		for range ticker.C {
+		for {
+			select {
+			case <-rl.ticker.C():
+			case <-rl.stop:
+				return
+			}
 			select {
 			case rl.tokens <- struct{}{}:
 			default:
@@ -92,19 +201,434 @@ func NewTokenBucketLimiter(maxTokens int, refillRate time.Duration) *TokenBucket
 	return rl
 }
 
+// LimiterStats counts requests since the limiter was created: Granted got
+// their tokens, Throttled were refused, timed out or cancelled. A WaitN or
+// AllowN is one request whatever its cost.
+type LimiterStats struct {
+	Granted   int64
+	Throttled int64
+}
+
+// Available returns how many tokens are in the bucket right now.
+func (rl *TokenBucketLimiter) Available() int {
+	return len(rl.tokens)
+}
+
+// Stats returns the request counters; it is safe to call concurrently with
+// the limiter in use.
+func (rl *TokenBucketLimiter) Stats() LimiterStats {
+	return LimiterStats{Granted: rl.granted.Load(), Throttled: rl.throttled.Load()}
+}
+
+// count records a request outcome and returns it unchanged.
+func (rl *TokenBucketLimiter) count(granted bool) bool {
+	if granted {
+		rl.granted.Add(1)
+	} else {
+		rl.throttled.Add(1)
+	}
+	return granted
+}
+
+// Wait is WaitCtx without cancellation. It cannot report errors, so on a
+// closed limiter it returns at once without taking a token.
 func (rl *TokenBucketLimiter) Wait() {
-	<-rl.tokens
+	rl.WaitCtx(context.Background())
 }
 
+// TryWait waits up to timeout for a token and reports whether it got one;
+// a closed limiter, or one closed while waiting, reports false.
 func (rl *TokenBucketLimiter) TryWait(timeout time.Duration) bool {
+	select {
+	case <-rl.closed:
+		return rl.count(false)
+	default:
+	}
+	select {
+	case <-rl.tokens:
+		return rl.count(true)
+	case <-rl.closed:
+		return rl.count(false)
+	case <-rl.clock.After(timeout):
+		return rl.count(false)
+	}
+}
+
+// Allow takes a token if one is available right now and reports whether it
+// did, never blocking; a closed limiter allows nothing.
+func (rl *TokenBucketLimiter) Allow() bool {
+	return rl.count(rl.take())
+}
+
+// take is Allow without touching the stats.
+func (rl *TokenBucketLimiter) take() bool {
+	select {
+	case <-rl.closed:
+		return false
+	default:
+	}
 	select {
 	case <-rl.tokens:
 		return true
-	case <-time.After(timeout):
+	default:
 		return false
 	}
 }
 
+// WaitN is WaitCtx for an operation costing n tokens: it returns once it
+// holds all n, or takes none. n larger than the bucket fails at once with
+// ErrExceedsBurst instead of blocking forever.
+func (rl *TokenBucketLimiter) WaitN(ctx context.Context, n int) error {
+	if n > rl.maxTokens {
+		rl.count(false)
+		return ErrExceedsBurst
+	}
+	select {
+	case rl.multi <- struct{}{}:
+	case <-rl.closed:
+		rl.count(false)
+		return ErrLimiterClosed
+	case <-ctx.Done():
+		rl.count(false)
+		return ctx.Err()
+	}
+	defer func() { <-rl.multi }()
+
+	for taken := 0; taken < n; taken++ {
+		if err := rl.wait(ctx); err != nil {
+			rl.putBack(taken)
+			rl.count(false)
+			return err
+		}
+	}
+	rl.count(true)
+	return nil
+}
+
+// AllowN is the non-blocking WaitN: it takes n tokens only if they are all
+// available right now.
+func (rl *TokenBucketLimiter) AllowN(n int) bool {
+	if n > rl.maxTokens {
+		return rl.count(false)
+	}
+	select {
+	case rl.multi <- struct{}{}:
+	default:
+		return rl.count(false)
+	}
+	defer func() { <-rl.multi }()
+
+	for taken := 0; taken < n; taken++ {
+		if !rl.take() {
+			rl.putBack(taken)
+			return rl.count(false)
+		}
+	}
+	return rl.count(true)
+}
+
+// putBack returns n tokens taken by a failed WaitN or AllowN; those that no
+// longer fit because the ticker refilled the bucket meanwhile are dropped.
+func (rl *TokenBucketLimiter) putBack(n int) {
+	for i := 0; i < n; i++ {
+		select {
+		case rl.tokens <- struct{}{}:
+		default:
+			return
+		}
+	}
+}
+
+// WaitCtx blocks until a token is available, ctx is done or the limiter is
+// closed, returning ctx.Err() or ErrLimiterClosed in the last two cases.
+func (rl *TokenBucketLimiter) WaitCtx(ctx context.Context) error {
+	err := rl.wait(ctx)
+	rl.count(err == nil)
+	return err
+}
+
+// wait is WaitCtx without touching the stats.
+func (rl *TokenBucketLimiter) wait(ctx context.Context) error {
+	// a closed limiter must not hand out the tokens still in the bucket
+	select {
+	case <-rl.closed:
+		return ErrLimiterClosed
+	default:
+	}
+	select {
+	case <-rl.tokens:
+		return nil
+	case <-rl.closed:
+		return ErrLimiterClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop ends the refill: the ticker and its goroutine. It is safe to call twice.
 func (rl *TokenBucketLimiter) Stop() {
-	rl.ticker.Stop()
+	rl.stopOnce.Do(func() {
+		rl.ticker.Stop()
+		close(rl.stop)
+	})
+}
+
+// Close stops granting tokens: pending and future WaitCtx calls return
+// ErrLimiterClosed. It also stops the refill ticker and is safe to call twice.
+func (rl *TokenBucketLimiter) Close() {
+	rl.closeOnce.Do(func() {
+		close(rl.closed)
+		rl.Stop()
+	})
+}
+
+// rateLimit admits requests only when the limiter grants a token. Requests
+// waiting when the limiter is closed, or whose client goes away, get 503.
+func rateLimit(rl *TokenBucketLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := rl.WaitCtx(r.Context()); err != nil {
+			msg := "rate limit wait aborted"
+			if errors.Is(err, ErrLimiterClosed) {
+				msg = "server shutting down"
+			}
+			http.Error(w, msg, http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// shutdownLimited closes the limiter first, so no request is admitted once
+// shutdown begins, then drains the in-flight ones with srv.Shutdown.
+func shutdownLimited(ctx context.Context, srv *http.Server, rl *TokenBucketLimiter) error {
+	rl.Close()
+	return srv.Shutdown(ctx)
+}
+
+func serveLimited(addr string, rate int) error {
+	limiter := NewTokenBucketLimiter(rate, time.Second/time.Duration(rate))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	srv := &http.Server{Addr: addr, Handler: rateLimit(limiter, mux)}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errCh <- err
+		}
+	}()
+	fmt.Printf("Serving on %s at %d req/s\n", addr, rate)
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	fmt.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return shutdownLimited(shutdownCtx, srv, limiter)
+}
+
+// SlidingWindowLimiter allows at most limit requests in any trailing window.
+// Unlike the token bucket it never lets more than limit through in one
+// window, not even right after a quiet period followed by refills. The
+// timestamps of the last limit requests are kept in a ring buffer.
+type SlidingWindowLimiter struct {
+	limit  int
+	window time.Duration
+	clock  Clock
+
+	mu sync.Mutex
+	// times[next] is the oldest of the last len(times) requests once the
+	// ring is full, and the next slot to overwrite.
+	times []time.Time
+	next  int
+}
+
+// NewSlidingWindowLimiter panics if limit is below 1 or window is not
+// positive: the ring buffer needs at least one slot.
+func NewSlidingWindowLimiter(limit int, window time.Duration, opts ...Option) *SlidingWindowLimiter {
+	if limit < 1 {
+		panic(fmt.Sprintf("NewSlidingWindowLimiter: limit must be at least 1, got %d", limit))
+	}
+	if window <= 0 {
+		panic(fmt.Sprintf("NewSlidingWindowLimiter: window must be positive, got %v", window))
+	}
+	return &SlidingWindowLimiter{
+		limit:  limit,
+		window: window,
+		clock:  applyOptions(opts).clock,
+		times:  make([]time.Time, 0, limit),
+	}
+}
+
+// reserve records a request at now if the window has room, otherwise it
+// returns how long until the oldest request leaves the window. Callers hold sw.mu.
+func (sw *SlidingWindowLimiter) reserve(now time.Time) (time.Duration, bool) {
+	if len(sw.times) < sw.limit {
+		sw.times = append(sw.times, now)
+		return 0, true
+	}
+	if wait := sw.times[sw.next].Add(sw.window).Sub(now); wait > 0 {
+		return wait, false
+	}
+	sw.times[sw.next] = now
+	sw.next = (sw.next + 1) % sw.limit
+	return 0, true
+}
+
+// Allow records the request and reports true if fewer than limit requests
+// happened in the trailing window.
+func (sw *SlidingWindowLimiter) Allow() bool {
+	sw.mu.Lock()
+	defer sw.mu.Unlock()
+	_, ok := sw.reserve(sw.clock.Now())
+	return ok
+}
+
+// WaitCtx blocks until the window has room or ctx is done.
+func (sw *SlidingWindowLimiter) WaitCtx(ctx context.Context) error {
+	for {
+		sw.mu.Lock()
+		wait, ok := sw.reserve(sw.clock.Now())
+		sw.mu.Unlock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-sw.clock.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// KeyedLimiter rate-limits each key (a client IP, an API key) with its own
+// TokenBucketLimiter, created on first use. Limiters idle for longer than
+// ttl are closed and dropped, taking their refill goroutines with them.
+type KeyedLimiter struct {
+	maxTokens  int
+	refillRate time.Duration
+	ttl        time.Duration
+	clock      Clock
+
+	mu      sync.Mutex
+	buckets map[string]*keyedBucket
+	stop    chan struct{}
+	once    sync.Once
+}
+
+type keyedBucket struct {
+	rl       *TokenBucketLimiter
+	lastUsed time.Time
+	// waiting counts WaitCtx calls in progress, which keep the bucket alive.
+	waiting int
+}
+
+// NewKeyedLimiter hands every key a bucket of maxTokens refilled every
+// refillRate, and checks for idle keys every ttl/2. A ttl of zero or less
+// disables eviction: keys are kept until Close.
+func NewKeyedLimiter(maxTokens int, refillRate, ttl time.Duration, opts ...Option) *KeyedLimiter {
+	kl := &KeyedLimiter{
+		maxTokens:  maxTokens,
+		refillRate: refillRate,
+		ttl:        ttl,
+		clock:      applyOptions(opts).clock,
+		buckets:    make(map[string]*keyedBucket),
+		stop:       make(chan struct{}),
+	}
+	if ttl <= 0 {
+		return kl
+	}
+	// ttl/2 rounds to zero for ttl of 1ns, which NewTicker rejects
+	every := max(ttl/2, 1)
+	go func() {
+		ticker := kl.clock.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C():
+				kl.evictIdle()
+			case <-kl.stop:
+				return
+			}
+		}
+	}()
+	return kl
+}
+
+// bucket returns the limiter of key, creating it if needed, and marks it used.
+// Callers hold kl.mu.
+func (kl *KeyedLimiter) bucket(key string) *keyedBucket {
+	b, ok := kl.buckets[key]
+	if !ok {
+		b = &keyedBucket{rl: NewTokenBucketLimiter(kl.maxTokens, kl.refillRate, WithClock(kl.clock))}
+		kl.buckets[key] = b
+	}
+	b.lastUsed = kl.clock.Now()
+	return b
+}
+
+// Allow is TokenBucketLimiter.Allow on the bucket of key.
+func (kl *KeyedLimiter) Allow(key string) bool {
+	kl.mu.Lock()
+	b := kl.bucket(key)
+	kl.mu.Unlock()
+	return b.rl.Allow()
+}
+
+// WaitCtx is TokenBucketLimiter.WaitCtx on the bucket of key. A bucket with
+// a caller waiting on it is never evicted.
+func (kl *KeyedLimiter) WaitCtx(ctx context.Context, key string) error {
+	kl.mu.Lock()
+	b := kl.bucket(key)
+	b.waiting++
+	kl.mu.Unlock()
+
+	err := b.rl.WaitCtx(ctx)
+
+	kl.mu.Lock()
+	b.waiting--
+	b.lastUsed = kl.clock.Now()
+	kl.mu.Unlock()
+	return err
+}
+
+// Len returns how many keys currently have a bucket.
+func (kl *KeyedLimiter) Len() int {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	return len(kl.buckets)
+}
+
+// evictIdle closes and forgets the buckets unused for longer than ttl.
+func (kl *KeyedLimiter) evictIdle() {
+	kl.mu.Lock()
+	defer kl.mu.Unlock()
+	now := kl.clock.Now()
+	for key, b := range kl.buckets {
+		if b.waiting == 0 && now.Sub(b.lastUsed) > kl.ttl {
+			b.rl.Close()
+			delete(kl.buckets, key)
+		}
+	}
+}
+
+// Close stops the eviction loop and closes every bucket; it is safe to call twice.
+func (kl *KeyedLimiter) Close() {
+	kl.once.Do(func() {
+		close(kl.stop)
+		kl.mu.Lock()
+		defer kl.mu.Unlock()
+		for key, b := range kl.buckets {
+			b.rl.Close()
+			delete(kl.buckets, key)
+		}
+	})
 }
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShutdownRejectsQueuedAndDrainsInFlight(t *testing.T) {
+	limiter := NewTokenBucketLimiter(1, time.Hour) // a single token, no refill during the test
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	ts := httptest.NewServer(rateLimit(limiter, handler))
+	defer ts.Close()
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-started
+
+	queued := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			queued <- 0
+			return
+		}
+		resp.Body.Close()
+		queued <- resp.StatusCode
+	}()
+	time.Sleep(50 * time.Millisecond) // the second request is now waiting for a token
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownDone <- shutdownLimited(ctx, ts.Config, limiter)
+	}()
+
+	if code := <-queued; code != http.StatusServiceUnavailable {
+		t.Fatalf("queued request: status %d, want 503", code)
+	}
+	close(release)
+	if code := <-inFlight; code != http.StatusOK {
+		t.Fatalf("in-flight request: status %d, want 200", code)
+	}
+	if err := <-shutdownDone; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+}
+
+func TestWaitCtxAfterClose(t *testing.T) {
+	limiter := NewTokenBucketLimiter(5, time.Hour)
+	limiter.Close()
+	if err := limiter.WaitCtx(context.Background()); err != ErrLimiterClosed {
+		t.Fatalf("WaitCtx after Close = %v, want ErrLimiterClosed", err)
+	}
+}
+
+func TestTryWaitAfterClose(t *testing.T) {
+	clk := newFakeClock()
+	rl := NewTokenBucketLimiter(5, time.Hour, WithClock(clk))
+	rl.Close()
+	if rl.TryWait(time.Hour) {
+		t.Error("TryWait after Close took a token")
+	}
+
+	// a TryWait blocked on a drained bucket is released by Close
+	rl = NewTokenBucketLimiter(1, time.Hour, WithClock(clk))
+	rl.Allow()
+	got := make(chan bool)
+	go func() { got <- rl.TryWait(time.Hour) }()
+	<-clk.waiters
+	rl.Close()
+	if <-got {
+		t.Error("TryWait on a limiter closed while waiting took a token")
+	}
+}
+
+func TestAllowDrainsAndRefills(t *testing.T) {
+	rl := NewTokenBucketLimiter(2, 50*time.Millisecond)
+	defer rl.Close()
+
+	if !rl.Allow() || !rl.Allow() {
+		t.Fatal("full bucket refused a token")
+	}
+	start := time.Now()
+	for !rl.Allow() {
+		if time.Since(start) > time.Second {
+			t.Fatal("bucket never refilled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Allow succeeded after %s on a drained bucket, before the refill", waited)
+	}
+
+	rl.Close()
+	time.Sleep(60 * time.Millisecond)
+	if rl.Allow() {
+		t.Error("closed limiter allowed a token")
+	}
+}
+
+func TestWaitDelegatesToWaitCtx(t *testing.T) {
+	rl := NewTokenBucketLimiter(3, time.Hour)
+	rl.Wait()
+	if n := len(rl.tokens); n != 2 {
+		t.Fatalf("tokens after Wait = %d, want 2", n)
+	}
+
+	// closed, Wait must not hang even with the bucket drained
+	rl.Close()
+	<-rl.tokens
+	<-rl.tokens
+	done := make(chan struct{})
+	go func() {
+		rl.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Wait blocked on a closed limiter")
+	}
+}
+
+func TestWaitNAllOrNothing(t *testing.T) {
+	rl := NewTokenBucketLimiter(10, time.Hour)
+	defer rl.Close()
+
+	start := time.Now()
+	if err := rl.WaitN(context.Background(), 11); !errors.Is(err, ErrExceedsBurst) {
+		t.Fatalf("WaitN(11) on a 10-token bucket = %v, want ErrExceedsBurst", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("WaitN(11) blocked instead of failing at once")
+	}
+	if rl.AllowN(11) {
+		t.Error("AllowN(11) on a 10-token bucket = true")
+	}
+
+	if err := rl.WaitN(context.Background(), 7); err != nil {
+		t.Fatal(err)
+	}
+	if rl.AllowN(4) {
+		t.Error("AllowN(4) with 3 tokens left = true")
+	}
+	if n := len(rl.tokens); n != 3 {
+		t.Fatalf("failed AllowN left %d tokens, want the 3 untouched", n)
+	}
+
+	// two callers each wanting more than is left: neither keeps a partial share
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- rl.WaitN(ctx, 2)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	var ok, timedOut int
+	for err := range errs {
+		switch {
+		case err == nil:
+			ok++
+		case errors.Is(err, context.DeadlineExceeded):
+			timedOut++
+		}
+	}
+	if ok != 1 || timedOut != 1 {
+		t.Errorf("ok=%d timedOut=%d, want one of each", ok, timedOut)
+	}
+	if n := len(rl.tokens); n != 1 {
+		t.Errorf("tokens left = %d, want 1 (the loser returned its share)", n)
+	}
+}
+
+func TestStopReleasesRefillGoroutine(t *testing.T) {
+	baseline := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		rl := NewTokenBucketLimiter(1, time.Millisecond)
+		rl.Stop()
+		rl.Stop()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d after stopping 100 limiters, baseline %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKeyedLimiterIsolatesKeys(t *testing.T) {
+	kl := NewKeyedLimiter(2, time.Hour, time.Hour)
+	defer kl.Close()
+
+	for i := 0; i < 2; i++ {
+		if !kl.Allow("10.0.0.1") {
+			t.Fatalf("first key refused token %d", i+1)
+		}
+	}
+	if kl.Allow("10.0.0.1") {
+		t.Error("exhausted key still allowed")
+	}
+	if !kl.Allow("10.0.0.2") || !kl.Allow("10.0.0.2") {
+		t.Error("second key throttled by the first one's exhaustion")
+	}
+	if err := kl.WaitCtx(context.Background(), "10.0.0.3"); err != nil {
+		t.Errorf("WaitCtx on a fresh key: %v", err)
+	}
+}
+
+func TestKeyedLimiterEvictsIdleKeys(t *testing.T) {
+	clk := newFakeClock()
+	kl := NewKeyedLimiter(1, 24*time.Hour, time.Hour, WithClock(clk))
+	defer kl.Close()
+
+	kl.Allow("idle")
+	clk.Advance(30 * time.Minute)
+	kl.Allow("busy")
+	// "waiting" blocks on its drained bucket for the whole test
+	kl.Allow("waiting")
+	ctx, cancel := context.WithCancel(context.Background())
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- kl.WaitCtx(ctx, "waiting") }()
+	for {
+		kl.mu.Lock()
+		w := kl.buckets["waiting"].waiting
+		kl.mu.Unlock()
+		if w == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	idle := kl.buckets["idle"].rl
+
+	// the janitor ticks at 60m and evicts too; evictIdle makes the result
+	// certain before the checks below
+	clk.Advance(45 * time.Minute)
+	kl.evictIdle()
+	if kl.Len() != 2 {
+		t.Fatalf("keys after eviction = %d, want busy and waiting", kl.Len())
+	}
+	if _, ok := kl.buckets["idle"]; ok {
+		t.Error("idle key not evicted")
+	}
+	if err := idle.WaitCtx(context.Background()); !errors.Is(err, ErrLimiterClosed) {
+		t.Errorf("evicted limiter not closed: WaitCtx = %v", err)
+	}
+
+	cancel()
+	if err := <-waitErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("WaitCtx = %v, want context.Canceled", err)
+	}
+}
+
+func TestKeyedLimiterWithoutTTL(t *testing.T) {
+	for _, ttl := range []time.Duration{0, -time.Second, time.Nanosecond} {
+		kl := NewKeyedLimiter(1, time.Hour, ttl)
+		kl.Allow("key")
+		if ttl <= 0 && kl.Len() != 1 {
+			t.Errorf("ttl %v: keys = %d, want 1", ttl, kl.Len())
+		}
+		kl.Close()
+	}
+}
+
+// fakeClock is a Clock that only moves when Advance is called.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*fakeTicker
+	afters  []fakeAfter
+	// waiters receives a value every time After is called, so a test can
+	// advance only once the timeout it wants to fire is registered.
+	waiters chan struct{}
+}
+
+type fakeTicker struct {
+	c       chan time.Time
+	every   time.Duration
+	next    time.Time
+	stopped bool
+}
+
+func (t *fakeTicker) C() <-chan time.Time { return t.c }
+func (t *fakeTicker) Stop()               { t.stopped = true }
+
+type fakeAfter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0), waiters: make(chan struct{}, 16)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTicker{c: make(chan time.Time), every: d, next: c.now.Add(d)}
+	c.tickers = append(c.tickers, t)
+	return t
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	ch := make(chan time.Time, 1)
+	c.afters = append(c.afters, fakeAfter{at: c.now.Add(d), c: ch})
+	c.mu.Unlock()
+	c.waiters <- struct{}{}
+	return ch
+}
+
+// Advance moves the clock forward by d, firing what came due. A tick is
+// delivered synchronously, so when Advance returns the refill goroutine has
+// received it.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	now := c.now
+	var ticks []chan time.Time
+	for _, t := range c.tickers {
+		for !t.stopped && !t.next.After(now) {
+			ticks = append(ticks, t.c)
+			t.next = t.next.Add(t.every)
+		}
+	}
+	pending := c.afters[:0]
+	for _, a := range c.afters {
+		if a.at.After(now) {
+			pending = append(pending, a)
+			continue
+		}
+		a.c <- now
+	}
+	c.afters = pending
+	c.mu.Unlock()
+	for _, ch := range ticks {
+		ch <- now
+	}
+}
+
+func TestRefillWithFakeClock(t *testing.T) {
+	clk := newFakeClock()
+	rl := NewTokenBucketLimiter(2, time.Second, WithClock(clk))
+	defer rl.Stop()
+
+	rl.Allow()
+	rl.Allow()
+	if rl.Allow() {
+		t.Fatal("drained bucket allowed a token before any refill")
+	}
+
+	clk.Advance(999 * time.Millisecond)
+	if rl.Allow() {
+		t.Fatal("token granted before the refill interval elapsed")
+	}
+	clk.Advance(time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rl.WaitCtx(ctx); err != nil {
+		t.Fatalf("no token after one refill interval: %v", err)
+	}
+}
+
+func TestTryWaitTimeoutWithFakeClock(t *testing.T) {
+	clk := newFakeClock()
+	rl := NewTokenBucketLimiter(1, time.Hour, WithClock(clk))
+	defer rl.Stop()
+	rl.Allow()
+
+	got := make(chan bool)
+	go func() { got <- rl.TryWait(5 * time.Second) }()
+	<-clk.waiters
+
+	clk.Advance(4 * time.Second)
+	select {
+	case <-got:
+		t.Fatal("TryWait returned before its timeout")
+	default:
+	}
+	clk.Advance(time.Second)
+	if <-got {
+		t.Error("TryWait = true on a drained bucket")
+	}
+}
+
+func TestLimiterStats(t *testing.T) {
+	clk := newFakeClock()
+	rl := NewTokenBucketLimiter(3, time.Hour, WithClock(clk))
+	defer rl.Stop()
+
+	if n := rl.Available(); n != 3 {
+		t.Fatalf("Available = %d, want 3", n)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rl.Allow()
+		}()
+	}
+	wg.Wait()
+	if n := rl.Available(); n != 0 {
+		t.Errorf("Available = %d after draining, want 0", n)
+	}
+	rl.AllowN(2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rl.WaitCtx(ctx)
+
+	if got, want := rl.Stats(), (LimiterStats{Granted: 3, Throttled: 9}); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestSlidingWindowVersusTokenBucketBurst(t *testing.T) {
+	// both admit 5 requests per second on average
+	clk := newFakeClock()
+	bucket := NewTokenBucketLimiter(5, 200*time.Millisecond, WithClock(clk))
+	defer bucket.Stop()
+	window := NewSlidingWindowLimiter(5, time.Second, WithClock(clk))
+
+	for name, l := range map[string]Limiter{"bucket": bucket, "window": window} {
+		for i := 0; i < 5; i++ {
+			if !l.Allow() {
+				t.Fatalf("%s refused request %d of the initial burst", name, i+1)
+			}
+		}
+		if l.Allow() {
+			t.Errorf("%s allowed a 6th request at once", name)
+		}
+	}
+
+	// 200ms later the bucket has a fresh token: 6 requests in 200ms
+	clk.Advance(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bucket.WaitCtx(ctx); err != nil {
+		t.Errorf("bucket after one refill: %v", err)
+	}
+	if window.Allow() {
+		t.Error("window allowed a 6th request within the same second")
+	}
+
+	clk.Advance(800 * time.Millisecond)
+	if !window.Allow() {
+		t.Error("window still full once the first request left it")
+	}
+}
+
+func TestSlidingWindowWaitCtx(t *testing.T) {
+	clk := newFakeClock()
+	sw := NewSlidingWindowLimiter(1, time.Second, WithClock(clk))
+	sw.Allow()
+
+	done := make(chan error)
+	go func() { done <- sw.WaitCtx(context.Background()) }()
+	<-clk.waiters
+	clk.Advance(time.Second)
+	if err := <-done; err != nil {
+		t.Fatalf("WaitCtx = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- sw.WaitCtx(ctx) }()
+	<-clk.waiters
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled WaitCtx = %v", err)
+	}
+}
+
+func TestSlidingWindowRejectsInvalidArgs(t *testing.T) {
+	for _, tc := range []struct {
+		limit  int
+		window time.Duration
+	}{{0, time.Second}, {-1, time.Second}, {1, 0}, {1, -time.Second}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("NewSlidingWindowLimiter(%d, %v) did not panic", tc.limit, tc.window)
+				}
+			}()
+			NewSlidingWindowLimiter(tc.limit, tc.window)
+		}()
+	}
+}
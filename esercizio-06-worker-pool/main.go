@@ -1,100 +1,603 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
+	"net/http"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"golang-course-ex-Mauro/internal/retry"
 )
 
-type Task struct {
+// PoolTask è un'unità di lavoro di un Pool: Process riceve Data.
+type PoolTask[In, Out any] struct {
 	ID      int
-	Data    interface{}
-	Process func(interface{}) (interface{}, error)
+	Data    In
+	Process func(In) (Out, error)
+
+	attempts int
+	// seq è la posizione del task tra quelli accettati da Submit.
+	seq int64
 }
 
-type Result struct {
-	TaskID int
-	Value  interface{}
-	Error  error
+// PoolResult è l'esito del task TaskID; Value è lo zero value se Error != nil.
+// Attempts conta le esecuzioni di Process, retry compresi.
+type PoolResult[Out any] struct {
+	TaskID   int
+	Value    Out
+	Error    error
+	Attempts int
+
+	seq int64
 }
 
-type WorkerPool struct {
+// Task, Result e WorkerPool sono il pool non tipizzato di partenza, che ora è
+// solo un'istanza di Pool.
+type (
+	Task       = PoolTask[interface{}, interface{}]
+	Result     = PoolResult[interface{}]
+	WorkerPool = Pool[interface{}, interface{}]
+)
+
+// Pool esegue task di tipo PoolTask[In, Out] su un numero fisso di worker e
+// ne pubblica i PoolResult[Out], senza type assertion da parte di chi lo usa.
+type Pool[In, Out any] struct {
+	// MaxRetries è quante volte un task fallito viene rieseguito prima di
+	// pubblicarne l'errore; gli errori retry.Permanent non si ritentano.
+	// Backoff, se non nil, dà l'attesa prima del retry a partire dall'indice
+	// (da 0) del tentativo fallito, come retry.RetryPolicy.Delay. Vanno
+	// impostati prima di Start.
+	MaxRetries int
+	Backoff    func(attempt int) time.Duration
+
 	numWorkers int
-	tasks      chan Task
-	results    chan Result
-	done       chan struct{}
-	wg         sync.WaitGroup
+	tasks      chan PoolTask[In, Out]
+	// retries è la coda interna dei task da rieseguire: la riempiono i timer
+	// del backoff e non i worker, che così non si bloccano mai su tasks piena.
+	retries chan PoolTask[In, Out]
+	results chan PoolResult[Out]
+	// open conta i task accettati da Submit che non hanno ancora un Result
+	// definitivo, compresi quelli in attesa di retry.
+	open sync.WaitGroup
+	// submitted numera i task accettati, per CollectOrdered.
+	submitted atomic.Int64
+	// ctx è quello passato a StartCtx: cancellato, i worker smettono di
+	// prendere task e Submit non accoda più.
+	ctx     context.Context
+	wg      sync.WaitGroup
+	breaker *CircuitBreaker
+	// done viene chiuso dal primo Stop o Wait: da lì Submit rifiuta i task.
+	// submitMu è preso in lettura da ogni Submit, così chi chiude la coda
+	// può prima aspettare che quelli in corso abbiano finito.
+	done     chan struct{}
+	submitMu sync.RWMutex
+	stopOnce sync.Once
+	// stopped viene chiuso quando i worker hanno finito e Results è chiuso.
+	stopped chan struct{}
+	// quit fa uscire un worker inattivo per ogni valore ricevuto: è così che
+	// Resize riduce i worker. started dice se StartCtx è già stata chiamata;
+	// entrambi, come numWorkers, sono protetti da statsMu.
+	quit    chan struct{}
+	started bool
+
+	statsMu sync.Mutex
+	stats   PoolStats
+}
+
+// PoolStats è lo stato istantaneo del pool. Queued conta anche i Submit
+// ancora bloccati sulla coda piena; ogni task si trova in esattamente uno tra
+// Queued, InFlight, Completed e Failed.
+type PoolStats struct {
+	Workers   int   `json:"workers"`
+	Queued    int64 `json:"queued"`
+	InFlight  int64 `json:"in_flight"`
+	Completed int64 `json:"completed"`
+	Failed    int64 `json:"failed"`
+}
+
+// Stats ritorna uno snapshot coerente: i contatori sono aggiornati insieme
+// sotto lo stesso lock, quindi un task non viene mai contato due volte.
+func (wp *Pool[In, Out]) Stats() PoolStats {
+	wp.statsMu.Lock()
+	defer wp.statsMu.Unlock()
+	s := wp.stats
+	s.Workers = wp.numWorkers
+	return s
+}
+
+func (wp *Pool[In, Out]) updateStats(fn func(s *PoolStats)) {
+	wp.statsMu.Lock()
+	fn(&wp.stats)
+	wp.statsMu.Unlock()
+}
+
+func (wp *Pool[In, Out]) finish(err error) {
+	wp.updateStats(func(s *PoolStats) {
+		s.InFlight--
+		if err != nil {
+			s.Failed++
+		} else {
+			s.Completed++
+		}
+	})
+}
+
+// statsHandler espone Stats come JSON, da montare ad esempio su /debug/pool.
+func statsHandler(wp interface{ Stats() PoolStats }) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(wp.Stats())
+	})
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// CircuitBreaker scatta dopo threshold fallimenti consecutivi (errori o panic)
+// avvenuti entro window. Da aperto rifiuta tutto per cooldown, poi lascia
+// passare un solo task di prova: se riesce si richiude, altrimenti si riapre.
+type CircuitBreaker struct {
+	mu           sync.Mutex
+	threshold    int
+	window       time.Duration
+	cooldown     time.Duration
+	state        breakerState
+	failures     int
+	firstFailure time.Time
+	openedAt     time.Time
+	probing      bool
+	now          func() time.Time
+}
+
+func NewCircuitBreaker(threshold int, window, cooldown time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow ritorna ErrCircuitOpen se il task non deve essere eseguito.
+func (cb *CircuitBreaker) Allow() error {
+	_, err := cb.allow()
+	return err
+}
+
+// allow è Allow che dice anche se il chiamante ha preso il posto del task di
+// prova, che va restituito con cancelProbe se il task poi non parte.
+func (cb *CircuitBreaker) allow() (probe bool, err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case breakerOpen:
+		if cb.now().Sub(cb.openedAt) < cb.cooldown {
+			return false, ErrCircuitOpen
+		}
+		cb.state = breakerHalfOpen
+		cb.probing = true
+		return true, nil
+	case breakerHalfOpen:
+		if cb.probing {
+			return false, ErrCircuitOpen
+		}
+		cb.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// cancelProbe libera il posto del task di prova senza cambiare stato, così
+// il prossimo Allow può tentare un'altra prova.
+func (cb *CircuitBreaker) cancelProbe() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == breakerHalfOpen {
+		cb.probing = false
+	}
+}
+
+// RecordSuccess richiude il breaker solo da half-open. Da aperto il successo
+// è di un task accodato prima dello scatto e non deve saltare il cooldown.
+func (cb *CircuitBreaker) RecordSuccess() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case breakerOpen:
+		return
+	case breakerHalfOpen:
+		cb.state = breakerClosed
+		cb.probing = false
+	}
+	cb.failures = 0
+}
+
+func (cb *CircuitBreaker) RecordFailure() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	now := cb.now()
+	if cb.state == breakerHalfOpen {
+		cb.state = breakerOpen
+		cb.openedAt = now
+		cb.probing = false
+		return
+	}
+	if cb.failures == 0 || now.Sub(cb.firstFailure) > cb.window {
+		cb.failures = 0
+		cb.firstFailure = now
+	}
+	cb.failures++
+	if cb.state == breakerClosed && cb.failures >= cb.threshold {
+		cb.state = breakerOpen
+		cb.openedAt = now
+	}
+}
+
+// SetCircuitBreaker va chiamato prima di Start.
+func (wp *Pool[In, Out]) SetCircuitBreaker(cb *CircuitBreaker) {
+	wp.breaker = cb
+}
+
+func (wp *Pool[In, Out]) record(err error) {
+	if wp.breaker == nil {
+		return
+	}
+	if err != nil {
+		wp.breaker.RecordFailure()
+	} else {
+		wp.breaker.RecordSuccess()
+	}
 }
 
 func NewWorkerPool(n int) *WorkerPool {
-	return &WorkerPool{
+	return NewPool[interface{}, interface{}](n)
+}
+
+// NewPool crea un pool tipizzato con n worker; code e risultati hanno un
+// buffer di n elementi come in NewWorkerPool.
+func NewPool[In, Out any](n int) *Pool[In, Out] {
+	return &Pool[In, Out]{
 		numWorkers: n,
-		tasks:      make(chan Task, n),
-		results:    make(chan Result, n),
+		tasks:      make(chan PoolTask[In, Out], n),
+		retries:    make(chan PoolTask[In, Out]),
+		results:    make(chan PoolResult[Out], n),
+		ctx:        context.Background(),
 		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+		quit:       make(chan struct{}),
 	}
 }
 
-func (wp *WorkerPool) Start() {
-	for i := 0; i < wp.numWorkers; i++ {
+func (wp *Pool[In, Out]) Start() {
+	wp.StartCtx(context.Background())
+}
+
+// StartCtx avvia i worker legati a ctx. Alla cancellazione ogni worker
+// finisce il task che sta eseguendo, ne pubblica il Result come sempre ed
+// esce senza prenderne altri; un task già tolto dalla coda quando ctx è
+// cancellato viene riportato con Error = ctx.Err() senza eseguirlo. I task
+// rimasti in coda non producono Result. Wait va chiamata comunque.
+func (wp *Pool[In, Out]) StartCtx(ctx context.Context) {
+	wp.ctx = ctx
+	wp.statsMu.Lock()
+	wp.started = true
+	n := wp.numWorkers
+	wp.statsMu.Unlock()
+	for i := 0; i < n; i++ {
 		wp.wg.Add(1)
 		go wp.worker(i)
 	}
 }
 
-func (wp *WorkerPool) worker(id int) {
+// Resize porta il pool a n worker, almeno 1 perché la coda non resti mai
+// senza nessuno che la svuoti. I worker in più partono subito; quelli in
+// eccesso escono appena sono liberi, dopo il task che stanno eseguendo, e
+// nessun task accodato va perso. Dopo Stop o Wait non fa nulla.
+func (wp *Pool[In, Out]) Resize(n int) {
+	if n < 1 {
+		n = 1
+	}
+	// come Submit: shutdown non chiude la coda mentre si aggiungono worker
+	wp.submitMu.RLock()
+	defer wp.submitMu.RUnlock()
+	select {
+	case <-wp.done:
+		return
+	default:
+	}
+
+	wp.statsMu.Lock()
+	old := wp.numWorkers
+	wp.numWorkers = n
+	started := wp.started
+	wp.statsMu.Unlock()
+	if !started {
+		return
+	}
+	for i := old; i < n; i++ {
+		wp.wg.Add(1)
+		go wp.worker(i)
+	}
+	if n < old {
+		go func() {
+			for i := n; i < old; i++ {
+				select {
+				case wp.quit <- struct{}{}:
+				case <-wp.stopped:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func (wp *Pool[In, Out]) worker(id int) {
 	defer wp.wg.Done()
+	for {
+		var task PoolTask[In, Out]
+		select {
+		case <-wp.ctx.Done():
+			return
+		case <-wp.quit:
+			return
+		case t, ok := <-wp.tasks:
+			if !ok {
+				return
+			}
+			task = t
+		case t := <-wp.retries:
+			task = t
+		}
+		if err := wp.ctx.Err(); err != nil {
+			// la select può scegliere il task anche a contesto già cancellato
+			wp.updateStats(func(s *PoolStats) {
+				s.Queued--
+				s.Failed++
+			})
+			wp.results <- PoolResult[Out]{TaskID: task.ID, Error: err, Attempts: task.attempts, seq: task.seq}
+			wp.open.Done()
+			return
+		}
+		wp.updateStats(func(s *PoolStats) {
+			s.Queued--
+			s.InFlight++
+		})
+		val, err := runTask(task)
+		task.attempts++
+		wp.record(err)
+		if err != nil && wp.shouldRetry(task, err) {
+			wp.updateStats(func(s *PoolStats) {
+				s.InFlight--
+				s.Queued++
+			})
+			wp.scheduleRetry(task)
+			continue
+		}
+		wp.finish(err)
+		wp.results <- PoolResult[Out]{TaskID: task.ID, Value: val, Error: err, Attempts: task.attempts, seq: task.seq}
+		wp.open.Done()
+	}
+}
+
+func (wp *Pool[In, Out]) shouldRetry(task PoolTask[In, Out], err error) bool {
+	return task.attempts <= wp.MaxRetries && !errors.Is(err, retry.ErrPermanent) && wp.ctx.Err() == nil
+}
+
+// scheduleRetry rimette task nella coda dei retry dopo il backoff. Se il
+// contesto viene cancellato nel frattempo il task viene scartato.
+func (wp *Pool[In, Out]) scheduleRetry(task PoolTask[In, Out]) {
+	var delay time.Duration
+	if wp.Backoff != nil {
+		delay = wp.Backoff(task.attempts - 1)
+	}
+	time.AfterFunc(delay, func() {
+		select {
+		case wp.retries <- task:
+		case <-wp.ctx.Done():
+			wp.updateStats(func(s *PoolStats) {
+				s.Queued--
+				s.Failed++
+			})
+			wp.open.Done()
+		}
+	})
+}
+
+// runTask esegue task.Process trasformando un suo panic in errore, così il
+// Result porta l'ID del task che l'ha causato e il worker passa al successivo.
+func runTask[In, Out any](task PoolTask[In, Out]) (val Out, err error) {
 	defer func() {
 		if r := recover(); r != nil {
-			wp.results <- Result{TaskID: -1, Error: fmt.Errorf("panic: %v", r)}
+			var zero Out
+			val, err = zero, fmt.Errorf("panic: %v", r)
 		}
 	}()
-	for task := range wp.tasks {
-		val, err := task.Process(task.Data)
-		wp.results <- Result{TaskID: task.ID, Value: val, Error: err}
-	}
+	return task.Process(task.Data)
 }
 
-func (wp *WorkerPool) Submit(task Task) {
-	wp.tasks <- task
+// ErrPoolStopped è l'errore di Submit dopo Stop o Wait.
+var ErrPoolStopped = errors.New("worker pool stopped")
+
+// Submit ritorna ErrCircuitOpen, senza accodare il task, se il circuit breaker è aperto,
+// l'errore del contesto di StartCtx se questo viene cancellato prima che ci sia posto in coda
+// ed ErrPoolStopped se il pool è stato fermato con Stop o Wait.
+func (wp *Pool[In, Out]) Submit(task PoolTask[In, Out]) error {
+	wp.submitMu.RLock()
+	defer wp.submitMu.RUnlock()
+	select {
+	case <-wp.done:
+		return ErrPoolStopped
+	default:
+	}
+	if err := wp.ctx.Err(); err != nil {
+		return err
+	}
+	// il breaker si consulta dopo lo stato del pool: un task di prova che non
+	// viene accodato deve restituire il suo posto, altrimenti il breaker
+	// resterebbe half-open con una prova che non arriverà mai
+	probe := false
+	if wp.breaker != nil {
+		var err error
+		if probe, err = wp.breaker.allow(); err != nil {
+			return err
+		}
+	}
+	unprobe := func() {
+		if probe {
+			wp.breaker.cancelProbe()
+		}
+	}
+	wp.updateStats(func(s *PoolStats) { s.Queued++ })
+	wp.open.Add(1)
+	task.seq = wp.submitted.Add(1)
+	select {
+	case wp.tasks <- task:
+		return nil
+	case <-wp.ctx.Done():
+		wp.updateStats(func(s *PoolStats) { s.Queued-- })
+		wp.open.Done()
+		unprobe()
+		return wp.ctx.Err()
+	case <-wp.done:
+		wp.updateStats(func(s *PoolStats) { s.Queued-- })
+		wp.open.Done()
+		unprobe()
+		return ErrPoolStopped
+	}
 }
 
-func (wp *WorkerPool) Results() <-chan Result {
+// Results è il canale su cui i worker pubblicano un Result per ogni task.
+// Va consumato mentre si sottomette: il buffer è di numWorkers elementi e
+// i worker si bloccano quando è pieno.
+func (wp *Pool[In, Out]) Results() <-chan PoolResult[Out] {
 	return wp.results
 }
 
-func (wp *WorkerPool) Stop() {
-	close(wp.tasks)
-	wp.wg.Wait()
-	close(wp.results)
+// CollectOrdered legge Results fino alla chiusura e ritorna tutti i risultati
+// nell'ordine in cui i task sono stati accettati da Submit, che con ID
+// crescenti coincide con l'ordine per TaskID; errori e panic compresi.
+// Come range su Results va chiamata mentre un'altra goroutine fa Submit e
+// poi Wait. A differenza dello streaming di Results tiene in memoria ogni
+// risultato fino alla fine, quindi costa O(task) e il primo risultato arriva
+// solo quando è finito l'ultimo.
+func (wp *Pool[In, Out]) CollectOrdered() []PoolResult[Out] {
+	var all []PoolResult[Out]
+	for res := range wp.results {
+		all = append(all, res)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].seq < all[j].seq })
+	return all
+}
+
+// Wait aspetta il Result definitivo di ogni task accodato, retry compresi,
+// poi chiude la coda, ferma i worker e chiude Results, così chi consuma può
+// usare range. Se il contesto di StartCtx viene cancellato smette di
+// aspettare i task rimasti in coda.
+//
+// L'ordine corretto è: Start, Submit dei task (anche da più goroutine), poi
+// Wait; i Submit successivi ritornano ErrPoolStopped. Poiché Wait blocca
+// finché i risultati non sono letti, di solito la si chiama nella goroutine
+// che sottomette e si fa range su Results in quella principale.
+func (wp *Pool[In, Out]) Wait() {
+	<-wp.shutdown()
+}
+
+// Stop smette di accettare task e aspetta, come Wait, che quelli già accodati
+// finiscano, ma non oltre ctx: alla scadenza ritorna ctx.Err() lasciando i
+// worker completare da soli, e Results verrà chiuso quando avranno finito.
+func (wp *Pool[In, Out]) Stop(ctx context.Context) error {
+	select {
+	case <-wp.shutdown():
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutdown avvia lo spegnimento una sola volta e ritorna il canale che si
+// chiude quando è completo.
+func (wp *Pool[In, Out]) shutdown() <-chan struct{} {
+	wp.stopOnce.Do(func() {
+		close(wp.done)
+		// i Submit in corso hanno accodato o rinunciato: nessuno invierà più
+		// su tasks e open non cresce più
+		wp.submitMu.Lock()
+		wp.submitMu.Unlock()
+		go func() {
+			settled := make(chan struct{})
+			go func() {
+				wp.open.Wait()
+				close(settled)
+			}()
+			select {
+			case <-settled:
+			case <-wp.ctx.Done():
+			}
+			close(wp.tasks)
+			wp.wg.Wait()
+			// dopo una cancellazione in coda possono restare task mai eseguiti:
+			// non avranno un Result ma escono da Queued
+			for range wp.tasks {
+				wp.updateStats(func(s *PoolStats) { s.Queued-- })
+				wp.open.Done()
+			}
+			close(wp.results)
+			close(wp.stopped)
+		}()
+	})
+	return wp.stopped
 }
 
 func main() {
 	workers := flag.Int("workers", 5, "number of workers")
 	tasks := flag.Int("tasks", 100, "number of tasks")
+	statsAddr := flag.String("stats-addr", "", "if set, serve the pool state as JSON on this address at /debug/pool")
 	flag.Parse()
 	start := time.Now()
 	var total, success, failed int64
 
-	pool := NewWorkerPool(*workers)
+	pool := NewPool[int, int](*workers)
 	pool.Start()
-	defer pool.Stop()
+
+	if *statsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/pool", statsHandler(pool))
+		go func() {
+			log.Println(http.ListenAndServe(*statsAddr, mux))
+		}()
+	}
 
 	numTasks := *tasks
 	go func() {
 		for i := 0; i < numTasks; i++ {
-			task := Task{ID: i, Data: i, Process: func(d interface{}) (interface{}, error) {
+			task := PoolTask[int, int]{ID: i, Data: i, Process: func(n int) (int, error) {
 				time.Sleep(100 * time.Millisecond)
-				return fmt.Sprintf("done %v", d), nil
+				return n * n, nil
 			}}
-			pool.Submit(task)
+			if err := pool.Submit(task); err != nil {
+				fmt.Printf("Task %d rejected: %v\n", task.ID, err)
+			}
 		}
+		pool.Wait()
 	}()
 
-	for i := 0; i < numTasks; i++ {
-		res := <-pool.Results()
+	for res := range pool.Results() {
 		fmt.Printf("Task %d: %v (err=%v)\n", res.TaskID, res.Value, res.Error)
 		atomic.AddInt64(&total, 1)
 		if res.Error != nil {
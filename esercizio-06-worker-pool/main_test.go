@@ -0,0 +1,596 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang-course-ex-Mauro/internal/retry"
+)
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := NewCircuitBreaker(3, time.Minute, 10*time.Second)
+	cb.now = func() time.Time { return now }
+
+	pool := NewWorkerPool(1)
+	pool.SetCircuitBreaker(cb)
+	pool.Start()
+	defer pool.Wait()
+
+	fail := func(interface{}) (interface{}, error) { return nil, errors.New("boom") }
+	ok := func(d interface{}) (interface{}, error) { return d, nil }
+
+	for i := 0; i < 3; i++ {
+		if err := pool.Submit(Task{ID: i, Process: fail}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+		<-pool.Results()
+	}
+
+	if err := pool.Submit(Task{ID: 3, Process: ok}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("after threshold: err = %v, want ErrCircuitOpen", err)
+	}
+
+	now = now.Add(11 * time.Second)
+	if err := pool.Submit(Task{ID: 4, Process: ok}); err != nil {
+		t.Fatalf("half-open probe rejected: %v", err)
+	}
+	if err := pool.Submit(Task{ID: 5, Process: ok}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("second task during probe: err = %v, want ErrCircuitOpen", err)
+	}
+	if res := <-pool.Results(); res.Error != nil || res.TaskID != 4 {
+		t.Fatalf("probe result = %+v", res)
+	}
+
+	if err := pool.Submit(Task{ID: 6, Process: ok}); err != nil {
+		t.Fatalf("after successful probe: %v", err)
+	}
+	<-pool.Results()
+}
+
+func TestCircuitBreakerFailedProbeReopens(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := NewCircuitBreaker(1, time.Minute, time.Second)
+	cb.now = func() time.Time { return now }
+
+	cb.RecordFailure()
+	if !errors.Is(cb.Allow(), ErrCircuitOpen) {
+		t.Fatal("breaker should be open")
+	}
+	now = now.Add(2 * time.Second)
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("probe: %v", err)
+	}
+	cb.RecordFailure()
+	if !errors.Is(cb.Allow(), ErrCircuitOpen) {
+		t.Fatal("failed probe should reopen the breaker")
+	}
+}
+
+// TestCircuitBreakerIgnoresLateSuccess usa due worker: un task lento
+// accodato prima dello scatto che riesce a breaker aperto non deve
+// richiuderlo saltando cooldown e prova.
+func TestCircuitBreakerIgnoresLateSuccess(t *testing.T) {
+	cb := NewCircuitBreaker(2, time.Minute, time.Hour)
+	pool := NewWorkerPool(2)
+	pool.SetCircuitBreaker(cb)
+	pool.Start()
+	defer pool.Wait()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	slow := func(d interface{}) (interface{}, error) {
+		close(started)
+		<-release
+		return d, nil
+	}
+	fail := func(interface{}) (interface{}, error) { return nil, errors.New("boom") }
+
+	if err := pool.Submit(Task{ID: 0, Process: slow}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i := 1; i <= 2; i++ {
+		if err := pool.Submit(Task{ID: i, Process: fail}); err != nil {
+			t.Fatalf("submit %d: %v", i, err)
+		}
+		<-pool.Results()
+	}
+	if !errors.Is(cb.Allow(), ErrCircuitOpen) {
+		t.Fatal("breaker should be open after two failures")
+	}
+
+	close(release)
+	if res := <-pool.Results(); res.TaskID != 0 || res.Error != nil {
+		t.Fatalf("slow result = %+v", res)
+	}
+	if err := pool.Submit(Task{ID: 3, Process: fail}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("late success closed the breaker: err = %v, want ErrCircuitOpen", err)
+	}
+}
+
+func TestCircuitBreakerProbeReleasedOnStoppedPool(t *testing.T) {
+	now := time.Unix(0, 0)
+	cb := NewCircuitBreaker(1, time.Minute, time.Second)
+	cb.now = func() time.Time { return now }
+	cb.RecordFailure()
+	now = now.Add(2 * time.Second)
+
+	pool := NewWorkerPool(1)
+	pool.SetCircuitBreaker(cb)
+	pool.Start()
+	pool.Wait()
+	ok := func(d interface{}) (interface{}, error) { return d, nil }
+	if err := pool.Submit(Task{ID: 0, Process: ok}); !errors.Is(err, ErrPoolStopped) {
+		t.Fatalf("submit on stopped pool: err = %v, want ErrPoolStopped", err)
+	}
+	// il Submit fallito non deve essersi tenuto il posto della prova
+	if err := cb.Allow(); err != nil {
+		t.Fatalf("probe slot leaked: %v", err)
+	}
+}
+
+func TestStatsHandlerWhileQueued(t *testing.T) {
+	pool := NewWorkerPool(1)
+	pool.Start()
+
+	release := make(chan struct{})
+	block := func(d interface{}) (interface{}, error) {
+		<-release
+		if d.(int) == 2 {
+			return nil, errors.New("fail")
+		}
+		return d, nil
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			pool.Submit(Task{ID: i, Data: i, Process: block})
+		}
+	}()
+
+	// un task in esecuzione, uno nel buffer e uno bloccato in Submit
+	deadline := time.Now().Add(2 * time.Second)
+	for s := pool.Stats(); s.InFlight != 1 || s.Queued != 2; s = pool.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool never reached 1 in flight / 2 queued: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := httptest.NewRecorder()
+	statsHandler(pool).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/pool", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var got PoolStats
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	want := PoolStats{Workers: 1, Queued: 2, InFlight: 1}
+	if got != want {
+		t.Fatalf("stats = %+v, want %+v", got, want)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		<-pool.Results()
+	}
+	pool.Wait()
+	final := pool.Stats()
+	if final.Queued != 0 || final.InFlight != 0 || final.Completed != 2 || final.Failed != 1 {
+		t.Fatalf("final stats = %+v, want 2 completed and 1 failed", final)
+	}
+}
+
+func TestWaitClosesResults(t *testing.T) {
+	pool := NewWorkerPool(3)
+	pool.Start()
+	double := func(d interface{}) (interface{}, error) { return d.(int) * 2, nil }
+	go func() {
+		for i := 0; i < 10; i++ {
+			pool.Submit(Task{ID: i, Data: i, Process: double})
+		}
+		pool.Wait()
+	}()
+
+	seen := make(map[int]int)
+	for res := range pool.Results() {
+		seen[res.TaskID] = res.Value.(int)
+	}
+	if len(seen) != 10 {
+		t.Fatalf("got %d results, want 10", len(seen))
+	}
+	for id, v := range seen {
+		if v != id*2 {
+			t.Errorf("task %d = %d, want %d", id, v, id*2)
+		}
+	}
+}
+
+func TestStartCtxCancelStopsWorkers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := NewWorkerPool(2)
+	pool.StartCtx(ctx)
+
+	var processed atomic.Int64
+	slow := func(d interface{}) (interface{}, error) {
+		processed.Add(1)
+		time.Sleep(20 * time.Millisecond)
+		return d, nil
+	}
+	const batch = 100
+	submitErr := make(chan error, 1)
+	go func() {
+		var err error
+		for i := 0; i < batch && err == nil; i++ {
+			err = pool.Submit(Task{ID: i, Data: i, Process: slow})
+		}
+		pool.Wait()
+		submitErr <- err
+	}()
+
+	got := 0
+	cancelled := 0
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for res := range pool.Results() {
+			got++
+			if errors.Is(res.Error, context.Canceled) {
+				cancelled++
+			}
+			if got == 4 {
+				cancel()
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("workers did not return after cancel")
+	}
+
+	if err := <-submitErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("Submit after cancel: err = %v, want context.Canceled", err)
+	}
+	// dopo la cancellazione al più un task in esecuzione per worker
+	if n := processed.Load(); n > 4+2 {
+		t.Errorf("processed %d tasks, want at most 6 after cancelling at 4", n)
+	}
+	if got-cancelled != int(processed.Load()) {
+		t.Errorf("results = %d (%d cancelled), processed = %d", got, cancelled, processed.Load())
+	}
+}
+
+func TestStopAfterCancelEmptiesQueued(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	pool := NewWorkerPool(2)
+	pool.StartCtx(ctx)
+	go func() {
+		for range pool.Results() {
+		}
+	}()
+
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	blocking := func(d interface{}) (interface{}, error) {
+		started <- struct{}{}
+		<-release
+		return d, nil
+	}
+	pool.Submit(Task{ID: 0, Process: blocking})
+	pool.Submit(Task{ID: 1, Process: blocking})
+	<-started
+	<-started
+	// riempiono la coda mentre i due worker sono occupati
+	pool.Submit(Task{ID: 2, Process: blocking})
+	pool.Submit(Task{ID: 3, Process: blocking})
+
+	cancel()
+	close(release)
+	if err := pool.Stop(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if s := pool.Stats(); s.Queued != 0 || s.InFlight != 0 {
+		t.Errorf("stats after Stop = %+v, want nothing queued or in flight", s)
+	}
+}
+
+func TestPanicKeepsTaskIDAndWorker(t *testing.T) {
+	// un solo worker: se il panic lo uccidesse, i task successivi resterebbero in coda
+	pool := NewWorkerPool(1)
+	pool.Start()
+	process := func(d interface{}) (interface{}, error) {
+		if d.(int) == 2 {
+			panic("bad input")
+		}
+		return d, nil
+	}
+	go func() {
+		for i := 0; i < 5; i++ {
+			pool.Submit(Task{ID: i, Data: i, Process: process})
+		}
+		pool.Wait()
+	}()
+
+	results := make(map[int]Result)
+	for res := range pool.Results() {
+		results[res.TaskID] = res
+	}
+	if len(results) != 5 {
+		t.Fatalf("got results for %d tasks, want 5: %v", len(results), results)
+	}
+	if err := results[2].Error; err == nil || err.Error() != "panic: bad input" {
+		t.Errorf("task 2 error = %v, want the panic", err)
+	}
+	for _, id := range []int{0, 1, 3, 4} {
+		if res := results[id]; res.Error != nil || res.Value != id {
+			t.Errorf("task %d = %+v", id, res)
+		}
+	}
+	if s := pool.Stats(); s.Completed != 4 || s.Failed != 1 {
+		t.Errorf("stats = %+v, want 4 completed and 1 failed", s)
+	}
+}
+
+func TestGenericPoolSquares(t *testing.T) {
+	pool := NewPool[int, int](3)
+	pool.Start()
+	square := func(n int) (int, error) {
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return n * n, nil
+	}
+	go func() {
+		for i := -1; i < 10; i++ {
+			pool.Submit(PoolTask[int, int]{ID: i, Data: i, Process: square})
+		}
+		pool.Wait()
+	}()
+
+	sum := 0
+	for res := range pool.Results() {
+		if res.TaskID == -1 {
+			if res.Error == nil {
+				t.Error("task -1: want an error")
+			}
+			continue
+		}
+		if res.Value != res.TaskID*res.TaskID {
+			t.Errorf("task %d = %d", res.TaskID, res.Value)
+		}
+		sum += res.Value // int, nessuna type assertion
+	}
+	if sum != 285 {
+		t.Errorf("sum of squares 0..9 = %d, want 285", sum)
+	}
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+	pool := NewPool[int, string](1)
+	pool.MaxRetries = 2
+	var delays []int
+	var mu sync.Mutex
+	pool.Backoff = func(attempt int) time.Duration {
+		mu.Lock()
+		delays = append(delays, attempt)
+		mu.Unlock()
+		return time.Millisecond
+	}
+	pool.Start()
+
+	var calls [3]atomic.Int64
+	flaky := func(id int) (string, error) {
+		// il task 0 riesce al terzo tentativo, l'1 fallisce sempre, il 2 è permanente
+		n := calls[id].Add(1)
+		switch {
+		case id == 0 && n == 3:
+			return "ok", nil
+		case id == 2:
+			return "", retry.Permanent(errors.New("bad request"))
+		}
+		return "", errors.New("transient")
+	}
+	go func() {
+		for i := 0; i < 3; i++ {
+			pool.Submit(PoolTask[int, string]{ID: i, Data: i, Process: flaky})
+		}
+		pool.Wait()
+	}()
+
+	results := make(map[int]PoolResult[string])
+	for res := range pool.Results() {
+		results[res.TaskID] = res
+	}
+	if r := results[0]; r.Error != nil || r.Value != "ok" || r.Attempts != 3 {
+		t.Errorf("flaky task = %+v, want ok after 3 attempts", r)
+	}
+	if r := results[1]; r.Error == nil || r.Attempts != 3 {
+		t.Errorf("failing task = %+v, want an error after 3 attempts", r)
+	}
+	if r := results[2]; !errors.Is(r.Error, retry.ErrPermanent) || r.Attempts != 1 {
+		t.Errorf("permanent task = %+v, want 1 attempt", r)
+	}
+	if len(delays) != 4 {
+		t.Errorf("backoff called %d times (%v), want 4", len(delays), delays)
+	}
+	if s := pool.Stats(); s.Queued != 0 || s.InFlight != 0 || s.Completed != 1 || s.Failed != 2 {
+		t.Errorf("stats = %+v", s)
+	}
+}
+
+func TestRetryDoesNotDeadlockOnFullQueue(t *testing.T) {
+	// un worker e una coda da un posto, sempre piena: i retry passano per la
+	// coda interna e non per tasks
+	pool := NewPool[int, int](1)
+	pool.MaxRetries = 3
+	pool.Start()
+	fail := func(int) (int, error) { return 0, errors.New("transient") }
+	go func() {
+		for i := 0; i < 20; i++ {
+			pool.Submit(PoolTask[int, int]{ID: i, Process: fail})
+		}
+		pool.Wait()
+	}()
+
+	done := make(chan int)
+	go func() {
+		n := 0
+		for res := range pool.Results() {
+			if res.Attempts != 4 {
+				t.Errorf("task %d: %d attempts, want 4", res.TaskID, res.Attempts)
+			}
+			n++
+		}
+		done <- n
+	}()
+	select {
+	case n := <-done:
+		if n != 20 {
+			t.Errorf("got %d results, want 20", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("pool deadlocked with retries and a full queue")
+	}
+}
+
+func TestCollectOrdered(t *testing.T) {
+	pool := NewPool[int, int](4)
+	pool.Start()
+	process := func(n int) (int, error) {
+		// i primi task finiscono per ultimi
+		time.Sleep(time.Duration(10-n) * time.Millisecond)
+		switch n {
+		case 3:
+			return 0, errors.New("boom")
+		case 7:
+			panic("bad")
+		}
+		return n * 10, nil
+	}
+	go func() {
+		for i := 0; i < 10; i++ {
+			pool.Submit(PoolTask[int, int]{ID: i, Data: i, Process: process})
+		}
+		pool.Wait()
+	}()
+
+	results := pool.CollectOrdered()
+	if len(results) != 10 {
+		t.Fatalf("got %d results, want 10", len(results))
+	}
+	for i, r := range results {
+		if r.TaskID != i {
+			t.Fatalf("results[%d].TaskID = %d, want submission order", i, r.TaskID)
+		}
+		if failed := r.Error != nil; failed != (i == 3 || i == 7) {
+			t.Errorf("task %d: err = %v", i, r.Error)
+		}
+	}
+}
+
+func TestStopWithTimeout(t *testing.T) {
+	pool := NewPool[time.Duration, time.Duration](2)
+	pool.Start()
+	sleep := func(d time.Duration) (time.Duration, error) {
+		time.Sleep(d)
+		return d, nil
+	}
+	for i, d := range []time.Duration{time.Millisecond, 300 * time.Millisecond, time.Millisecond} {
+		if err := pool.Submit(PoolTask[time.Duration, time.Duration]{ID: i, Data: d, Process: sleep}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := make(chan PoolResult[time.Duration], 3)
+	go func() {
+		for res := range pool.Results() {
+			results <- res
+		}
+		close(results)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := pool.Stop(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Stop = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Stop returned after %s, past its deadline", elapsed)
+	}
+	if err := pool.Submit(PoolTask[time.Duration, time.Duration]{ID: 9, Process: sleep}); !errors.Is(err, ErrPoolStopped) {
+		t.Errorf("Submit after Stop = %v, want ErrPoolStopped", err)
+	}
+
+	// i task veloci sono finiti, quello lento finisce dopo e Results si chiude
+	var ids []int
+	for res := range results {
+		ids = append(ids, res.TaskID)
+	}
+	sort.Ints(ids)
+	if !reflect.DeepEqual(ids, []int{0, 1, 2}) {
+		t.Errorf("completed tasks = %v, want all three", ids)
+	}
+	if err := pool.Stop(context.Background()); err != nil {
+		t.Errorf("second Stop = %v, want nil once drained", err)
+	}
+}
+
+func TestResizeKeepsEveryTask(t *testing.T) {
+	pool := NewPool[int, int](1)
+	pool.Start()
+
+	var running, peak atomic.Int64
+	process := func(n int) (int, error) {
+		cur := running.Add(1)
+		for p := peak.Load(); cur > p && !peak.CompareAndSwap(p, cur); p = peak.Load() {
+		}
+		time.Sleep(2 * time.Millisecond)
+		running.Add(-1)
+		return n, nil
+	}
+	const total = 300
+	go func() {
+		for i := 0; i < total; i++ {
+			switch i {
+			case 50:
+				pool.Resize(8)
+			case 150:
+				pool.Resize(2)
+			case 250:
+				pool.Resize(4)
+			}
+			pool.Submit(PoolTask[int, int]{ID: i, Data: i, Process: process})
+		}
+		pool.Wait()
+	}()
+
+	seen := make(map[int]int)
+	for res := range pool.Results() {
+		seen[res.TaskID]++
+	}
+	if len(seen) != total {
+		t.Fatalf("%d distinct tasks completed, want %d", len(seen), total)
+	}
+	for id, n := range seen {
+		if n != 1 {
+			t.Errorf("task %d completed %d times", id, n)
+		}
+	}
+	if p := peak.Load(); p < 2 || p > 8 {
+		t.Errorf("peak concurrency = %d, want between 2 and 8", p)
+	}
+	if w := pool.Stats().Workers; w != 4 {
+		t.Errorf("Workers = %d after the last Resize, want 4", w)
+	}
+}
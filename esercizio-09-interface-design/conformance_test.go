@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"golang-course-ex-Mauro/internal/retry"
+)
+
+// RunStorageConformance verifica il contratto comune di Storage. factory deve
+// ritornare un'istanza nuova e vuota ad ogni chiamata.
+func RunStorageConformance(t *testing.T, factory func() Storage) {
+	t.Helper()
+
+	t.Run("PutGetRoundTrip", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		if err := s.Put("k", []byte("v1")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Put("k", []byte("v2")); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Get("k")
+		if err != nil || string(got) != "v2" {
+			t.Fatalf("Get = %q, %v; want \"v2\"", got, err)
+		}
+	})
+
+	t.Run("GetMissing", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		if _, err := s.Get("missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get missing: err = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		if err := s.Delete("missing"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Delete missing: err = %v, want ErrNotFound", err)
+		}
+		if err := s.Put("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("k"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Get("k"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Get after Delete: err = %v, want ErrNotFound", err)
+		}
+	})
+
+	t.Run("ListSorted", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		keys, err := s.List()
+		if err != nil || len(keys) != 0 {
+			t.Fatalf("List on empty storage = %v, %v", keys, err)
+		}
+		for _, k := range []string{"b", "c", "a"} {
+			if err := s.Put(k, []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		keys, err = s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"a", "b", "c"}; !reflect.DeepEqual(keys, want) {
+			t.Fatalf("List = %v, want %v", keys, want)
+		}
+	})
+
+	t.Run("DefensiveCopy", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		value := []byte("abc")
+		if err := s.Put("k", value); err != nil {
+			t.Fatal(err)
+		}
+		value[0] = 'X'
+		got, err := s.Get("k")
+		if err != nil || string(got) != "abc" {
+			t.Fatalf("Put did not copy its input: Get = %q, %v", got, err)
+		}
+		got[0] = 'Y'
+		again, _ := s.Get("k")
+		if string(again) != "abc" {
+			t.Fatalf("Get returned internal state: %q", again)
+		}
+	})
+
+	t.Run("CancelledContext", func(t *testing.T) {
+		s := factory()
+		defer s.Close()
+		if err := s.Put("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := s.PutCtx(ctx, "k", []byte("new")); !errors.Is(err, context.Canceled) {
+			t.Errorf("PutCtx: %v", err)
+		}
+		if _, err := s.GetCtx(ctx, "k"); !errors.Is(err, context.Canceled) {
+			t.Errorf("GetCtx: %v", err)
+		}
+		if err := s.DeleteCtx(ctx, "k"); !errors.Is(err, context.Canceled) {
+			t.Errorf("DeleteCtx: %v", err)
+		}
+		if _, err := s.ListCtx(ctx); !errors.Is(err, context.Canceled) {
+			t.Errorf("ListCtx: %v", err)
+		}
+		// nessuna delle operazioni annullate deve aver toccato i dati
+		got, err := s.Get("k")
+		if err != nil || string(got) != "v" {
+			t.Fatalf("Get after cancelled ops = %q, %v; want \"v\"", got, err)
+		}
+	})
+
+	t.Run("ClosedStorage", func(t *testing.T) {
+		s := factory()
+		if err := s.Put("k", []byte("v")); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatalf("second Close: %v", err)
+		}
+		if _, err := s.Get("k"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Get after Close: %v", err)
+		}
+		if err := s.Put("k", []byte("v")); !errors.Is(err, ErrClosed) {
+			t.Errorf("Put after Close: %v", err)
+		}
+		if err := s.Delete("k"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Delete after Close: %v", err)
+		}
+		if _, err := s.List(); !errors.Is(err, ErrClosed) {
+			t.Errorf("List after Close: %v", err)
+		}
+	})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	RunStorageConformance(t, func() Storage { return NewMemoryStorage() })
+}
+
+func newTestFileStorage(t *testing.T) *FileStorage {
+	t.Helper()
+	fs, err := NewFileStorage(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fs
+}
+
+func TestFileStorageConformance(t *testing.T) {
+	RunStorageConformance(t, func() Storage { return newTestFileStorage(t) })
+}
+
+func TestIndexedFileStorageConformance(t *testing.T) {
+	RunStorageConformance(t, func() Storage {
+		fs := newTestFileStorage(t)
+		if err := fs.EnableIndex(); err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
+
+func TestCachedStorageConformance(t *testing.T) {
+	RunStorageConformance(t, func() Storage { return NewCachedStorage(newTestFileStorage(t)) })
+}
+
+func TestRetryingStorageConformance(t *testing.T) {
+	RunStorageConformance(t, func() Storage {
+		return NewRetryingStorage(NewMemoryStorage(), retry.RetryPolicy{MaxAttempts: 3}, nil)
+	})
+}
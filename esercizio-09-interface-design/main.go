@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
@@ -9,15 +12,26 @@ import (
 	"sort"
 	"strings"
 	"sync"
+
+	"golang-course-ex-Mauro/internal/retry"
 )
 
-var ErrNotFound = errors.New("key not found")
+var (
+	ErrNotFound = errors.New("key not found")
+	ErrClosed   = errors.New("storage closed")
+)
 
+// Le varianti *Ctx ritornano ctx.Err() senza fare I/O se il context è già
+// cancellato; quelle senza context equivalgono a context.Background().
 type Storage interface {
 	Get(key string) ([]byte, error)
 	Put(key string, value []byte) error
 	Delete(key string) error
 	List() ([]string, error)
+	GetCtx(ctx context.Context, key string) ([]byte, error)
+	PutCtx(ctx context.Context, key string, value []byte) error
+	DeleteCtx(ctx context.Context, key string) error
+	ListCtx(ctx context.Context) ([]string, error)
 	Close() error
 }
 
@@ -28,16 +42,32 @@ type MemoryStorage struct {
 }
 
 type FileStorage struct {
-	baseDir string
-	closed  bool
-	mu      sync.RWMutex
+	baseDir    string
+	encoder    KeyEncoder
+	maxNameLen int
+	closed     bool
+	mu         sync.RWMutex
+	// index, se non nil, contiene tutte le chiavi presenti su disco: List lo
+	// usa al posto di ReadDir. Protetto da mu come il resto dello stato.
+	index map[string]struct{}
+	// writeFile è os.WriteFile; sostituibile nei test per simulare scritture parziali.
+	writeFile func(name string, data []byte, perm os.FileMode) error
 }
 
 func NewFileStorage(baseDir string) (*FileStorage, error) {
+	return NewFileStorageWithEncoder(baseDir, Base64Keys)
+}
+
+func NewFileStorageWithEncoder(baseDir string, encoder KeyEncoder) (*FileStorage, error) {
 	if err := os.MkdirAll(baseDir, 0o755); err != nil {
 		return nil, err
 	}
-	return &FileStorage{baseDir: baseDir}, nil
+	f := &FileStorage{baseDir: baseDir, encoder: encoder, maxNameLen: defaultMaxNameLen, writeFile: os.WriteFile}
+	// eventuali .tmp rimasti da un crash precedente sono spazzatura
+	if err := f.Cleanup(); err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
 type CachedStorage struct {
@@ -53,20 +83,149 @@ func NewCachedStorage(backend Storage) *CachedStorage {
 	}
 }
 
+// KeyEncoder trasforma una chiave in un nome di file sicuro e viceversa.
+// Encoder diversi devono produrre nomi disgiunti (Decode di un encoder fallisce
+// sui nomi dell'altro), così MigrateKeys distingue i file già migrati.
+type KeyEncoder interface {
+	Encode(key string) string
+	Decode(name string) (string, error)
+}
+
+var (
+	Base64Keys KeyEncoder = base64KeyEncoder{}
+	HexKeys    KeyEncoder = hexKeyEncoder{}
+)
+
+type base64KeyEncoder struct{}
+
+func (base64KeyEncoder) Encode(key string) string { return encodeKey(key) }
+
+func (base64KeyEncoder) Decode(name string) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(name)
+	return string(raw), err
+}
+
+type hexKeyEncoder struct{}
+
+// il prefisso "hex." non è base64url valido: i nomi non si confondono con Base64Keys
+const hexKeyPrefix = "hex."
+
+func (hexKeyEncoder) Encode(key string) string { return hexKeyPrefix + hex.EncodeToString([]byte(key)) }
+
+func (hexKeyEncoder) Decode(name string) (string, error) {
+	encoded, ok := strings.CutPrefix(name, hexKeyPrefix)
+	if !ok {
+		return "", fmt.Errorf("not a hex key: %q", name)
+	}
+	raw, err := hex.DecodeString(encoded)
+	return string(raw), err
+}
+
 func encodeKey(key string) string {
 	return base64.RawURLEncoding.EncodeToString([]byte(key))
 }
 
+// defaultMaxNameLen è il limite tipico di un nome di file (ext4, APFS, NTFS).
+const defaultMaxNameLen = 255
+
+// hashedKeyPrefix marca i file il cui nome è l'hash della chiave. Il "." lo
+// tiene fuori dai nomi prodotti dagli encoder.
+const hashedKeyPrefix = "sha256."
+
+// SetMaxNameLen imposta la lunghezza massima del nome di file oltre la quale
+// la chiave viene salvata sotto il suo hash sha256.
+func (f *FileStorage) SetMaxNameLen(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.maxNameLen = n
+}
+
+// fileStem ritorna il nome del file senza estensione. Le chiavi la cui codifica
+// supererebbe maxNameLen usano l'hash sha256: la chiave originale è salvata nel
+// file sidecar .key accanto al .dat, così List può ricostruirla.
+func (f *FileStorage) fileStem(key string) (stem string, hashed bool) {
+	stem = f.encoder.Encode(key)
+	if len(stem)+len(".dat.tmp") <= f.maxNameLen {
+		return stem, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	return hashedKeyPrefix + hex.EncodeToString(sum[:]), true
+}
+
 func (f *FileStorage) pathForKey(key string) string {
-	return filepath.Join(f.baseDir, encodeKey(key)+".dat")
+	stem, _ := f.fileStem(key)
+	return filepath.Join(f.baseDir, stem+".dat")
+}
+
+// MigrateKeys rinomina i file di baseDir dalla codifica from alla codifica to.
+// I nomi seguono la stessa regola di fileStem con il limite predefinito: una
+// chiave troppo lunga per to finisce sotto il suo hash con il sidecar .key,
+// e un file già sotto hash torna al nome codificato se con to ci sta.
+// Ogni file viene spostato con os.Rename, atomico nella stessa directory: il
+// vecchio nome sparisce solo quando il nuovo è al suo posto. I nomi che from
+// non sa decodificare (es. già migrati) vengono saltati, quindi la migrazione
+// è idempotente e può essere rilanciata se interrotta.
+// La directory non deve essere in uso da un FileStorage aperto.
+func MigrateKeys(baseDir string, from, to KeyEncoder) error {
+	entries, err := os.ReadDir(baseDir)
+	if err != nil {
+		return err
+	}
+	dst := &FileStorage{baseDir: baseDir, encoder: to, maxNameLen: defaultMaxNameLen, writeFile: os.WriteFile}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".dat" {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".dat")
+		oldHashed := strings.HasPrefix(name, hashedKeyPrefix)
+		var key string
+		if oldHashed {
+			raw, err := os.ReadFile(filepath.Join(baseDir, name+".key"))
+			if err != nil {
+				continue
+			}
+			key = string(raw)
+		} else if key, err = from.Decode(name); err != nil {
+			continue
+		}
+
+		newName, hashed := dst.fileStem(key)
+		if newName == name {
+			continue
+		}
+		// come in Put, il sidecar va scritto prima dei dati
+		if hashed {
+			if err := dst.writeAtomic(filepath.Join(baseDir, newName+".key"), []byte(key)); err != nil {
+				return fmt.Errorf("migrate %q: %w", key, err)
+			}
+		}
+		oldPath := filepath.Join(baseDir, entry.Name())
+		newPath := filepath.Join(baseDir, newName+".dat")
+		if err := os.Rename(oldPath, newPath); err != nil {
+			return fmt.Errorf("migrate %q: %w", key, err)
+		}
+		if oldHashed {
+			if err := os.Remove(filepath.Join(baseDir, name+".key")); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("migrate %q: %w", key, err)
+			}
+		}
+	}
+	return nil
 }
 
 func (m *MemoryStorage) Get(key string) ([]byte, error) {
+	return m.GetCtx(context.Background(), key)
+}
+
+func (m *MemoryStorage) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	if m.closed {
-		return nil, errors.New("storage closed")
+		return nil, ErrClosed
 	}
 
 	value, ok := m.data[key]
@@ -80,11 +239,18 @@ func (m *MemoryStorage) Get(key string) ([]byte, error) {
 }
 
 func (m *MemoryStorage) Put(key string, value []byte) error {
+	return m.PutCtx(context.Background(), key, value)
+}
+
+func (m *MemoryStorage) PutCtx(ctx context.Context, key string, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if m.closed {
-		return errors.New("storage closed")
+		return ErrClosed
 	}
 
 	m.data[key] = append([]byte(nil), value...)
@@ -92,11 +258,18 @@ func (m *MemoryStorage) Put(key string, value []byte) error {
 }
 
 func (m *MemoryStorage) Delete(key string) error {
+	return m.DeleteCtx(context.Background(), key)
+}
+
+func (m *MemoryStorage) DeleteCtx(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	if m.closed {
-		return errors.New("storage closed")
+		return ErrClosed
 	}
 
 	if _, ok := m.data[key]; !ok {
@@ -107,11 +280,18 @@ func (m *MemoryStorage) Delete(key string) error {
 }
 
 func (m *MemoryStorage) List() ([]string, error) {
+	return m.ListCtx(context.Background())
+}
+
+func (m *MemoryStorage) ListCtx(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
 	if m.closed {
-		return nil, errors.New("storage closed")
+		return nil, ErrClosed
 	}
 
 	keys := make([]string, 0, len(m.data))
@@ -122,6 +302,25 @@ func (m *MemoryStorage) List() ([]string, error) {
 	return keys, nil
 }
 
+// ForEach chiama fn per ogni entry tenendo il read lock, così la vista è
+// consistente senza materializzare tutte le chiavi. Si ferma se fn ritorna false.
+// fn non deve richiamare metodi dello storage: Put/Delete/Close andrebbero in deadlock.
+func (m *MemoryStorage) ForEach(fn func(key string, value []byte) bool) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	for key, value := range m.data {
+		if !fn(key, append([]byte(nil), value...)) {
+			break
+		}
+	}
+	return nil
+}
+
 func (m *MemoryStorage) Close() error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -139,31 +338,87 @@ func NewMemoryStorage() *MemoryStorage {
 	}
 }
 
+// Put e Delete tengono il lock in scrittura per tutta l'operazione: con
+// l'indice attivo file e indice devono cambiare insieme, altrimenti una Put e
+// una Delete concorrenti sulla stessa chiave potrebbero lasciarli diversi.
 func (f *FileStorage) Put(key string, value []byte) error {
-	f.mu.RLock()
+	return f.PutCtx(context.Background(), key, value)
+}
+
+func (f *FileStorage) PutCtx(ctx context.Context, key string, value []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.closed {
-		f.mu.RUnlock()
-		return errors.New("storage closed")
+		return ErrClosed
 	}
-	f.mu.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stem, hashed := f.fileStem(key)
 
-	finalPath := f.pathForKey(key)
+	if hashed {
+		// il sidecar va scritto prima dei dati: un .dat senza .key sarebbe irrecuperabile
+		if err := f.writeAtomic(filepath.Join(f.baseDir, stem+".key"), []byte(key)); err != nil {
+			return err
+		}
+	}
+	if err := f.writeAtomic(filepath.Join(f.baseDir, stem+".dat"), value); err != nil {
+		return err
+	}
+	if f.index != nil {
+		f.index[key] = struct{}{}
+	}
+	return nil
+}
+
+func (f *FileStorage) writeAtomic(finalPath string, data []byte) error {
 	tmpPath := finalPath + ".tmp"
 
-	if err := os.WriteFile(tmpPath, append([]byte(nil), value...), 0o644); err != nil {
+	// se la scrittura fallisce a metà (es. disco pieno) il .tmp va rimosso,
+	// altrimenti resta orfano nella directory
+	if err := f.writeFile(tmpPath, append([]byte(nil), data...), 0o644); err != nil {
+		os.Remove(tmpPath)
 		return err
 	}
-	return os.Rename(tmpPath, finalPath)
+	if err := os.Rename(tmpPath, finalPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Cleanup rimuove i file .tmp lasciati da Put interrotte.
+func (f *FileStorage) Cleanup() error {
+	entries, err := os.ReadDir(f.baseDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".tmp" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(f.baseDir, entry.Name())); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
 }
 
 func (f *FileStorage) Get(key string) ([]byte, error) {
+	return f.GetCtx(context.Background(), key)
+}
+
+func (f *FileStorage) GetCtx(ctx context.Context, key string) ([]byte, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 
 	if f.closed {
-		return nil, errors.New("storage closed")
+		return nil, ErrClosed
 	}
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	data, err := os.ReadFile(f.pathForKey(key))
 	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
@@ -176,6 +431,13 @@ func (f *FileStorage) Get(key string) ([]byte, error) {
 }
 
 func (c *CachedStorage) Get(key string) ([]byte, error) {
+	return c.GetCtx(context.Background(), key)
+}
+
+func (c *CachedStorage) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	c.mu.RLock()
 	if value, ok := c.cache[key]; ok {
 		copied := append([]byte(nil), value...)
@@ -184,7 +446,7 @@ func (c *CachedStorage) Get(key string) ([]byte, error) {
 	}
 	c.mu.RUnlock()
 
-	value, err := c.backend.Get(key)
+	value, err := c.backend.GetCtx(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -195,26 +457,92 @@ func (c *CachedStorage) Get(key string) ([]byte, error) {
 }
 
 func (f *FileStorage) Delete(key string) error {
-	f.mu.RLock()
-	defer f.mu.RUnlock()
+	return f.DeleteCtx(context.Background(), key)
+}
+
+func (f *FileStorage) DeleteCtx(ctx context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	if f.closed {
-		return errors.New("storage closed")
+		return ErrClosed
 	}
 
-	err := os.Remove(f.pathForKey(key))
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	stem, hashed := f.fileStem(key)
+	err := os.Remove(filepath.Join(f.baseDir, stem+".dat"))
 	if errors.Is(err, os.ErrNotExist) {
 		return ErrNotFound
 	}
+	if err != nil {
+		return err
+	}
+	// il .dat non c'è più: la chiave esce dall'indice anche se il sidecar resta
+	if f.index != nil {
+		delete(f.index, key)
+	}
+	if hashed {
+		err = os.Remove(filepath.Join(f.baseDir, stem+".key"))
+	}
 	return err
 }
 
 func (f *FileStorage) List() ([]string, error) {
+	return f.ListCtx(context.Background())
+}
+
+func (f *FileStorage) ListCtx(ctx context.Context) ([]string, error) {
 	f.mu.RLock()
 	defer f.mu.RUnlock()
 	if f.closed {
-		return nil, errors.New("storage closed")
+		return nil, ErrClosed
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if f.index != nil {
+		keys := make([]string, 0, len(f.index))
+		for key := range f.index {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		return keys, nil
+	}
+	return f.scanKeys()
+}
+
+// EnableIndex legge la directory una volta e da lì in poi List risponde dalla
+// memoria. Richiamarla ricostruisce l'indice, utile se la directory è stata
+// modificata da fuori (es. MigrateKeys o un altro processo).
+func (f *FileStorage) EnableIndex() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return ErrClosed
+	}
+
+	keys, err := f.scanKeys()
+	if err != nil {
+		return err
+	}
+	f.index = make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		f.index[key] = struct{}{}
+	}
+	return nil
+}
+
+// InvalidateIndex scarta l'indice: List torna a leggere il disco.
+func (f *FileStorage) InvalidateIndex() {
+	f.mu.Lock()
+	f.index = nil
+	f.mu.Unlock()
+}
 
+// scanKeys ricava le chiavi dai nomi dei file. Va chiamata con mu acquisito.
+func (f *FileStorage) scanKeys() ([]string, error) {
 	entries, err := os.ReadDir(f.baseDir)
 	if err != nil {
 		return nil, err
@@ -226,11 +554,19 @@ func (f *FileStorage) List() ([]string, error) {
 			continue
 		}
 		encoded := strings.TrimSuffix(entry.Name(), ".dat")
-		raw, err := base64.RawURLEncoding.DecodeString(encoded)
+		if strings.HasPrefix(encoded, hashedKeyPrefix) {
+			raw, err := os.ReadFile(filepath.Join(f.baseDir, encoded+".key"))
+			if err != nil {
+				continue
+			}
+			keys = append(keys, string(raw))
+			continue
+		}
+		key, err := f.encoder.Decode(encoded)
 		if err != nil {
 			continue
 		}
-		keys = append(keys, string(raw))
+		keys = append(keys, key)
 	}
 	sort.Strings(keys)
 	return keys, nil
@@ -240,9 +576,108 @@ func (f *FileStorage) Close() error {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	f.closed = true
+	f.index = nil
 	return nil
 }
 
+// RetryingStorage ritenta Get/Put/Delete/List sul backend quando isTransient
+// classifica l'errore come temporaneo. ErrNotFound, ErrClosed e gli errori di
+// context non vengono mai ritentati.
+type RetryingStorage struct {
+	backend     Storage
+	policy      retry.RetryPolicy
+	isTransient func(error) bool
+}
+
+// NewRetryingStorage avvolge backend. Con isTransient nil ogni altro errore
+// è considerato temporaneo.
+func NewRetryingStorage(backend Storage, policy retry.RetryPolicy, isTransient func(error) bool) *RetryingStorage {
+	if isTransient == nil {
+		isTransient = func(error) bool { return true }
+	}
+	return &RetryingStorage{backend: backend, policy: policy, isTransient: isTransient}
+}
+
+func (r *RetryingStorage) retryable(err error) bool {
+	switch {
+	case errors.Is(err, ErrNotFound), errors.Is(err, ErrClosed),
+		errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	}
+	return r.isTransient(err)
+}
+
+// do esegue fn con la policy e ritorna l'errore del backend così com'è,
+// senza il wrapper di retry.Permanent.
+func (r *RetryingStorage) do(ctx context.Context, fn func() error) error {
+	var last error
+	err := retry.Do(ctx, r.policy, func() error {
+		last = fn()
+		if last != nil && !r.retryable(last) {
+			return retry.Permanent(last)
+		}
+		return last
+	})
+	if errors.Is(err, retry.ErrPermanent) {
+		return last
+	}
+	return err
+}
+
+func (r *RetryingStorage) Get(key string) ([]byte, error) {
+	return r.GetCtx(context.Background(), key)
+}
+
+func (r *RetryingStorage) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	var value []byte
+	err := r.do(ctx, func() error {
+		var err error
+		value, err = r.backend.GetCtx(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (r *RetryingStorage) Put(key string, value []byte) error {
+	return r.PutCtx(context.Background(), key, value)
+}
+
+func (r *RetryingStorage) PutCtx(ctx context.Context, key string, value []byte) error {
+	return r.do(ctx, func() error { return r.backend.PutCtx(ctx, key, value) })
+}
+
+func (r *RetryingStorage) Delete(key string) error {
+	return r.DeleteCtx(context.Background(), key)
+}
+
+func (r *RetryingStorage) DeleteCtx(ctx context.Context, key string) error {
+	return r.do(ctx, func() error { return r.backend.DeleteCtx(ctx, key) })
+}
+
+func (r *RetryingStorage) List() ([]string, error) {
+	return r.ListCtx(context.Background())
+}
+
+func (r *RetryingStorage) ListCtx(ctx context.Context) ([]string, error) {
+	var keys []string
+	err := r.do(ctx, func() error {
+		var err error
+		keys, err = r.backend.ListCtx(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *RetryingStorage) Close() error {
+	return r.backend.Close()
+}
+
 func createStorage(storageType string) (Storage, error) {
 	switch storageType {
 	case "memory":
@@ -261,7 +696,11 @@ func createStorage(storageType string) (Storage, error) {
 }
 
 func (c *CachedStorage) Put(key string, value []byte) error {
-	if err := c.backend.Put(key, value); err != nil {
+	return c.PutCtx(context.Background(), key, value)
+}
+
+func (c *CachedStorage) PutCtx(ctx context.Context, key string, value []byte) error {
+	if err := c.backend.PutCtx(ctx, key, value); err != nil {
 		return err
 	}
 	c.mu.Lock()
@@ -271,7 +710,11 @@ func (c *CachedStorage) Put(key string, value []byte) error {
 }
 
 func (c *CachedStorage) Delete(key string) error {
-	if err := c.backend.Delete(key); err != nil {
+	return c.DeleteCtx(context.Background(), key)
+}
+
+func (c *CachedStorage) DeleteCtx(ctx context.Context, key string) error {
+	if err := c.backend.DeleteCtx(ctx, key); err != nil {
 		return err
 	}
 	c.mu.Lock()
@@ -281,7 +724,11 @@ func (c *CachedStorage) Delete(key string) error {
 }
 
 func (c *CachedStorage) List() ([]string, error) {
-	return c.backend.List()
+	return c.ListCtx(context.Background())
+}
+
+func (c *CachedStorage) ListCtx(ctx context.Context) ([]string, error) {
+	return c.backend.ListCtx(ctx)
 }
 
 func (c *CachedStorage) Close() error {
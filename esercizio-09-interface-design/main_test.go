@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang-course-ex-Mauro/internal/retry"
+)
+
+func TestMemoryStorageForEach(t *testing.T) {
+	m := NewMemoryStorage()
+	for i := 0; i < 5; i++ {
+		if err := m.Put(fmt.Sprintf("key:%d", i), []byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	seen := map[string]bool{}
+	err := m.ForEach(func(key string, value []byte) bool {
+		seen[key] = true
+		value[0] = 0xFF // non deve toccare lo stato interno
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 5 {
+		t.Fatalf("visited %d entries, want 5", len(seen))
+	}
+	if v, _ := m.Get("key:3"); v[0] != 3 {
+		t.Fatalf("ForEach leaked internal slice: got %v", v)
+	}
+
+	visited := 0
+	err = m.ForEach(func(key string, value []byte) bool {
+		visited++
+		return visited < 2
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if visited != 2 {
+		t.Fatalf("early stop: visited %d entries, want 2", visited)
+	}
+}
+
+func tmpFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+func TestFileStoragePutCleansUpPartialWrite(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errDiskFull := errors.New("no space left on device")
+	fs.writeFile = func(name string, data []byte, perm os.FileMode) error {
+		// scrive metà dei dati e poi fallisce
+		os.WriteFile(name, data[:len(data)/2], perm)
+		return errDiskFull
+	}
+
+	if err := fs.Put("k", []byte("some value")); !errors.Is(err, errDiskFull) {
+		t.Fatalf("Put err = %v, want %v", err, errDiskFull)
+	}
+	if left := tmpFiles(t, dir); len(left) != 0 {
+		t.Fatalf("orphan temp files: %v", left)
+	}
+	if _, err := fs.Get("k"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after failed Put: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestFileStorageCleanupRemovesStaleTmp(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, encodeKey("k")+".dat.tmp")
+	if err := os.WriteFile(stale, []byte("half"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewFileStorage(dir); err != nil {
+		t.Fatal(err)
+	}
+	if left := tmpFiles(t, dir); len(left) != 0 {
+		t.Fatalf("stale temp files not purged: %v", left)
+	}
+}
+
+func TestMigrateKeys(t *testing.T) {
+	dir := t.TempDir()
+	old, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// la chiave da 150 byte sta nel limite in base64 ma non in hex; quella
+	// da 200 va sotto hash con entrambe le codifiche
+	medium, long := strings.Repeat("m", 150), strings.Repeat("l", 200)
+	want := map[string]string{"user:1": "alice", "user:2": "bob", "città/è": "roma", medium: "medio", long: "lungo"}
+	for k, v := range want {
+		if err := old.Put(k, []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old.Close()
+
+	// due run: la seconda deve essere un no-op
+	for i := 0; i < 2; i++ {
+		if err := MigrateKeys(dir, Base64Keys, HexKeys); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+
+	migrated, err := NewFileStorageWithEncoder(dir, HexKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := migrated.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != len(want) {
+		t.Fatalf("keys after migration = %v", keys)
+	}
+	for k, v := range want {
+		got, err := migrated.Get(k)
+		if err != nil || string(got) != v {
+			t.Errorf("Get(%q) = %q, %v; want %q", k, got, err, v)
+		}
+	}
+	migrated.Close()
+
+	// al ritorno la chiave media esce dall'hash e il suo sidecar sparisce
+	if err := MigrateKeys(dir, HexKeys, Base64Keys); err != nil {
+		t.Fatal(err)
+	}
+	back, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range want {
+		got, err := back.Get(k)
+		if err != nil || string(got) != v {
+			t.Errorf("after migrating back: Get(%q) = %q, %v; want %q", k, got, err, v)
+		}
+	}
+	sidecars, _ := filepath.Glob(filepath.Join(dir, "*.key"))
+	if len(sidecars) != 1 {
+		t.Errorf("sidecars after migrating back = %v, want only the long key's", sidecars)
+	}
+}
+
+// Da eseguire con -race: Put/Get/Delete/List/ForEach concorrenti con un Close a metà.
+func TestMemoryStorageConcurrentStress(t *testing.T) {
+	m := NewMemoryStorage()
+	const workers = 32
+	const ops = 500
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < ops; i++ {
+				key := fmt.Sprintf("k%d", (w+i)%16)
+				value := []byte(key) // il valore codifica la chiave: una lettura "strappata" si vede
+				var err error
+				switch i % 5 {
+				case 0:
+					err = m.Put(key, value)
+				case 1:
+					var got []byte
+					got, err = m.Get(key)
+					if err == nil && string(got) != key {
+						t.Errorf("torn read: Get(%q) = %q", key, got)
+					}
+				case 2:
+					err = m.Delete(key)
+				case 3:
+					_, err = m.List()
+				case 4:
+					err = m.ForEach(func(k string, v []byte) bool {
+						if string(v) != k {
+							t.Errorf("torn read in ForEach: %q = %q", k, v)
+						}
+						return true
+					})
+				}
+				if err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrClosed) {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		}(w)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-start
+		m.Close()
+	}()
+	close(start)
+	wg.Wait()
+
+	if err := m.Put("k", nil); !errors.Is(err, ErrClosed) {
+		t.Errorf("Put after Close: %v", err)
+	}
+	if _, err := m.Get("k"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Get after Close: %v", err)
+	}
+	if err := m.Delete("k"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Delete after Close: %v", err)
+	}
+	if _, err := m.List(); !errors.Is(err, ErrClosed) {
+		t.Errorf("List after Close: %v", err)
+	}
+	if err := m.ForEach(func(string, []byte) bool { return true }); !errors.Is(err, ErrClosed) {
+		t.Errorf("ForEach after Close: %v", err)
+	}
+}
+
+func TestFileStorageLongKey(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	longKey := "doc:" + strings.Repeat("x", 2000)
+	if err := fs.Put(longKey, []byte("long")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Put("short", []byte("s")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := fs.Get(longKey)
+	if err != nil || string(got) != "long" {
+		t.Fatalf("Get(longKey) = %q, %v", got, err)
+	}
+	keys, err := fs.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0] != longKey || keys[1] != "short" {
+		t.Fatalf("List = %d keys, want the long key and \"short\"", len(keys))
+	}
+	if _, err := os.Stat(filepath.Join(dir, encodeKey("short")+".dat")); err != nil {
+		t.Errorf("short key should keep readable name: %v", err)
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if len(e.Name()) > defaultMaxNameLen {
+			t.Errorf("file name too long: %d chars", len(e.Name()))
+		}
+	}
+
+	if err := fs.Delete(longKey); err != nil {
+		t.Fatal(err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, hashedKeyPrefix+"*")); len(matches) != 0 {
+		t.Errorf("hashed files left after Delete: %v", matches)
+	}
+}
+
+func TestFileStorageIndexConsistency(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// chiavi scritte prima di attivare l'indice devono comparire comunque
+	fs.Put("pre", []byte("x"))
+	if err := fs.EnableIndex(); err != nil {
+		t.Fatal(err)
+	}
+
+	longKey := strings.Repeat("k", 500)
+	steps := []func() error{
+		func() error { return fs.Put("a", []byte("1")) },
+		func() error { return fs.Put("b", []byte("2")) },
+		func() error { return fs.Put("a", []byte("3")) }, // sovrascrittura
+		func() error { return fs.Put(longKey, []byte("4")) },
+		func() error { return fs.Delete("b") },
+		func() error { return fs.Delete(longKey) },
+		func() error { return fs.Put("c", []byte("5")) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		indexed, err := fs.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs.mu.RLock()
+		onDisk, err := fs.scanKeys()
+		fs.mu.RUnlock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(onDisk)
+		if !reflect.DeepEqual(indexed, onDisk) {
+			t.Fatalf("step %d: index %v, disk %v", i, indexed, onDisk)
+		}
+	}
+	if err := fs.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Delete(missing) = %v", err)
+	}
+
+	// una modifica esterna si vede solo dopo il rebuild
+	os.WriteFile(filepath.Join(dir, encodeKey("external")+".dat"), []byte("e"), 0o644)
+	if keys, _ := fs.List(); len(keys) != 3 {
+		t.Fatalf("List before rebuild = %v", keys)
+	}
+	if err := fs.EnableIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := fs.List(); len(keys) != 4 {
+		t.Fatalf("List after rebuild = %v", keys)
+	}
+}
+
+func benchmarkFileStorageList(b *testing.B, indexed bool) {
+	fs, err := NewFileStorage(b.TempDir())
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := fs.Put(fmt.Sprintf("key:%04d", i), []byte("v")); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if indexed {
+		if err := fs.EnableIndex(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := fs.List(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFileStorageListDisk(b *testing.B)    { benchmarkFileStorageList(b, false) }
+func BenchmarkFileStorageListIndexed(b *testing.B) { benchmarkFileStorageList(b, true) }
+
+func TestFileStoragePutCtxCancelledSkipsIO(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFileStorage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := 0
+	fs.writeFile = func(name string, data []byte, perm os.FileMode) error {
+		writes++
+		return os.WriteFile(name, data, perm)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fs.PutCtx(ctx, "k", []byte("v")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("PutCtx = %v, want context.Canceled", err)
+	}
+	if writes != 0 {
+		t.Fatalf("writeFile called %d times after cancel", writes)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Fatalf("files created: %v", entries)
+	}
+}
+
+var errTransient = errors.New("temporary network error")
+
+// flakyStorage fallisce le prime failures chiamate a GetCtx/PutCtx con errTransient.
+type flakyStorage struct {
+	*MemoryStorage
+	failures int
+	calls    int
+}
+
+func (f *flakyStorage) fail() error {
+	f.calls++
+	if f.calls <= f.failures {
+		return errTransient
+	}
+	return nil
+}
+
+func (f *flakyStorage) GetCtx(ctx context.Context, key string) ([]byte, error) {
+	if err := f.fail(); err != nil {
+		return nil, err
+	}
+	return f.MemoryStorage.GetCtx(ctx, key)
+}
+
+func (f *flakyStorage) PutCtx(ctx context.Context, key string, value []byte) error {
+	if err := f.fail(); err != nil {
+		return err
+	}
+	return f.MemoryStorage.PutCtx(ctx, key, value)
+}
+
+func isTransient(err error) bool { return errors.Is(err, errTransient) }
+
+func TestRetryingStorageRecoversFromFlakyBackend(t *testing.T) {
+	backend := &flakyStorage{MemoryStorage: NewMemoryStorage(), failures: 2}
+	s := NewRetryingStorage(backend, retry.RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}, isTransient)
+
+	if err := s.Put("k", []byte("v")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if backend.calls != 3 {
+		t.Fatalf("backend calls = %d, want 3 (2 failures + success)", backend.calls)
+	}
+
+	backend.calls, backend.failures = 0, 5
+	if _, err := s.Get("k"); !errors.Is(err, errTransient) {
+		t.Fatalf("Get with exhausted attempts: %v, want errTransient", err)
+	}
+}
+
+func TestRetryingStorageNotFoundIsNotRetried(t *testing.T) {
+	backend := &flakyStorage{MemoryStorage: NewMemoryStorage()}
+	s := NewRetryingStorage(backend, retry.RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour}, isTransient)
+
+	_, err := s.Get("missing")
+	if err != ErrNotFound {
+		t.Fatalf("Get missing = %v, want ErrNotFound unwrapped", err)
+	}
+	if backend.calls != 1 {
+		t.Fatalf("backend calls = %d, want 1", backend.calls)
+	}
+}
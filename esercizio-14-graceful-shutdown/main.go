@@ -1,18 +1,754 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
-func main() {
-	// TODO: Implementare HTTP server con graceful shutdown
+// Metrics tiene in memoria i contatori per path finché non vengono flushati.
+type Metrics struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{counts: make(map[string]int64)}
+}
+
+func (m *Metrics) Inc(name string) {
+	m.mu.Lock()
+	m.counts[name]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) Snapshot() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	snap := make(map[string]int64, len(m.counts))
+	for k, v := range m.counts {
+		snap[k] = v
+	}
+	return snap
+}
+
+// MetricsFlusher scrive lo snapshot delle metriche su w, una riga per contatore.
+type MetricsFlusher struct {
+	metrics *Metrics
+	w       io.Writer
+}
+
+func NewMetricsFlusher(m *Metrics, w io.Writer) *MetricsFlusher {
+	return &MetricsFlusher{metrics: m, w: w}
+}
+
+func (f *MetricsFlusher) Flush() error {
+	snap := f.metrics.Snapshot()
+	names := make([]string, 0, len(snap))
+	for name := range snap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(f.w, "%s %d\n", name, snap[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func countRequests(m *Metrics, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Inc("requests_total")
+		m.Inc("path:" + r.URL.Path)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recoverMiddleware trasforma il panic di un handler in un 500 loggato con il
+// path della richiesta. http.ErrAbortHandler viene rilanciato: è il modo
+// previsto per interrompere una risposta e net/http lo gestisce da sé.
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			log.Printf("panic serving %s: %v", r.URL.Path, v)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeoutMiddleware risponde 503 alle richieste che superano d. Il panic di
+// un handler viene riportato nella goroutine del chiamante, quindi
+// recoverMiddleware va messo all'esterno.
+func timeoutMiddleware(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.TimeoutHandler(next, d, "request timeout")
+	}
+}
+
+// CheckFunc verifica che una dipendenza sia pronta; deve rispettare ctx.
+type CheckFunc func(ctx context.Context) error
+
+type namedCheck struct {
+	name string
+	fn   CheckFunc
+}
+
+// StartupChecks raccoglie i controlli da superare prima di accettare traffico.
+type StartupChecks struct {
+	checks []namedCheck
+}
+
+func (c *StartupChecks) Register(name string, fn CheckFunc) {
+	c.checks = append(c.checks, namedCheck{name: name, fn: fn})
+}
+
+// Run esegue tutti i check in parallelo con una deadline complessiva e
+// ritorna gli errori aggregati; un check ancora in corso alla deadline conta
+// come fallito per timeout.
+func (c *StartupChecks) Run(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	errs := make([]error, len(c.checks))
+	done := make([]chan struct{}, len(c.checks))
+	for i, chk := range c.checks {
+		done[i] = make(chan struct{})
+		go func(i int, chk namedCheck) {
+			defer close(done[i])
+			if err := chk.fn(ctx); err != nil {
+				errs[i] = fmt.Errorf("check %s: %w", chk.name, err)
+			}
+		}(i, chk)
+	}
+
+	var result []error
+	for i, chk := range c.checks {
+		select {
+		case <-done[i]:
+			result = append(result, errs[i])
+		case <-ctx.Done():
+			result = append(result, fmt.Errorf("check %s: %w", chk.name, ctx.Err()))
+		}
+	}
+	return errors.Join(result...)
+}
+
+// httpCheck passa se url risponde con uno status 2xx.
+func httpCheck(url string) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%s: status %d", url, resp.StatusCode)
+		}
+		return nil
+	}
+}
+
+// listenAfterChecks apre il listener su addr solo dopo che tutti i check
+// sono passati, così il server non riceve traffico senza le sue dipendenze.
+func listenAfterChecks(ctx context.Context, checks *StartupChecks, timeout time.Duration, addr string) (net.Listener, error) {
+	if err := checks.Run(ctx, timeout); err != nil {
+		return nil, fmt.Errorf("startup checks failed: %w", err)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// metricsHandler espone lo snapshot corrente nello stesso formato del flush,
+// più il gauge active_requests se active non è nil.
+func metricsHandler(m *Metrics, active *ActiveRequests) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if active != nil {
+			fmt.Fprintf(w, "active_requests %d\n", active.Load())
+		}
+		NewMetricsFlusher(m, w).Flush()
+	})
+}
+
+// ActiveRequests conta le richieste i cui handler non sono ancora tornati.
+// Non passa da Metrics perché è un gauge, non un contatore da flushare.
+type ActiveRequests struct {
+	n atomic.Int64
+}
+
+func (a *ActiveRequests) Load() int64 {
+	return a.n.Load()
+}
+
+func trackActive(a *ActiveRequests, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.n.Add(1)
+		defer a.n.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// logDraining logga ogni every quante richieste sono ancora attive, finché
+// scendono a zero, scade timeout o done viene chiuso.
+func logDraining(a *ActiveRequests, every, timeout time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+	for {
+		n := a.Load()
+		if n == 0 {
+			return
+		}
+		log.Printf("draining: %d active connections", n)
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Readiness dice se il server deve ricevere nuovo traffico. Lo zero value è
+// pronto; un *Readiness nil è sempre pronto e StartShutdown non fa nulla.
+type Readiness struct {
+	// Grace è quanto serveAll aspetta tra StartShutdown e la chiusura dei
+	// listener. Con zero il 503 di /readyz si vede solo sul server admin:
+	// sulla porta dell'app il load balancer troverebbe già connection refused.
+	Grace time.Duration
+
+	shuttingDown atomic.Bool
+}
+
+// StartShutdown fa rispondere 503 a /readyz da subito e per sempre.
+func (r *Readiness) StartShutdown() {
+	if r != nil {
+		r.shuttingDown.Store(true)
+	}
+}
+
+func (r *Readiness) Ready() bool {
+	return r == nil || !r.shuttingDown.Load()
+}
+
+// healthzHandler è la liveness: 200 finché il processo risponde.
+func healthzHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+}
+
+// readyzHandler è la readiness: 503 da quando è iniziato lo shutdown, così il
+// load balancer smette di mandare richieste mentre quelle in corso drenano.
+func readyzHandler(ready *Readiness) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Ready() {
+			http.Error(w, "shutting down", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+}
+
+// namedServer è un server gestito da serveAll; Name compare negli errori.
+type namedServer struct {
+	Name string
+	Srv  *http.Server
+	Ln   net.Listener
+}
+
+// serve è serveAll con un solo server applicativo e nessun admin.
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, timeout time.Duration, flusher *MetricsFlusher) error {
+	return serveAll(ctx, []namedServer{{Name: "app", Srv: srv, Ln: ln}}, nil, timeout, flusher, nil)
+}
+
+// serveAll avvia tutti i server e, quando ctx viene cancellato o uno di loro
+// fallisce, fa lo shutdown graceful dei server applicativi in parallelo.
+// Dopo il loro drain flusha le metriche, così i conteggi finali includono le
+// richieste completate durante lo shutdown, e solo alla fine spegne admin,
+// che resta interrogabile mentre le app drenano. timeout vale per l'intera
+// sequenza; gli errori di tutti i server vengono aggregati. Se ready non è
+// nil viene segnato come in shutdown prima di fermare qualsiasi server, e
+// i listener restano aperti ancora per ready.Grace, fuori da timeout.
+func serveAll(ctx context.Context, apps []namedServer, admin *namedServer, timeout time.Duration, flusher *MetricsFlusher, ready *Readiness) error {
+	all := apps[:len(apps):len(apps)]
+	if admin != nil {
+		all = append(all, *admin)
+	}
+	errCh := make(chan error, len(all))
+	for _, s := range all {
+		go func(s namedServer) {
+			if err := s.Srv.Serve(s.Ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				errCh <- fmt.Errorf("%s: %w", s.Name, err)
+			}
+		}(s)
+	}
+
+	var errs []error
+	select {
+	case err := <-errCh:
+		errs = append(errs, err)
+	case <-ctx.Done():
+	}
+
+	ready.StartShutdown()
+	if ready != nil && ready.Grace > 0 {
+		log.Printf("Not ready, waiting %s before closing listeners...", ready.Grace)
+		time.Sleep(ready.Grace)
+	}
+	log.Println("Shutting down servers...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, s := range apps {
+		wg.Add(1)
+		go func(s namedServer) {
+			defer wg.Done()
+			if err := s.Srv.Shutdown(shutdownCtx); err != nil {
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("shutdown %s: %w", s.Name, err))
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if err := flusher.Flush(); err != nil {
+		errs = append(errs, fmt.Errorf("flush metrics: %w", err))
+	}
+	if admin != nil {
+		if err := admin.Srv.Shutdown(shutdownCtx); err != nil {
+			errs = append(errs, fmt.Errorf("shutdown %s: %w", admin.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateTimeouts rifiuta i timeout non positivi: per http.Server zero vuol
+// dire "nessun limite", ed è raro che sia voluto da flag.
+func validateTimeouts(timeouts map[string]time.Duration) error {
+	names := make([]string, 0, len(timeouts))
+	for name := range timeouts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var errs []error
+	for _, name := range names {
+		if d := timeouts[name]; d <= 0 {
+			errs = append(errs, fmt.Errorf("-%s deve essere positivo, non %s", name, d))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Config raccoglie tutto ciò che serve a New; main la riempie dai flag e,
+// con -config, dal file JSON (vedi loadConfig). Su SIGHUP Reload applica
+// a caldo solo RequestTimeout, DrainLogEvery e LogRequests: gli altri campi
+// sono usati una volta sola all'avvio (listener, http.Server, check) e
+// richiedono un riavvio.
+type Config struct {
+	Addr            string
+	AdminAddr       string // vuoto = nessun server admin
+	ShutdownTimeout time.Duration
+	ShutdownDelay   time.Duration // attesa con /readyz a 503 prima di chiudere i listener
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	RequestTimeout  time.Duration // zero = nessun limite, come per http.Server
+	StartupTimeout  time.Duration
+	DrainLogEvery   time.Duration // intervallo del log "draining" durante lo shutdown; zero = 1s
+	CheckURLs       []string
+	LogRequests     bool      // logga metodo e path di ogni richiesta
+	MetricsOut      io.Writer // destinazione del flush allo shutdown
+}
+
+// Server è il server applicativo con il suo eventuale admin. Si crea con New
+// e si avvia una sola volta con Run.
+type Server struct {
+	cfg        Config // quella di avvio, per i campi non ricaricabili
+	live       atomic.Pointer[Config]
+	reloadMu   sync.Mutex
+	srv        *http.Server
+	admin      *http.Server
+	metrics    *Metrics
+	active     *ActiveRequests
+	ready      *Readiness
+	checks     *StartupChecks
+	listening  chan struct{}
+	listenOnce sync.Once
+	addr       net.Addr
+}
+
+func New(cfg Config) *Server {
+	s := &Server{
+		cfg:       cfg,
+		metrics:   NewMetrics(),
+		active:    &ActiveRequests{},
+		ready:     &Readiness{Grace: cfg.ShutdownDelay},
+		checks:    &StartupChecks{},
+		listening: make(chan struct{}),
+	}
+	if s.cfg.MetricsOut == nil {
+		s.cfg.MetricsOut = os.Stderr
+	}
+	if s.cfg.DrainLogEvery <= 0 {
+		s.cfg.DrainLogEvery = time.Second
+	}
+	live := s.cfg
+	s.live.Store(&live)
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", healthzHandler())
+	mux.Handle("/readyz", readyzHandler(s.ready))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Hello, World!")
 	})
+	// trackActive sta dentro il timeout: conta gli handler ancora in
+	// esecuzione anche dopo che il client ha ricevuto il 503
+	s.srv = &http.Server{
+		Handler:      countRequests(s.metrics, s.logRequests(recoverMiddleware(s.requestTimeout(trackActive(s.active, mux))))),
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+	}
+
+	if cfg.AdminAddr != "" {
+		adminMux := http.NewServeMux()
+		adminMux.Handle("/metrics", metricsHandler(s.metrics, s.active))
+		// admin resta su mentre le app drenano: qui il 503 di /readyz si vede
+		adminMux.Handle("/healthz", healthzHandler())
+		adminMux.Handle("/readyz", readyzHandler(s.ready))
+		s.admin = &http.Server{Handler: adminMux}
+	}
+
+	for _, u := range cfg.CheckURLs {
+		s.checks.Register(u, httpCheck(u))
+	}
+	return s
+}
+
+// current è la configurazione in vigore: ogni richiesta la legge una volta,
+// così un Reload concorrente non la cambia a metà.
+func (s *Server) current() *Config {
+	return s.live.Load()
+}
+
+// requestTimeout è timeoutMiddleware con la durata letta a ogni richiesta.
+func (s *Server) requestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := s.current().RequestTimeout
+		if d <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeoutMiddleware(d)(next).ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.current().LogRequests {
+			log.Printf("%s %s", r.Method, r.URL.Path)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Reload applica i campi ricaricabili di cfg e logga come ignorati quelli
+// che differiscono dall'avvio ma richiedono un riavvio. Le richieste in
+// corso finiscono con la configurazione che avevano letto.
+func (s *Server) Reload(cfg Config) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var ignored []string
+	if cfg.Addr != s.cfg.Addr {
+		ignored = append(ignored, "addr")
+	}
+	if cfg.AdminAddr != s.cfg.AdminAddr {
+		ignored = append(ignored, "admin-addr")
+	}
+	if cfg.ShutdownTimeout != s.cfg.ShutdownTimeout {
+		ignored = append(ignored, "shutdown-timeout")
+	}
+	if cfg.ShutdownDelay != s.cfg.ShutdownDelay {
+		ignored = append(ignored, "shutdown-delay")
+	}
+	if cfg.ReadTimeout != s.cfg.ReadTimeout {
+		ignored = append(ignored, "read-timeout")
+	}
+	if cfg.WriteTimeout != s.cfg.WriteTimeout {
+		ignored = append(ignored, "write-timeout")
+	}
+	if cfg.StartupTimeout != s.cfg.StartupTimeout {
+		ignored = append(ignored, "startup-timeout")
+	}
+	if !slices.Equal(cfg.CheckURLs, s.cfg.CheckURLs) {
+		ignored = append(ignored, "check-url")
+	}
+	for _, name := range ignored {
+		log.Printf("reload: %s needs a restart, ignored", name)
+	}
+
+	next := *s.current()
+	next.RequestTimeout = cfg.RequestTimeout
+	next.LogRequests = cfg.LogRequests
+	if cfg.DrainLogEvery > 0 {
+		next.DrainLogEvery = cfg.DrainLogEvery
+	}
+	s.live.Store(&next)
+	log.Printf("reload: request-timeout=%s drain-log-every=%s log-requests=%t",
+		next.RequestTimeout, next.DrainLogEvery, next.LogRequests)
+}
+
+// Listening viene chiuso quando Run ha aperto i listener o ha rinunciato a
+// farlo; da lì Addr riporta l'indirizzo effettivo, utile con Addr ":0".
+func (s *Server) Listening() <-chan struct{} {
+	return s.listening
+}
+
+// Addr aspetta Listening e ritorna nil se Run è fallito prima di ascoltare.
+func (s *Server) Addr() net.Addr {
+	<-s.listening
+	return s.addr
+}
+
+// markListening fissa addr e chiude listening; conta solo la prima chiamata.
+func (s *Server) markListening(addr net.Addr) {
+	s.listenOnce.Do(func() {
+		s.addr = addr
+		close(s.listening)
+	})
+}
+
+// Run esegue i check di avvio, apre i listener e serve finché ctx non viene
+// cancellato; poi fa lo shutdown graceful e ritorna gli errori aggregati.
+func (s *Server) Run(ctx context.Context) error {
+	// su ogni ritorno anticipato Addr non deve restare bloccato
+	defer s.markListening(nil)
+	ln, err := listenAfterChecks(ctx, s.checks, s.cfg.StartupTimeout, s.cfg.Addr)
+	if err != nil {
+		return err
+	}
+	apps := []namedServer{{Name: "app", Srv: s.srv, Ln: ln}}
+
+	var admin *namedServer
+	if s.admin != nil {
+		adminLn, err := net.Listen("tcp", s.cfg.AdminAddr)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		admin = &namedServer{Name: "admin", Srv: s.admin, Ln: adminLn}
+		fmt.Printf("Admin server starting on %s\n", adminLn.Addr())
+	}
+
+	s.markListening(ln.Addr())
+	fmt.Printf("Server starting on %s\n", s.addr)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			logDraining(s.active, s.current().DrainLogEvery, s.cfg.ShutdownTimeout, finished)
+		case <-finished:
+		}
+	}()
+	return serveAll(ctx, apps, admin, s.cfg.ShutdownTimeout, NewMetricsFlusher(s.metrics, s.cfg.MetricsOut), s.ready)
+}
+
+// validate applica validateTimeouts ai timeout obbligatori di c.
+// RequestTimeout non c'è: zero vuol dire nessun limite.
+func (c Config) validate() error {
+	return validateTimeouts(map[string]time.Duration{
+		"shutdown-timeout": c.ShutdownTimeout,
+		"read-timeout":     c.ReadTimeout,
+		"write-timeout":    c.WriteTimeout,
+	})
+}
+
+// loadConfig legge il file JSON in path sopra base. Le chiavi sono i nomi
+// dei flag, le durate stringhe come "5s"; le chiavi assenti lasciano il
+// valore di base, così il file può contenere solo ciò che cambia.
+func loadConfig(path string, base Config) (Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer file.Close()
+	var f struct {
+		Addr            *string  `json:"addr"`
+		AdminAddr       *string  `json:"admin-addr"`
+		ShutdownTimeout *string  `json:"shutdown-timeout"`
+		ShutdownDelay   *string  `json:"shutdown-delay"`
+		ReadTimeout     *string  `json:"read-timeout"`
+		WriteTimeout    *string  `json:"write-timeout"`
+		RequestTimeout  *string  `json:"request-timeout"`
+		StartupTimeout  *string  `json:"startup-timeout"`
+		DrainLogEvery   *string  `json:"drain-log-every"`
+		CheckURLs       []string `json:"check-url"`
+		LogRequests     *bool    `json:"log-requests"`
+	}
+	dec := json.NewDecoder(file)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	cfg := base
+	if f.Addr != nil {
+		cfg.Addr = *f.Addr
+	}
+	if f.AdminAddr != nil {
+		cfg.AdminAddr = *f.AdminAddr
+	}
+	if f.CheckURLs != nil {
+		cfg.CheckURLs = f.CheckURLs
+	}
+	if f.LogRequests != nil {
+		cfg.LogRequests = *f.LogRequests
+	}
+	durations := []struct {
+		name string
+		src  *string
+		dst  *time.Duration
+	}{
+		{"shutdown-timeout", f.ShutdownTimeout, &cfg.ShutdownTimeout},
+		{"shutdown-delay", f.ShutdownDelay, &cfg.ShutdownDelay},
+		{"read-timeout", f.ReadTimeout, &cfg.ReadTimeout},
+		{"write-timeout", f.WriteTimeout, &cfg.WriteTimeout},
+		{"request-timeout", f.RequestTimeout, &cfg.RequestTimeout},
+		{"startup-timeout", f.StartupTimeout, &cfg.StartupTimeout},
+		{"drain-log-every", f.DrainLogEvery, &cfg.DrainLogEvery},
+	}
+	for _, d := range durations {
+		if d.src == nil {
+			continue
+		}
+		v, err := time.ParseDuration(*d.src)
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %s: %w", path, d.name, err)
+		}
+		*d.dst = v
+	}
+	if err := cfg.validate(); err != nil {
+		return Config{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// reloadOnSIGHUP rilegge path sopra base a ogni SIGHUP finché ctx è attivo.
+// Un file non valido viene loggato e la configurazione corrente resta.
+func reloadOnSIGHUP(ctx context.Context, s *Server, path string, base Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		}
+		if path == "" {
+			log.Println("reload: no -config file, nothing to reload")
+			continue
+		}
+		cfg, err := loadConfig(path, base)
+		if err != nil {
+			log.Printf("reload: %v", err)
+			continue
+		}
+		s.Reload(cfg)
+	}
+}
+
+func main() {
+	addr := flag.String("addr", ":8080", "indirizzo del server applicativo")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 15*time.Second, "tempo massimo per lo shutdown graceful")
+	shutdownDelay := flag.Duration("shutdown-delay", 0, "attesa con /readyz a 503 prima di chiudere i listener, per dare tempo al load balancer (0 = chiude subito)")
+	readTimeout := flag.Duration("read-timeout", 5*time.Second, "http.Server.ReadTimeout: tempo massimo per leggere una richiesta")
+	writeTimeout := flag.Duration("write-timeout", 5*time.Second, "http.Server.WriteTimeout: tempo massimo per scrivere una risposta")
+	requestTimeout := flag.Duration("request-timeout", 3*time.Second, "tempo massimo di un handler prima di rispondere 503, minore di -write-timeout (0 = nessun limite)")
+	drainLogEvery := flag.Duration("drain-log-every", time.Second, "intervallo del log delle richieste attive durante lo shutdown")
+	metricsFile := flag.String("metrics-file", "", "file su cui scrivere le metriche allo shutdown (default: log su stderr)")
+	adminAddr := flag.String("admin-addr", "", "indirizzo del server admin con /metrics, es. :8081 (vuoto = disabilitato)")
+	startupTimeout := flag.Duration("startup-timeout", 10*time.Second, "tempo massimo per i check di avvio")
+	logReqs := flag.Bool("log-requests", false, "logga metodo e path di ogni richiesta")
+	configFile := flag.String("config", "", "file JSON con le stesse chiavi dei flag, riletto su SIGHUP")
+	var checkURLs []string
+	flag.Func("check-url", "URL di una dipendenza che deve rispondere 2xx prima dell'avvio (ripetibile)", func(s string) error {
+		checkURLs = append(checkURLs, s)
+		return nil
+	})
+	flag.Parse()
+
+	base := Config{
+		Addr:            *addr,
+		AdminAddr:       *adminAddr,
+		ShutdownTimeout: *shutdownTimeout,
+		ShutdownDelay:   *shutdownDelay,
+		ReadTimeout:     *readTimeout,
+		WriteTimeout:    *writeTimeout,
+		RequestTimeout:  *requestTimeout,
+		StartupTimeout:  *startupTimeout,
+		DrainLogEvery:   *drainLogEvery,
+		CheckURLs:       checkURLs,
+		LogRequests:     *logReqs,
+	}
+	if err := base.validate(); err != nil {
+		log.Fatal(err)
+	}
+	cfg := base
+	if *configFile != "" {
+		var err error
+		if cfg, err = loadConfig(*configFile, base); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *metricsFile != "" {
+		f, err := os.Create(*metricsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		cfg.MetricsOut = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	fmt.Println("Server starting on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	srv := New(cfg)
+	go reloadOnSIGHUP(ctx, srv, *configFile, base)
+	if err := srv.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("Server stopped gracefully")
 }
@@ -0,0 +1,664 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricsFlushedOnShutdown(t *testing.T) {
+	metrics := NewMetrics()
+	var out bytes.Buffer
+	flusher := NewMetricsFlusher(metrics, &out)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {})
+	srv := &http.Server{Handler: countRequests(metrics, mux)}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, ln, 5*time.Second, flusher) }()
+
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+
+	got := out.String()
+	for _, want := range []string{"requests_total 3\n", "path:/hello 3\n"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("flushed output %q missing %q", got, want)
+		}
+	}
+}
+
+func TestServeAllAdminOutlivesApp(t *testing.T) {
+	metrics := NewMetrics()
+	flusher := NewMetricsFlusher(metrics, io.Discard)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	appMux := http.NewServeMux()
+	appMux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	appSrv := &http.Server{Handler: countRequests(metrics, appMux)}
+	adminSrv := &http.Server{Handler: metricsHandler(metrics, nil)}
+
+	var mu sync.Mutex
+	var order []string
+	appShutdown := make(chan struct{})
+	appSrv.RegisterOnShutdown(func() {
+		mu.Lock()
+		order = append(order, "app")
+		mu.Unlock()
+		close(appShutdown)
+	})
+	adminShutdown := make(chan struct{})
+	adminSrv.RegisterOnShutdown(func() {
+		mu.Lock()
+		order = append(order, "admin")
+		mu.Unlock()
+		close(adminShutdown)
+	})
+
+	appLn := listen(t)
+	adminLn := listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveAll(ctx,
+			[]namedServer{{Name: "app", Srv: appSrv, Ln: appLn}},
+			&namedServer{Name: "admin", Srv: adminSrv, Ln: adminLn},
+			5*time.Second, flusher, nil)
+	}()
+
+	slowDone := make(chan error, 1)
+	go func() {
+		resp, err := http.Get("http://" + appLn.Addr().String() + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		slowDone <- err
+	}()
+	<-started
+
+	cancel()
+	<-appShutdown
+	// l'app sta drenando la richiesta lenta: admin deve rispondere ancora
+	resp, err := http.Get("http://" + adminLn.Addr().String() + "/metrics")
+	if err != nil {
+		t.Fatalf("admin not reachable during app drain: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !strings.Contains(string(body), "path:/slow 1") {
+		t.Errorf("metrics = %q", body)
+	}
+
+	close(release)
+	if err := <-slowDone; err != nil {
+		t.Fatalf("in-flight request failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("serveAll: %v", err)
+	}
+	// gli hook di RegisterOnShutdown girano in goroutine separate
+	select {
+	case <-adminShutdown:
+	case <-time.After(time.Second):
+		t.Fatal("admin shutdown hook never ran")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(order) != 2 || order[0] != "app" || order[1] != "admin" {
+		t.Fatalf("shutdown order = %v, want [app admin]", order)
+	}
+	if _, err := net.DialTimeout("tcp", adminLn.Addr().String(), time.Second); err == nil {
+		t.Error("admin still accepting connections after serveAll returned")
+	}
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ln
+}
+
+func TestStartupChecksGateListening(t *testing.T) {
+	ok := func(ctx context.Context) error { return nil }
+	down := func(ctx context.Context) error { return errors.New("connection refused") }
+	hang := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+
+	passing := &StartupChecks{}
+	passing.Register("storage", ok)
+	passing.Register("cache", ok)
+	ln, err := listenAfterChecks(context.Background(), passing, time.Second, "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("passing checks: %v", err)
+	}
+	ln.Close()
+
+	failing := &StartupChecks{}
+	failing.Register("storage", ok)
+	failing.Register("db", down)
+	failing.Register("slow", hang)
+	ln, err = listenAfterChecks(context.Background(), failing, 50*time.Millisecond, "127.0.0.1:0")
+	if err == nil {
+		ln.Close()
+		t.Fatal("server started despite failing checks")
+	}
+	for _, want := range []string{"check db: connection refused", "check slow: context deadline exceeded"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q missing %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "storage") {
+		t.Errorf("passing check reported as failed: %v", err)
+	}
+}
+
+// TestServeAllDrainIsLossless manda un flusso continuo di richieste a un
+// handler lento e avvia lo shutdown a metà: ogni richiesta arrivata
+// all'handler deve ricevere la risposta completa, quelle partite dopo la
+// chiusura del listener devono essere rifiutate.
+func TestServeAllDrainIsLossless(t *testing.T) {
+	const clients = 8
+	body := strings.Repeat("x", 64*1024)
+
+	var mu sync.Mutex
+	handled := make(map[string]bool)
+	started := make(chan struct{}, 1024)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		handled[r.URL.Query().Get("id")] = true
+		mu.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+
+		// metà risposta, pausa, poi il resto: lo shutdown cade a metà scrittura
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		io.WriteString(w, body[:len(body)/2])
+		w.(http.Flusher).Flush()
+		time.Sleep(30 * time.Millisecond)
+		io.WriteString(w, body[len(body)/2:])
+	})
+	metrics := NewMetrics()
+	srv := &http.Server{Handler: countRequests(metrics, mux)}
+	ln := listen(t)
+	url := "http://" + ln.Addr().String() + "/slow?id="
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- serve(ctx, srv, ln, 5*time.Second, NewMetricsFlusher(metrics, io.Discard)) }()
+
+	// una connessione per richiesta, così quelle successive allo shutdown
+	// devono passare dal listener chiuso
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	type outcome struct {
+		id  string
+		err error
+	}
+	outcomes := make(chan outcome, 1024)
+	var wg sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				id := fmt.Sprintf("%d-%d", c, n)
+				resp, err := client.Get(url + id)
+				if err == nil {
+					var got []byte
+					got, err = io.ReadAll(resp.Body)
+					resp.Body.Close()
+					if err == nil && string(got) != body {
+						err = fmt.Errorf("truncated response: %d of %d bytes", len(got), len(body))
+					}
+				}
+				outcomes <- outcome{id, err}
+				if err != nil {
+					return
+				}
+			}
+		}(c)
+	}
+
+	for i := 0; i < 3*clients; i++ {
+		<-started
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("serve: %v", err)
+	}
+	wg.Wait()
+	close(outcomes)
+
+	mu.Lock()
+	defer mu.Unlock()
+	completed := 0
+	for o := range outcomes {
+		switch {
+		case o.err == nil:
+			completed++
+		case handled[o.id]:
+			t.Errorf("request %s reached the handler but failed: %v", o.id, o.err)
+		}
+	}
+	if completed != len(handled) {
+		t.Errorf("completed %d requests, handler saw %d", completed, len(handled))
+	}
+	if completed < 3*clients {
+		t.Errorf("completed = %d, want at least %d", completed, 3*clients)
+	}
+
+	_, err := client.Get(url + "late")
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Fatalf("request after shutdown: err = %v, want a dial error", err)
+	}
+}
+
+func TestValidateTimeouts(t *testing.T) {
+	if err := validateTimeouts(map[string]time.Duration{"read-timeout": time.Second}); err != nil {
+		t.Fatalf("valid timeout rejected: %v", err)
+	}
+	err := validateTimeouts(map[string]time.Duration{
+		"shutdown-timeout": 0,
+		"read-timeout":     5 * time.Second,
+		"write-timeout":    -time.Second,
+	})
+	if err == nil {
+		t.Fatal("zero and negative timeouts accepted")
+	}
+	want := "-shutdown-timeout deve essere positivo, non 0s\n-write-timeout deve essere positivo, non -1s"
+	if err.Error() != want {
+		t.Errorf("err = %q, want %q", err, want)
+	}
+}
+
+func TestReadinessEndpoints(t *testing.T) {
+	ready := &Readiness{}
+	get := func(h http.Handler, path string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+
+	if code := get(readyzHandler(ready), "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz before shutdown = %d, want 200", code)
+	}
+	ready.StartShutdown()
+	if code := get(readyzHandler(ready), "/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("/readyz during shutdown = %d, want 503", code)
+	}
+	if code := get(healthzHandler(), "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz during shutdown = %d, want 200", code)
+	}
+	var none *Readiness
+	if code := get(readyzHandler(none), "/readyz"); code != http.StatusOK {
+		t.Errorf("/readyz with nil Readiness = %d, want 200", code)
+	}
+}
+
+func TestServeAllFlipsReadinessFirst(t *testing.T) {
+	ready := &Readiness{}
+	appSrv := &http.Server{Handler: http.NewServeMux()}
+	var readyAtShutdown atomic.Bool
+	readyAtShutdown.Store(true)
+	appSrv.RegisterOnShutdown(func() { readyAtShutdown.Store(ready.Ready()) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := serveAll(ctx, []namedServer{{Name: "app", Srv: appSrv, Ln: listen(t)}}, nil,
+		time.Second, NewMetricsFlusher(NewMetrics(), io.Discard), ready)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ready.Ready() {
+		t.Error("still ready after serveAll returned")
+	}
+	// RegisterOnShutdown gira in una goroutine: aspettiamo che abbia registrato
+	deadline := time.Now().Add(time.Second)
+	for readyAtShutdown.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if readyAtShutdown.Load() {
+		t.Error("server shutdown began while /readyz still reported ready")
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, "ok") })
+	ts := httptest.NewServer(recoverMiddleware(timeoutMiddleware(time.Second)(mux)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/panic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("/panic status = %d, want 500", resp.StatusCode)
+	}
+	if !strings.Contains(logs.String(), "panic serving /panic: boom") {
+		t.Errorf("log = %q, want the panic with its path", logs.String())
+	}
+
+	// il server deve essere ancora su
+	resp, err = http.Get(ts.URL + "/ok")
+	if err != nil {
+		t.Fatalf("server down after panic: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/ok status = %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	rec := httptest.NewRecorder()
+	timeoutMiddleware(20*time.Millisecond)(slow).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", rec.Code)
+	}
+}
+
+func TestServerRun(t *testing.T) {
+	var out bytes.Buffer
+	srv := New(Config{
+		Addr:            "127.0.0.1:0",
+		ShutdownTimeout: 5 * time.Second,
+		RequestTimeout:  time.Second,
+		MetricsOut:      &out,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- srv.Run(ctx) }()
+	select {
+	case <-srv.Listening():
+	case err := <-done:
+		t.Fatalf("Run returned before listening: %v", err)
+	}
+
+	// senza keep-alive il transport non lascia connessioni aperte e mai
+	// usate, che Shutdown considererebbe idle solo dopo qualche secondo
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}, Timeout: 5 * time.Second}
+	base := "http://" + srv.Addr().String()
+	for _, path := range []string{"/", "/healthz", "/readyz"} {
+		resp, err := client.Get(base + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s = %d, want 200", path, resp.StatusCode)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !strings.Contains(out.String(), "requests_total 3\n") {
+		t.Errorf("flushed metrics = %q", out.String())
+	}
+	if _, err := client.Get(base + "/"); err == nil {
+		t.Error("server still answering after Run returned")
+	}
+}
+
+func TestActiveRequestsDuringDrain(t *testing.T) {
+	active := &ActiveRequests{}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	blocked := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+	ts := httptest.NewServer(trackActive(active, blocked))
+	defer ts.Close()
+
+	reqDone := make(chan error, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		reqDone <- err
+	}()
+	<-started
+
+	if n := active.Load(); n != 1 {
+		t.Fatalf("active = %d while the handler is blocked, want 1", n)
+	}
+	rec := httptest.NewRecorder()
+	metricsHandler(NewMetrics(), active).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "active_requests 1\n") {
+		t.Errorf("metrics = %q, want active_requests 1", rec.Body.String())
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	drained := make(chan struct{})
+	go func() {
+		logDraining(active, 5*time.Millisecond, 5*time.Second, nil)
+		close(drained)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if err := <-reqDone; err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatal("logDraining did not stop when the count reached zero")
+	}
+	if n := active.Load(); n != 0 {
+		t.Errorf("active = %d after the handler returned, want 0", n)
+	}
+	if !strings.Contains(logs.String(), "draining: 1 active connections") {
+		t.Errorf("log = %q, want a draining line", logs.String())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	base := Config{Addr: ":8080", ShutdownTimeout: 15 * time.Second, ReadTimeout: 5 * time.Second,
+		WriteTimeout: 5 * time.Second, RequestTimeout: 3 * time.Second}
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	os.WriteFile(path, []byte(`{"request-timeout": "250ms", "log-requests": true}`), 0o644)
+	cfg, err := loadConfig(path, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RequestTimeout != 250*time.Millisecond || !cfg.LogRequests || cfg.Addr != ":8080" {
+		t.Errorf("cfg = %+v, want the file on top of base", cfg)
+	}
+
+	// request-timeout a zero toglie il limite, non è un errore
+	os.WriteFile(path, []byte(`{"request-timeout": "0s"}`), 0o644)
+	if cfg, err := loadConfig(path, base); err != nil || cfg.RequestTimeout != 0 {
+		t.Errorf("request-timeout 0s: cfg = %+v, err = %v", cfg, err)
+	}
+
+	for body, want := range map[string]string{
+		`{"request-timeout": "soon"}`: "request-timeout: time: invalid duration",
+		`{"write-timeout": "0s"}`:     "-write-timeout deve essere positivo",
+		`{"log-level": "debug"}`:      `unknown field "log-level"`,
+	} {
+		os.WriteFile(path, []byte(body), 0o644)
+		if _, err := loadConfig(path, base); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loadConfig(%s) err = %v, want %q", body, err, want)
+		}
+	}
+}
+
+func TestReloadWhileServing(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{Addr: "127.0.0.1:0", ShutdownTimeout: 5 * time.Second, RequestTimeout: 5 * time.Second}
+	srv := New(cfg)
+	slowStarted := make(chan struct{}, 1)
+	release := make(chan struct{})
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slowStarted <- struct{}{}:
+		default:
+		}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}
+	// la mux di New non è esposta: ricostruiamo la stessa catena sopra slow
+	handler := srv.logRequests(recoverMiddleware(srv.requestTimeout(trackActive(srv.active, http.HandlerFunc(slow)))))
+	ts := httptest.NewServer(handler)
+	defer ts.Close()
+	defer close(release)
+
+	// una richiesta in corso con il timeout di avvio non viene toccata dal reload
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(ts.URL)
+		if err != nil {
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-slowStarted
+
+	next := cfg
+	next.RequestTimeout = 20 * time.Millisecond
+	next.Addr = ":9999"
+	srv.Reload(next)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status after reload = %d, want 503 from the new timeout", resp.StatusCode)
+	}
+	select {
+	case code := <-inFlight:
+		t.Fatalf("in-flight request finished early with %d", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+	release <- struct{}{}
+	if code := <-inFlight; code != http.StatusOK {
+		t.Errorf("in-flight status = %d, want 200", code)
+	}
+
+	if got := srv.current().Addr; got != "127.0.0.1:0" {
+		t.Errorf("addr reloaded to %q, want it unchanged", got)
+	}
+	if !strings.Contains(logs.String(), "reload: addr needs a restart, ignored") {
+		t.Errorf("log = %q, want addr reported as ignored", logs.String())
+	}
+}
+
+func TestServerRunFailureUnblocksAddr(t *testing.T) {
+	srv := New(Config{Addr: "127.0.0.1:-1", ShutdownTimeout: time.Second})
+	if err := srv.Run(context.Background()); err == nil {
+		t.Fatal("Run on an invalid address succeeded")
+	}
+	done := make(chan net.Addr, 1)
+	go func() { done <- srv.Addr() }()
+	select {
+	case addr := <-done:
+		if addr != nil {
+			t.Errorf("Addr after a failed Run = %v, want nil", addr)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Addr blocked after a failed Run")
+	}
+}
+
+func TestReadinessGraceKeepsAppListening(t *testing.T) {
+	ready := &Readiness{Grace: 200 * time.Millisecond}
+	mux := http.NewServeMux()
+	mux.Handle("/readyz", readyzHandler(ready))
+	ln := listen(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- serveAll(ctx, []namedServer{{Name: "app", Srv: &http.Server{Handler: mux}, Ln: ln}}, nil,
+			time.Second, NewMetricsFlusher(NewMetrics(), io.Discard), ready)
+	}()
+
+	cancel()
+	for ready.Ready() {
+		time.Sleep(time.Millisecond)
+	}
+	// durante la grace il 503 arriva dalla porta dell'app stessa
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + ln.Addr().String() + "/readyz")
+	if err != nil {
+		t.Fatalf("app port closed during the grace period: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("/readyz during grace = %d, want 503", resp.StatusCode)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
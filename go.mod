@@ -5,6 +5,8 @@ go 1.25.4
 require (
 	github.com/spf13/cobra v1.10.2
 	golang.org/x/net v0.49.0
+	golang.org/x/text v0.33.0
+	golang.org/x/text v0.33.0
 )
 
 require (
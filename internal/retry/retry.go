@@ -0,0 +1,104 @@
+// Package retry fornisce un helper di retry con backoff esponenziale
+// condiviso tra gli esercizi.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ErrPermanent marca gli errori che non devono essere ritentati.
+// Si usa tramite Permanent e si verifica con errors.Is.
+var ErrPermanent = errors.New("permanent error")
+
+type permanentError struct {
+	err error
+}
+
+func (p *permanentError) Error() string        { return p.err.Error() }
+func (p *permanentError) Unwrap() error        { return p.err }
+func (p *permanentError) Is(target error) bool { return target == ErrPermanent }
+
+// Permanent avvolge err in modo che Do smetta subito di ritentare.
+// Un err nil resta nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+type RetryPolicy struct {
+	MaxAttempts int           // tentativi totali, <= 0 vale 1
+	BaseDelay   time.Duration // attesa dopo il primo fallimento
+	Multiplier  float64       // fattore di crescita, <= 0 vale 2
+	MaxDelay    time.Duration // tetto all'attesa, 0 = nessun limite
+	Jitter      float64       // frazione in [0,1] di variazione casuale (+/-)
+}
+
+// Delay ritorna l'attesa dopo il tentativo attempt (0-based), senza jitter.
+func (p RetryPolicy) Delay(attempt int) time.Duration {
+	mult := p.Multiplier
+	if mult <= 0 {
+		mult = 2
+	}
+	d := float64(p.BaseDelay)
+	for i := 0; i < attempt; i++ {
+		d *= mult
+		if p.MaxDelay > 0 && d >= float64(p.MaxDelay) {
+			return p.MaxDelay
+		}
+	}
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		return p.MaxDelay
+	}
+	return time.Duration(d)
+}
+
+// jittered applica il jitter a Delay; rnd deve ritornare valori in [0,1).
+func (p RetryPolicy) jittered(attempt int, rnd func() float64) time.Duration {
+	d := p.Delay(attempt)
+	j := p.Jitter
+	if j <= 0 {
+		return d
+	}
+	if j > 1 {
+		j = 1
+	}
+	return time.Duration(float64(d) * (1 + j*(2*rnd()-1)))
+}
+
+// Do esegue fn finché non ha successo, ritorna un errore Permanent,
+// esaurisce i tentativi o ctx viene cancellato. Ritorna l'ultimo errore di fn,
+// oppure ctx.Err() se il contesto termina prima.
+func Do(ctx context.Context, policy RetryPolicy, fn func() error) error {
+	attempts := policy.MaxAttempts
+	if attempts <= 0 {
+		attempts = 1
+	}
+
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		err = fn()
+		if err == nil || errors.Is(err, ErrPermanent) {
+			return err
+		}
+		if attempt == attempts-1 {
+			break
+		}
+
+		timer := time.NewTimer(policy.jittered(attempt, rand.Float64))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return err
+}
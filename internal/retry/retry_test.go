@@ -0,0 +1,70 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDelaySchedule(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 10 * time.Millisecond, Multiplier: 2, MaxDelay: 50 * time.Millisecond}
+	want := []time.Duration{10, 20, 40, 50, 50}
+	for i, w := range want {
+		if got := p.Delay(i); got != w*time.Millisecond {
+			t.Errorf("Delay(%d) = %s, want %s", i, got, w*time.Millisecond)
+		}
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	p := RetryPolicy{BaseDelay: 100 * time.Millisecond, Multiplier: 2, Jitter: 0.25}
+	for _, r := range []float64{0, 0.1, 0.5, 0.9, 0.999} {
+		got := p.jittered(1, func() float64 { return r })
+		if got < 150*time.Millisecond || got > 250*time.Millisecond {
+			t.Errorf("jitter r=%v: %s out of [150ms, 250ms]", r, got)
+		}
+	}
+}
+
+func TestDoRetriesUntilSuccess(t *testing.T) {
+	calls := 0
+	err := Do(context.Background(), RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("err=%v calls=%d, want nil and 3", err, calls)
+	}
+}
+
+func TestDoPermanentShortCircuit(t *testing.T) {
+	base := errors.New("bad request")
+	calls := 0
+	err := Do(context.Background(), RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond}, func() error {
+		calls++
+		return Permanent(base)
+	})
+	if calls != 1 {
+		t.Fatalf("calls = %d, want 1", calls)
+	}
+	if !errors.Is(err, ErrPermanent) || !errors.Is(err, base) {
+		t.Fatalf("err = %v, want permanent wrapping base", err)
+	}
+}
+
+func TestDoStopsOnContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Do(ctx, RetryPolicy{MaxAttempts: 10, BaseDelay: time.Hour}, func() error {
+		calls++
+		cancel()
+		return errors.New("transient")
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Fatalf("err=%v calls=%d, want context.Canceled and 1", err, calls)
+	}
+}
@@ -0,0 +1,66 @@
+// Package semaphore fornisce un semaforo contatore basato su un canale
+// bufferizzato, condiviso tra gli esercizi.
+package semaphore
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrOverRelease è il valore del panic di Release chiamata senza un Acquire
+// corrispondente.
+var ErrOverRelease = errors.New("semaphore: release without acquire")
+
+// Semaphore limita a n i possessori contemporanei. Lo zero value non è
+// utilizzabile: va creato con New.
+type Semaphore struct {
+	slots chan struct{}
+}
+
+// New crea un semaforo con n slot; n < 1 vale 1.
+func New(n int) *Semaphore {
+	if n < 1 {
+		n = 1
+	}
+	return &Semaphore{slots: make(chan struct{}, n)}
+}
+
+// Acquire attende uno slot libero o la cancellazione di ctx, nel qual caso
+// ritorna ctx.Err() senza occupare slot.
+func (s *Semaphore) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// TryAcquire occupa uno slot solo se è libero subito.
+func (s *Semaphore) TryAcquire() bool {
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release libera uno slot. Chiamarla più volte degli Acquire riusciti è un
+// bug del chiamante: invece di alterare il conteggio va in panic con
+// ErrOverRelease, come fa sync.Mutex con un Unlock di troppo.
+func (s *Semaphore) Release() {
+	select {
+	case <-s.slots:
+	default:
+		panic(ErrOverRelease)
+	}
+}
+
+// InUse ritorna il numero di slot occupati in questo momento.
+func (s *Semaphore) InUse() int {
+	return len(s.slots)
+}
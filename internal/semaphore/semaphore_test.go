@@ -0,0 +1,69 @@
+package semaphore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireReleaseAccounting(t *testing.T) {
+	s := New(2)
+	ctx := context.Background()
+	if err := s.Acquire(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if !s.TryAcquire() {
+		t.Fatal("second slot should be free")
+	}
+	if s.TryAcquire() {
+		t.Fatal("TryAcquire succeeded on a full semaphore")
+	}
+	if s.InUse() != 2 {
+		t.Fatalf("InUse = %d, want 2", s.InUse())
+	}
+	s.Release()
+	if s.InUse() != 1 || !s.TryAcquire() {
+		t.Fatalf("slot not returned by Release: InUse = %d", s.InUse())
+	}
+	s.Release()
+	s.Release()
+	if s.InUse() != 0 {
+		t.Fatalf("InUse = %d, want 0", s.InUse())
+	}
+}
+
+func TestAcquireCancelledWhileBlocked(t *testing.T) {
+	s := New(1)
+	s.TryAcquire()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Acquire(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Acquire = %v, want DeadlineExceeded", err)
+	}
+	if s.InUse() != 1 {
+		t.Fatalf("cancelled Acquire took a slot: InUse = %d", s.InUse())
+	}
+
+	// con il context già cancellato non prende lo slot nemmeno se è libero
+	s.Release()
+	if err := s.Acquire(ctx); err == nil || s.InUse() != 0 {
+		t.Fatalf("Acquire on done ctx = %v, InUse = %d", err, s.InUse())
+	}
+}
+
+func TestReleaseWithoutAcquirePanics(t *testing.T) {
+	s := New(1)
+	defer func() {
+		r := recover()
+		err, ok := r.(error)
+		if !ok || !errors.Is(err, ErrOverRelease) {
+			t.Fatalf("recover() = %v, want ErrOverRelease", r)
+		}
+		if s.InUse() != 0 {
+			t.Errorf("InUse after over-release = %d", s.InUse())
+		}
+	}()
+	s.Release()
+}